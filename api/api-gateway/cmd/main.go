@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"go-rabbitmq-order-system/api-gateway/internal/app"
 	"go-rabbitmq-order-system/api-gateway/internal/config"
@@ -18,9 +22,13 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
+	// Shut down gracefully on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize and run application
 	application := app.New(cfg)
-	if err := application.Run(); err != nil {
+	if err := application.Run(ctx); err != nil {
 		log.Fatal("Failed to run application:", err)
 	}
 } 
\ No newline at end of file
@@ -1,15 +1,21 @@
 package app
 
 import (
+	"context"
 	"log"
 	"net/http"
 
 	"go-rabbitmq-order-system/api-gateway/internal/config"
 	"go-rabbitmq-order-system/api-gateway/internal/handler"
 	"go-rabbitmq-order-system/api-gateway/internal/middleware"
+	"go-rabbitmq-order-system/api-gateway/internal/stream"
 	commonMiddleware "go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/pkg/server"
+	"go-rabbitmq-order-system/pkg/tracing"
+	"go-rabbitmq-order-system/shared"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type App struct {
@@ -23,15 +29,56 @@ func New(cfg *config.Config) *App {
 	}
 }
 
-func (a *App) Run() error {
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, "api-gateway", a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.ShutdownTimeout)
+
+	// The order stream replays missed status changes from the event store.
+	// The gateway still proxies requests without the database.
+	db, err := shared.NewDatabase(a.config.Database.URL)
+	if err != nil {
+		log.Printf("Order stream disabled: %v", err)
+	} else {
+		defer db.Close()
+	}
+
+	// Connect to RabbitMQ for the dead-letter admin API and the order
+	// stream. The gateway still serves traffic when the broker is down.
+	options := []shared.Option{
+		shared.WithReconnectBackoff(a.config.RabbitMQ.ReconnectDelay, a.config.RabbitMQ.MaxReconnectDelay),
+		shared.WithPublishTimeout(a.config.RabbitMQ.PublishTimeout),
+		shared.WithStateHook(shared.LogConnectionState("api-gateway")),
+		shared.WithInbox(stream.Inbox),
+	}
+	var deadLetters handler.DeadLetters
+	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL, options...)
+	if err != nil {
+		log.Printf("Dead-letter admin API disabled: %v", err)
+	} else {
+		deadLetters = rabbitmq
+		defer rabbitmq.Close()
+	}
+
+	var orderStream *stream.Hub
+	if db != nil && rabbitmq != nil {
+		orderStream, err = a.startOrderStream(ctx, db, rabbitmq)
+		if err != nil {
+			log.Printf("Order stream disabled: %v", err)
+		}
+	}
+
 	// Initialize handler
-	h := handler.New(a.config)
+	h := handler.New(a.config, deadLetters, orderStream)
 
 	// Setup router
 	a.setupRouter(h)
 
 	// Create HTTP server with timeouts
-	server := &http.Server{
+	srv := &http.Server{
 		Addr:         ":" + a.config.Server.Port,
 		Handler:      a.router,
 		ReadTimeout:  a.config.Server.ReadTimeout,
@@ -40,7 +87,26 @@ func (a *App) Run() error {
 	}
 
 	log.Printf("API Gateway started on port %s", a.config.Server.Port)
-	return server.ListenAndServe()
+	return server.Run(ctx, srv, a.config.ShutdownTimeout)
+}
+
+// startOrderStream consumes the order status changes and fans them out to
+// the clients connected to the stream endpoints
+func (a *App) startOrderStream(ctx context.Context, db *shared.Database, rabbitmq *shared.RabbitMQ) (*stream.Hub, error) {
+	if err := rabbitmq.SetupExchange(); err != nil {
+		return nil, err
+	}
+	// Each instance streams every status change from its own queue
+	queueName := shared.StreamQueue(uuid.New().String())
+	if err := rabbitmq.SetupQueue(queueName); err != nil {
+		return nil, err
+	}
+
+	hub := stream.NewHub(shared.NewEventStore(db.DB), a.config.Stream.ClientBuffer, a.config.Stream.ResumeLimit)
+	if err := rabbitmq.ConsumeEvents(ctx, queueName, hub.HandleOrderEvent); err != nil {
+		return nil, err
+	}
+	return hub, nil
 }
 
 func (a *App) setupRouter(h *handler.Handler) {
@@ -48,6 +114,7 @@ func (a *App) setupRouter(h *handler.Handler) {
 
 	// Other middleware (NO CORS here, handled in proxy)
 	r.Use(commonMiddleware.RequestID())
+	r.Use(tracing.Middleware())
 	r.Use(commonMiddleware.StructuredLogger("api-gateway"))
 	r.Use(commonMiddleware.Recovery("api-gateway"))
 
@@ -67,6 +134,20 @@ func (a *App) setupRouter(h *handler.Handler) {
 	{
 		admin.GET("/status", h.AdminStatus)
 		admin.GET("/metrics", h.Metrics)
+
+		// Dead-lettered (parked) messages per service queue
+		admin.GET("/dlq", h.ListDeadLetters)
+		admin.GET("/dlq/:queue", h.ListQueueDeadLetters)
+		admin.GET("/dlq/:queue/:id", h.GetDeadLetter)
+		admin.POST("/dlq/:queue/replay", h.ReplayDeadLetters)
+		admin.POST("/dlq/:queue/purge", h.PurgeDeadLetters)
+
+		// Cancel any user's order
+		admin.POST("/orders/:id/cancel", h.AdminCancelOrder)
+
+		// Refund an order's payment and show its ledger
+		admin.POST("/orders/:id/refunds", h.AdminRefundOrder)
+		admin.GET("/orders/:id/payments", h.AdminOrderPayments)
 	}
 
 	// API routes with proxy
@@ -78,8 +159,19 @@ func (a *App) setupRouter(h *handler.Handler) {
 			orders.OPTIONS("", h.ProxyToOrderCreation)        // preflight for POST /orders
 			orders.OPTIONS("/:id", h.ProxyToOrderCreation)   // preflight for GET /orders/:id
 			orders.GET("", h.ProxyToOrderCreation)           // GET all orders
+			orders.OPTIONS("/stream", h.StreamOrders)        // preflight for GET /orders/stream
+			orders.GET("/stream", h.StreamOrders)            // status changes as Server-Sent Events
+			orders.GET("/stream/ws", h.StreamOrdersWebSocket) // status changes over a WebSocket
+			orders.OPTIONS("/stream/ticket", h.IssueStreamTicket) // preflight for POST /orders/stream/ticket
+			orders.POST("/stream/ticket", h.IssueStreamTicket)    // short-lived ticket to open a stream with
 			orders.POST("", h.ProxyToOrderCreation)
 			orders.GET("/:id", h.ProxyToOrderCreation)
+			orders.OPTIONS("/:id/cancel", h.ProxyToOrderCreation) // preflight for POST /orders/:id/cancel
+			orders.POST("/:id/cancel", h.CancelOrder)
+
+			// Order Status Service routes
+			orders.OPTIONS("/:id/history", h.ProxyToOrderStatus) // preflight for GET /orders/:id/history
+			orders.GET("/:id/history", h.ProxyToOrderStatus)
 		}
 
 		// Product routes
@@ -13,6 +13,7 @@ type Config struct {
 	RateLimit RateLimitConfig
 	Proxy     ProxyConfig
 	Auth      AuthConfig
+	Stream    StreamConfig
 }
 
 type ServerConfig struct {
@@ -45,6 +46,15 @@ type AuthConfig struct {
 	RequireAuth  bool
 }
 
+// StreamConfig controls the order status stream
+type StreamConfig struct {
+	HeartbeatInterval time.Duration
+	ClientBuffer      int // status changes queued per client before it is dropped
+	ResumeLimit       int // most status changes replayed to a reconnecting client
+	TicketSecret      string
+	TicketTTL         time.Duration // how long a client has to open the stream with a ticket
+}
+
 func Load() *Config {
 	baseConfig := config.LoadBaseConfig()
 	
@@ -76,6 +86,13 @@ func Load() *Config {
 			TokenExpiry:  getEnvAsDuration("TOKEN_EXPIRY", "24h"),
 			RequireAuth:  getEnvAsBool("REQUIRE_AUTH", false),
 		},
+		Stream: StreamConfig{
+			HeartbeatInterval: getEnvAsDuration("STREAM_HEARTBEAT_INTERVAL", "15s"),
+			ClientBuffer:      getEnvAsInt("STREAM_CLIENT_BUFFER", 64),
+			ResumeLimit:       getEnvAsInt("STREAM_RESUME_LIMIT", 500),
+			TicketSecret:      getEnv("STREAM_TICKET_SECRET", "stream-ticket-secret"),
+			TicketTTL:         getEnvAsDuration("STREAM_TICKET_TTL", "30s"),
+		},
 	}
 }
 
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeadLetters reads and acts on the messages parked for each service queue
+type DeadLetters interface {
+	ListParked(queueName string, limit int) ([]shared.ParkedMessage, error)
+	ReplayParked(ctx context.Context, queueName string, messageIDs []string) (int, error)
+	PurgeParked(queueName string, messageIDs []string) (int, error)
+}
+
+// dlqSelection selects parked messages to replay or purge
+type dlqSelection struct {
+	MessageIDs []string `json:"message_ids"`
+	All        bool     `json:"all"`
+}
+
+// ListDeadLetters lists the parked messages of every service queue without
+// their payloads
+func (h *Handler) ListDeadLetters(c *gin.Context) {
+	if !h.deadLettersAvailable(c) {
+		return
+	}
+	limit := parseLimit(c, 50)
+
+	queues := make([]string, 0, len(shared.QueueBindings))
+	for queueName := range shared.QueueBindings {
+		queues = append(queues, queueName)
+	}
+	sort.Strings(queues)
+
+	result := gin.H{}
+	for _, queueName := range queues {
+		messages, err := h.deadLetters.ListParked(queueName, limit)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "queue": queueName})
+			return
+		}
+		result[queueName] = withoutPayloads(messages)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queues":    result,
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// ListQueueDeadLetters lists the parked messages of one service queue
+// without their payloads
+func (h *Handler) ListQueueDeadLetters(c *gin.Context) {
+	if !h.deadLettersAvailable(c) || !knownQueue(c) {
+		return
+	}
+
+	messages, err := h.deadLetters.ListParked(c.Param("queue"), parseLimit(c, 50))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queue":    c.Param("queue"),
+		"messages": withoutPayloads(messages),
+		"count":    len(messages),
+	})
+}
+
+// GetDeadLetter shows one parked message with its payload
+func (h *Handler) GetDeadLetter(c *gin.Context) {
+	if !h.deadLettersAvailable(c) || !knownQueue(c) {
+		return
+	}
+
+	messages, err := h.deadLetters.ListParked(c.Param("queue"), 0)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, message := range messages {
+		if message.MessageID == c.Param("id") {
+			c.JSON(http.StatusOK, message)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Parked message not found"})
+}
+
+// ReplayDeadLetters sends selected parked messages back to their queue
+func (h *Handler) ReplayDeadLetters(c *gin.Context) {
+	if !h.deadLettersAvailable(c) || !knownQueue(c) {
+		return
+	}
+
+	var selection dlqSelection
+	if err := c.ShouldBindJSON(&selection); err != nil || len(selection.MessageIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message_ids is required"})
+		return
+	}
+
+	replayed, err := h.deadLetters.ReplayParked(c.Request.Context(), c.Param("queue"), selection.MessageIDs)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "replayed": replayed})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queue":     c.Param("queue"),
+		"requested": len(selection.MessageIDs),
+		"replayed":  replayed,
+	})
+}
+
+// PurgeDeadLetters drops selected parked messages, or all of them with
+// {"all": true}
+func (h *Handler) PurgeDeadLetters(c *gin.Context) {
+	if !h.deadLettersAvailable(c) || !knownQueue(c) {
+		return
+	}
+
+	var selection dlqSelection
+	if err := c.ShouldBindJSON(&selection); err != nil || (len(selection.MessageIDs) == 0 && !selection.All) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message_ids or all is required"})
+		return
+	}
+	if selection.All {
+		selection.MessageIDs = nil
+	}
+
+	purged, err := h.deadLetters.PurgeParked(c.Param("queue"), selection.MessageIDs)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "purged": purged})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queue":  c.Param("queue"),
+		"purged": purged,
+	})
+}
+
+func (h *Handler) deadLettersAvailable(c *gin.Context) bool {
+	if h.deadLetters == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Not connected to RabbitMQ"})
+		return false
+	}
+	return true
+}
+
+func knownQueue(c *gin.Context) bool {
+	if _, ok := shared.QueueBindings[c.Param("queue")]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown queue"})
+		return false
+	}
+	return true
+}
+
+func parseLimit(c *gin.Context, defaultLimit int) int {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+func withoutPayloads(messages []shared.ParkedMessage) []shared.ParkedMessage {
+	for i := range messages {
+		messages[i].Payload = nil
+	}
+	if messages == nil {
+		return []shared.ParkedMessage{}
+	}
+	return messages
+}
@@ -4,9 +4,13 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 
 	"go-rabbitmq-order-system/api-gateway/internal/config"
+	"go-rabbitmq-order-system/api-gateway/internal/stream"
+	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/pkg/tracing"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,26 +18,51 @@ import (
 type Handler struct {
 	config             *config.Config
 	orderCreationProxy *httputil.ReverseProxy
+	orderStatusProxy   *httputil.ReverseProxy
+	paymentProxy       *httputil.ReverseProxy
 	authServiceProxy   *httputil.ReverseProxy
+	deadLetters        DeadLetters
+	orderStream        *stream.Hub
+	streamTickets      *stream.Tickets
+	auth               *middleware.AuthMiddleware
 }
 
-func New(cfg *config.Config) *Handler {
+// New creates the gateway handler. deadLetters may be nil when RabbitMQ is
+// unreachable; the DLQ endpoints then answer 503. orderStream is nil when
+// the order stream is disabled, and the stream endpoints answer 503 too.
+func New(cfg *config.Config, deadLetters DeadLetters, orderStream *stream.Hub) *Handler {
 	// Create reverse proxy for order creation service
 	orderCreationURL, _ := url.Parse(cfg.Proxy.OrderCreationURL)
 	orderCreationProxy := httputil.NewSingleHostReverseProxy(orderCreationURL)
 
+	// Create reverse proxy for order status service
+	orderStatusURL, _ := url.Parse(cfg.Proxy.OrderStatusURL)
+	orderStatusProxy := httputil.NewSingleHostReverseProxy(orderStatusURL)
+
+	// Create reverse proxy for payment service
+	paymentURL, _ := url.Parse(cfg.Proxy.PaymentURL)
+	paymentProxy := httputil.NewSingleHostReverseProxy(paymentURL)
+
 	// Create reverse proxy for auth service
 	authServiceURL, _ := url.Parse(cfg.Proxy.AuthServiceURL)
 	authServiceProxy := httputil.NewSingleHostReverseProxy(authServiceURL)
 
-	// Configure proxy with timeout
-	orderCreationProxy.Transport = &http.Transport{
+	// Configure proxy with timeout, passing the trace on to the backend
+	orderCreationProxy.Transport = tracing.Transport(&http.Transport{
 		ResponseHeaderTimeout: cfg.Proxy.Timeout,
-	}
+	})
 
-	authServiceProxy.Transport = &http.Transport{
+	orderStatusProxy.Transport = tracing.Transport(&http.Transport{
 		ResponseHeaderTimeout: cfg.Proxy.Timeout,
-	}
+	})
+
+	paymentProxy.Transport = tracing.Transport(&http.Transport{
+		ResponseHeaderTimeout: cfg.Proxy.Timeout,
+	})
+
+	authServiceProxy.Transport = tracing.Transport(&http.Transport{
+		ResponseHeaderTimeout: cfg.Proxy.Timeout,
+	})
 
 	// Configure proxy to handle headers properly
 	orderCreationProxy.ModifyResponse = func(resp *http.Response) error {
@@ -49,6 +78,9 @@ func New(cfg *config.Config) *Handler {
 		return nil
 	}
 
+	orderStatusProxy.ModifyResponse = orderCreationProxy.ModifyResponse
+	paymentProxy.ModifyResponse = orderCreationProxy.ModifyResponse
+
 	authServiceProxy.ModifyResponse = func(resp *http.Response) error {
 		// Remove any CORS headers from backend to prevent duplicates
 		resp.Header.Del("Access-Control-Allow-Origin")
@@ -65,7 +97,13 @@ func New(cfg *config.Config) *Handler {
 	return &Handler{
 		config:             cfg,
 		orderCreationProxy: orderCreationProxy,
+		orderStatusProxy:   orderStatusProxy,
+		paymentProxy:       paymentProxy,
 		authServiceProxy:   authServiceProxy,
+		deadLetters:        deadLetters,
+		orderStream:        orderStream,
+		streamTickets:      stream.NewTickets(cfg.Stream.TicketSecret, cfg.Stream.TicketTTL),
+		auth:               middleware.NewAuthMiddleware(cfg.Proxy.AuthServiceURL),
 	}
 }
 
@@ -87,10 +125,10 @@ func (h *Handler) AdminStatus(c *gin.Context) {
 		"status": "healthy",
 		"services": gin.H{
 			"order-creation": h.checkServiceHealth(h.config.Proxy.OrderCreationURL),
-			"payment":        "unknown", // TODO: implement health checks
-			"stock":          "unknown",
+			"payment":        h.checkServiceHealth(h.config.Proxy.PaymentURL),
+			"stock":          "unknown", // TODO: implement health checks
 			"shipping":       "unknown",
-			"order-status":   "unknown",
+			"order-status":   h.checkServiceHealth(h.config.Proxy.OrderStatusURL),
 		},
 		"config": gin.H{
 			"rate_limit_enabled": h.config.RateLimit.Enabled,
@@ -123,7 +161,10 @@ func (h *Handler) ProxyToOrderCreation(c *gin.Context) {
 		return
 	}
 
-	// Add proxy headers
+	// Add proxy headers; only the admin routes may claim admin rights and
+	// only authenticated routes may name the user
+	c.Request.Header.Del(middleware.HeaderAdminRequest)
+	c.Request.Header.Del(middleware.HeaderUserID)
 	c.Request.Header.Set("X-Forwarded-By", "api-gateway")
 	c.Request.Header.Set("X-Request-ID", c.GetString("RequestID"))
 
@@ -131,6 +172,108 @@ func (h *Handler) ProxyToOrderCreation(c *gin.Context) {
 	h.orderCreationProxy.ServeHTTP(c.Writer, c.Request)
 }
 
+// CancelOrder cancels an order of the user the bearer token was issued to.
+// The user is forwarded to the order creation service, which refuses to
+// cancel another user's order.
+func (h *Handler) CancelOrder(c *gin.Context) {
+	h.setCORSHeaders(c)
+
+	userID, ok := h.requestUser(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Header.Del(middleware.HeaderAdminRequest)
+	c.Request.Header.Set(middleware.HeaderUserID, userID)
+	c.Request.Header.Set("X-Forwarded-By", "api-gateway")
+	c.Request.Header.Set("X-Request-ID", c.GetString("RequestID"))
+
+	h.orderCreationProxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// AdminCancelOrder cancels any user's order. It is served behind the admin
+// auth and forwarded to the order creation service's cancel endpoint.
+func (h *Handler) AdminCancelOrder(c *gin.Context) {
+	c.Request.URL.Path = "/api/v1/orders/" + c.Param("id") + "/cancel"
+	c.Request.URL.RawPath = ""
+	c.Request.Header.Set(middleware.HeaderAdminRequest, "true")
+	c.Request.Header.Del(middleware.HeaderUserID)
+	c.Request.Header.Set("X-Forwarded-By", "api-gateway")
+	c.Request.Header.Set("X-Request-ID", c.GetString("RequestID"))
+
+	h.orderCreationProxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// AdminRefundOrder refunds part or all of an order's captured payment. It
+// is forwarded to the payment service with the Idempotency-Key header.
+func (h *Handler) AdminRefundOrder(c *gin.Context) {
+	h.proxyToPayment(c, "/api/v1/orders/"+c.Param("id")+"/refunds")
+}
+
+// AdminOrderPayments returns an order's payment balance and ledger
+func (h *Handler) AdminOrderPayments(c *gin.Context) {
+	h.proxyToPayment(c, "/api/v1/orders/"+c.Param("id")+"/payments")
+}
+
+func (h *Handler) proxyToPayment(c *gin.Context, path string) {
+	c.Request.URL.Path = path
+	c.Request.URL.RawPath = ""
+	c.Request.Header.Set("X-Forwarded-By", "api-gateway")
+	c.Request.Header.Set("X-Request-ID", c.GetString("RequestID"))
+
+	h.paymentProxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// ProxyToOrderStatus forwards order history requests to the order status
+// service for the user of the bearer token, who must own the order
+func (h *Handler) ProxyToOrderStatus(c *gin.Context) {
+	h.setCORSHeaders(c)
+
+	// Handle CORS preflight
+	if c.Request.Method == "OPTIONS" {
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+
+	userID, ok := h.requestUser(c)
+	if !ok {
+		return
+	}
+
+	// Add proxy headers
+	c.Request.Header.Set(middleware.HeaderUserID, userID)
+	c.Request.Header.Set("X-Forwarded-By", "api-gateway")
+	c.Request.Header.Set("X-Request-ID", c.GetString("RequestID"))
+
+	h.orderStatusProxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// requestUser authenticates the request's bearer token and returns its user
+// ID. It answers the request itself when the token is missing or invalid.
+func (h *Handler) requestUser(c *gin.Context) (string, bool) {
+	token := bearerToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing access token"})
+		return "", false
+	}
+
+	userID, ok := h.auth.Authenticate(token)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return "", false
+	}
+	return userID, true
+}
+
+// bearerToken returns the token of the request's Authorization header
+func bearerToken(c *gin.Context) string {
+	parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+	if len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+		return parts[1]
+	}
+	return ""
+}
+
 func (h *Handler) checkServiceHealth(serviceURL string) string {
 	client := &http.Client{
 		Timeout: 5 * time.Second,
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go-rabbitmq-order-system/api-gateway/internal/stream"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// statusUpdate is what a client receives for a status change of one of its
+// orders
+type statusUpdate struct {
+	EventID   string                 `json:"event_id"`
+	OrderID   string                 `json:"order_id"`
+	OldStatus interface{}            `json:"old_status"`
+	Status    string                 `json:"status"`
+	Cause     interface{}            `json:"cause"`
+	Timestamp time.Time              `json:"timestamp"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+func newStatusUpdate(event shared.OrderEvent) statusUpdate {
+	return statusUpdate{
+		EventID:   event.EventID,
+		OrderID:   event.OrderID,
+		OldStatus: event.Metadata["old_status"],
+		Status:    event.Status,
+		Cause:     event.Metadata["cause"],
+		Timestamp: event.Timestamp,
+		Metadata:  event.Metadata,
+	}
+}
+
+// Message types sent on the stream. A reset tells the client that missed
+// changes cannot be replayed and it should reload its orders.
+const (
+	streamStatus = "status"
+	streamReset  = "reset"
+)
+
+var upgrader = websocket.Upgrader{
+	// The gateway allows any origin, as for its other routes
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// IssueStreamTicket gives the user authenticated by the request's JWT a
+// short-lived ticket to open the order stream with. EventSource and
+// WebSocket requests cannot carry the JWT in a header, and it must not end
+// up in URLs.
+func (h *Handler) IssueStreamTicket(c *gin.Context) {
+	h.setCORSHeaders(c)
+	if c.Request.Method == "OPTIONS" {
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	userID, ok := h.requestUser(c)
+	if !ok {
+		return
+	}
+
+	ticket, expiresAt := h.streamTickets.Issue(userID)
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":     ticket,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	})
+}
+
+// StreamOrders pushes the status changes of the user's orders as
+// Server-Sent Events. The user is identified by the JWT in the
+// Authorization header or, since EventSource cannot set headers, by a
+// stream ticket in the ticket query parameter. A client reconnecting with
+// Last-Event-ID, or last_event_id, first receives the changes it missed.
+func (h *Handler) StreamOrders(c *gin.Context) {
+	h.setCORSHeaders(c)
+	if c.Request.Method == "OPTIONS" {
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	userID, ok := h.streamUser(c)
+	if !ok {
+		return
+	}
+
+	sub := h.orderStream.Subscribe(userID)
+	defer sub.Close()
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear write deadline for order stream: %v", err)
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	send := func(kind, id string, data interface{}) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			fmt.Fprintf(c.Writer, "id: %s\n", id)
+		}
+		if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", kind, payload); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	heartbeat := func() error {
+		if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	h.runStream(c, nil, sub, userID, lastEventID, send, heartbeat)
+}
+
+// StreamOrdersWebSocket is the WebSocket variant of StreamOrders. Each
+// message is a JSON object with a type and the status update; the stream
+// ticket and last event ID are passed as query parameters.
+func (h *Handler) StreamOrdersWebSocket(c *gin.Context) {
+	userID, ok := h.streamUser(c)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade order stream: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := h.orderStream.Subscribe(userID)
+	defer sub.Close()
+
+	// The hijacked connection keeps the server's deadlines; manage them here
+	heartbeatInterval := h.config.Stream.HeartbeatInterval
+	conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+	})
+
+	// Read until the client goes away, so its close is noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(kind, id string, data interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+		return conn.WriteJSON(gin.H{"type": kind, "id": id, "data": data})
+	}
+	heartbeat := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatInterval))
+	}
+
+	h.runStream(c, closed, sub, userID, c.Query("last_event_id"), send, heartbeat)
+}
+
+// runStream sends the changes the client missed since lastEventID and
+// then the live ones, until the request ends, done is closed, the hub drops
+// the subscription or a write fails
+func (h *Handler) runStream(c *gin.Context, done <-chan struct{}, sub *stream.Subscription, userID, lastEventID string,
+	send func(kind, id string, data interface{}) error, heartbeat func() error) {
+	ctx := c.Request.Context()
+
+	// Live changes already queued may repeat replayed ones
+	replayed := make(map[string]bool)
+	if lastEventID != "" {
+		missed, err := h.orderStream.Missed(ctx, userID, lastEventID)
+		switch {
+		case errors.Is(err, stream.ErrResumeUnavailable):
+			if err := send(streamReset, "", gin.H{"message": err.Error()}); err != nil {
+				return
+			}
+		case err != nil:
+			log.Printf("Failed to load missed order updates for user %s: %v", userID, err)
+			send(streamReset, "", gin.H{"message": "missed updates are unavailable"})
+			return
+		}
+		for _, event := range missed {
+			if err := send(streamStatus, event.EventID, newStatusUpdate(event)); err != nil {
+				return
+			}
+			replayed[event.EventID] = true
+		}
+	}
+
+	ticker := time.NewTicker(h.config.Stream.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			if replayed[event.EventID] {
+				continue
+			}
+			if err := send(streamStatus, event.EventID, newStatusUpdate(event)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamUser authenticates a stream request by its ticket or bearer token
+// and returns its user ID. It answers the request itself when the stream is
+// unavailable or the credentials are missing or invalid.
+func (h *Handler) streamUser(c *gin.Context) (string, bool) {
+	if h.orderStream == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Order stream is unavailable"})
+		return "", false
+	}
+
+	// Browsers cannot set headers on EventSource and WebSocket requests
+	if ticket := c.Query("ticket"); ticket != "" {
+		userID, ok := h.streamTickets.Verify(ticket)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired stream ticket"})
+			return "", false
+		}
+		return userID, true
+	}
+	return h.requestUser(c)
+}
@@ -0,0 +1,141 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// ErrResumeUnavailable means the events after a client's last event ID
+// cannot be replayed, because the ID is unknown or too much was missed. The
+// client should reload its orders instead.
+var ErrResumeUnavailable = errors.New("cannot resume the order stream from this event")
+
+// Inbox is the inbox the stream queues are consumed through. Every gateway
+// instance receives each status change on its own queue and must deliver
+// it to its own clients, so events are not deduplicated across instances;
+// delivering one twice to a client is harmless, as it carries its event ID.
+var Inbox shared.EventInbox = shared.PassthroughInbox{}
+
+// Hub fans the order status changes consumed from the stream queue out to
+// the connected clients of the orders' users. A client that cannot keep up
+// is disconnected and resumes from its last event ID when it reconnects.
+type Hub struct {
+	store       *shared.EventStore
+	buffer      int
+	resumeLimit int
+
+	mu      sync.Mutex
+	clients map[string]map[*Subscription]struct{}
+}
+
+// Subscription receives the status changes of one user's orders until it is
+// closed, by the client or by the hub when the client falls behind
+type Subscription struct {
+	Events <-chan shared.OrderEvent
+
+	hub    *Hub
+	userID string
+	events chan shared.OrderEvent
+}
+
+func NewHub(store *shared.EventStore, buffer, resumeLimit int) *Hub {
+	return &Hub{
+		store:       store,
+		buffer:      buffer,
+		resumeLimit: resumeLimit,
+		clients:     make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe starts delivering the user's status changes
+func (h *Hub) Subscribe(userID string) *Subscription {
+	events := make(chan shared.OrderEvent, h.buffer)
+	sub := &Subscription{
+		Events: events,
+		hub:    h,
+		userID: userID,
+		events: events,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = make(map[*Subscription]struct{})
+	}
+	h.clients[userID][sub] = struct{}{}
+	return sub
+}
+
+// Close stops the subscription. It may be called more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// remove drops a subscription and closes its channel. h.mu must be held.
+func (h *Hub) remove(sub *Subscription) {
+	subs := h.clients[sub.userID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.clients, sub.userID)
+	}
+	close(sub.events)
+}
+
+// HandleOrderEvent delivers a status change consumed from the stream queue
+// to the subscriptions of the order's user
+func (h *Hub) HandleOrderEvent(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
+	if event.EventType != shared.EventOrderStatusChanged {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.clients[event.UserID] {
+		select {
+		case sub.events <- event:
+		default:
+			// Too slow; the client resumes from its last event when it
+			// reconnects
+			h.remove(sub)
+		}
+	}
+	return nil
+}
+
+// Missed returns the user's status changes recorded after lastEventID, in
+// order, or ErrResumeUnavailable. A change whose append was still
+// committing when lastEventID was recorded can be missing; see
+// EventStore.Position. The order's next change, or a reload, corrects the
+// client's view.
+func (h *Hub) Missed(ctx context.Context, userID, lastEventID string) ([]shared.OrderEvent, error) {
+	position, err := h.store.Position(ctx, lastEventID)
+	if err == sql.ErrNoRows {
+		return nil, ErrResumeUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := h.store.Query(ctx, shared.EventQuery{
+		UserID:        userID,
+		EventType:     shared.EventOrderStatusChanged,
+		AfterSequence: position,
+		Limit:         h.resumeLimit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > h.resumeLimit {
+		return nil, ErrResumeUnavailable
+	}
+	return events, nil
+}
@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+func TestEveryInstanceStreamsEachEvent(t *testing.T) {
+	// The gateway instances share their inbox, as they share the broker
+	// options
+	broker := shared.NewMemoryBroker(shared.RetryPolicy{MaxAttempts: 1, InitialDelay: time.Millisecond},
+		func(string) shared.EventInbox { return Inbox })
+	defer broker.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var subs []*Subscription
+	for _, instance := range []string{"gateway-1", "gateway-2"} {
+		hub := NewHub(nil, 1, 10)
+		queueName := shared.StreamQueue(instance)
+		if err := broker.SetupQueue(queueName); err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.ConsumeEvents(ctx, queueName, hub.HandleOrderEvent); err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, hub.Subscribe("user-1"))
+	}
+
+	event := shared.OrderEvent{OrderID: "order-1", UserID: "user-1", TotalAmount: 25}.
+		StatusChanged(shared.StatusCreated, shared.StatusPaymentSuccessful)
+	event.EventID = "event-1"
+	if err := broker.ForProducer("order-status").PublishEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, sub := range subs {
+		select {
+		case got := <-sub.Events:
+			if got.EventID != event.EventID {
+				t.Errorf("instance %d streamed event %s, want %s", i+1, got.EventID, event.EventID)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("instance %d did not stream the status change", i+1)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTickets(t *testing.T) {
+	tickets := NewTickets("secret", time.Minute)
+	ticket, expiresAt := tickets.Issue("user-1")
+	if until := time.Until(expiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("ticket expires in %s, want within a minute", until)
+	}
+
+	if userID, ok := tickets.Verify(ticket); !ok || userID != "user-1" {
+		t.Errorf("Verify = %q, %v; want user-1, true", userID, ok)
+	}
+
+	expired, _ := NewTickets("secret", -time.Second).Issue("user-1")
+	forged, _ := NewTickets("other secret", time.Minute).Issue("user-1")
+	otherUser, _ := tickets.Issue("user-2")
+	tests := []struct {
+		name   string
+		ticket string
+	}{
+		{"expired", expired},
+		{"signed with another secret", forged},
+		{"with its user swapped", strings.SplitN(otherUser, ".", 2)[0] + "." + strings.SplitN(ticket, ".", 2)[1]},
+		{"malformed", "user-1"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if userID, ok := tickets.Verify(tt.ticket); ok {
+				t.Errorf("Verify accepted the ticket for %s", userID)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"go-rabbitmq-order-system/auth-service/internal/app"
 	"go-rabbitmq-order-system/auth-service/internal/config"
@@ -22,7 +25,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := application.Run(); err != nil {
+	// Shut down gracefully on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := application.Run(ctx); err != nil {
 		log.Fatalf("Failed to run application: %v", err)
 		os.Exit(1)
 	}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -9,6 +10,8 @@ import (
 	"go-rabbitmq-order-system/auth-service/internal/config"
 	"go-rabbitmq-order-system/auth-service/internal/handler"
 	"go-rabbitmq-order-system/auth-service/internal/service"
+	"go-rabbitmq-order-system/pkg/server"
+	"go-rabbitmq-order-system/pkg/tracing"
 
 	_ "github.com/lib/pq"
 )
@@ -46,7 +49,14 @@ func New(cfg *config.Config) (*App, error) {
 	}, nil
 }
 
-func (a *App) Run() error {
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, "auth-service", a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.ShutdownTimeout)
+
 	// Setup routes
 	mux := http.NewServeMux()
 
@@ -62,7 +72,7 @@ func (a *App) Run() error {
 	mux.HandleFunc("/health", a.handler.HealthCheck)
 
 	// Add CORS middleware
-	handler := a.corsMiddleware(mux)
+	handler := tracing.Handler(a.corsMiddleware(mux))
 
 	log.Printf("Auth Service starting on port %s", a.config.Port)
 	log.Println("Available endpoints:")
@@ -74,7 +84,13 @@ func (a *App) Run() error {
 	log.Println("  GET  /auth/profile")
 	log.Println("  GET  /health")
 
-	return http.ListenAndServe(":"+a.config.Port, handler)
+	srv := &http.Server{
+		Addr:    ":" + a.config.Port,
+		Handler: handler,
+	}
+	err = server.Run(ctx, srv, a.config.ShutdownTimeout)
+	a.Close()
+	return err
 }
 
 func (a *App) Close() error {
@@ -4,6 +4,8 @@ import (
 	"os"
 	"strconv"
 	"time"
+
+	pkgconfig "go-rabbitmq-order-system/pkg/config"
 )
 
 type Config struct {
@@ -13,6 +15,8 @@ type Config struct {
 	JWTExpiration  time.Duration
 	RefreshExpiration time.Duration
 	BCryptCost     int
+	ShutdownTimeout time.Duration
+	Tracing         pkgconfig.TracingConfig
 }
 
 func Load() (*Config, error) {
@@ -55,6 +59,13 @@ func Load() (*Config, error) {
 		}
 	}
 
+	shutdownTimeout := 30 * time.Second // default 30 seconds
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil {
+			shutdownTimeout = timeout
+		}
+	}
+
 	return &Config{
 		Port:              port,
 		DatabaseURL:       databaseURL,
@@ -62,5 +73,7 @@ func Load() (*Config, error) {
 		JWTExpiration:     jwtExpiration,
 		RefreshExpiration: refreshExpiration,
 		BCryptCost:        bcryptCost,
+		ShutdownTimeout:   shutdownTimeout,
+		Tracing:           pkgconfig.LoadTracingConfig(),
 	}, nil
 } 
\ No newline at end of file
@@ -0,0 +1,75 @@
+// Command orderfsm prints the order state machine defined in
+// shared/orderfsm, so docs and the frontend status badges can be generated
+// from the same definition the services enforce.
+//
+// Examples:
+//
+//	go run ./cmd/orderfsm -format mermaid > order-lifecycle.mmd
+//	go run ./cmd/orderfsm -format dot | dot -Tsvg > order-lifecycle.svg
+//	go run ./cmd/orderfsm -format json > ../order-processing-system/src/orderStates.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"go-rabbitmq-order-system/shared/orderfsm"
+)
+
+type transition struct {
+	From   []orderfsm.State `json:"from"`
+	Event  orderfsm.Event   `json:"event"`
+	To     orderfsm.State   `json:"to"`
+	Guards []string         `json:"guards,omitempty"`
+}
+
+type definition struct {
+	Initial     orderfsm.State   `json:"initial"`
+	States      []orderfsm.State `json:"states"`
+	Transitions []transition     `json:"transitions"`
+}
+
+func main() {
+	format := flag.String("format", "mermaid", "output format: mermaid, dot or json")
+	flag.Parse()
+
+	switch *format {
+	case "mermaid":
+		fmt.Print(orderfsm.Order.Mermaid())
+	case "dot":
+		fmt.Print(orderfsm.Order.DOT())
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(describe(orderfsm.Order)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func describe(m *orderfsm.Machine) definition {
+	d := definition{
+		Initial: m.Initial(),
+		States:  m.States(),
+	}
+	for _, t := range m.Transitions() {
+		var guards []string
+		for _, guard := range t.Guards {
+			guards = append(guards, guard.Name)
+		}
+		d.Transitions = append(d.Transitions, transition{
+			From:   t.From,
+			Event:  t.Event,
+			To:     t.To,
+			Guards: guards,
+		})
+	}
+	return d
+}
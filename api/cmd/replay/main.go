@@ -0,0 +1,229 @@
+// Command replay republishes order events, for example to re-drive orders
+// stuck after a broker outage. Events are read from the order_events store
+// or rebuilt from the orders, payment_transactions and stock_reservations
+// tables, filtered, and published to the exchange or to one service queue.
+//
+// Replayed events keep their event IDs by default, so services that already
+// handled them skip them through their inbox. Use -new-ids to make every
+// service handle them again.
+//
+// Examples:
+//
+//	go run ./cmd/replay -order <order-id> -dry-run
+//	go run ./cmd/replay -source tables -type OrderCreated -status CREATED -since 2h
+//	go run ./cmd/replay -type OrderCreated -queue payment_queue -to-queue
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go-rabbitmq-order-system/pkg/config"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+)
+
+type options struct {
+	source    string
+	orderID   string
+	eventType string
+	status    string
+	queue     string
+	toQueue   bool
+	from      time.Time
+	to        time.Time
+	limit     int
+	newIDs    bool
+	dryRun    bool
+}
+
+func main() {
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	opts, err := parseFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, config.LoadBaseConfig(), opts); err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+}
+
+func parseFlags() (options, error) {
+	var opts options
+	var from, to string
+	var since time.Duration
+
+	flag.StringVar(&opts.source, "source", "store", "where to read events from: store (order_events) or tables")
+	flag.StringVar(&opts.orderID, "order", "", "only events of this order ID")
+	flag.StringVar(&opts.eventType, "type", "", "only events of this type, e.g. OrderCreated")
+	flag.StringVar(&opts.status, "status", "", "only orders currently in this status, e.g. CREATED")
+	flag.StringVar(&opts.queue, "queue", "", "only event types bound to this service queue, e.g. payment_queue")
+	flag.BoolVar(&opts.toQueue, "to-queue", false, "publish to -queue only instead of the exchange")
+	flag.StringVar(&from, "from", "", "only events at or after this time (RFC 3339)")
+	flag.StringVar(&to, "to", "", "only events before this time (RFC 3339)")
+	flag.DurationVar(&since, "since", 0, "only events in this window up to now, e.g. 2h")
+	flag.IntVar(&opts.limit, "limit", 1000, "maximum number of events to replay")
+	flag.BoolVar(&opts.newIDs, "new-ids", false, "give replayed events new IDs so services handle them again")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "print the selected events without publishing")
+	flag.Parse()
+
+	if opts.source != "store" && opts.source != "tables" {
+		return opts, fmt.Errorf("unknown source %q", opts.source)
+	}
+	if opts.queue != "" {
+		if _, ok := shared.QueueBindings[opts.queue]; !ok {
+			return opts, fmt.Errorf("unknown queue %q", opts.queue)
+		}
+	}
+	if opts.toQueue && opts.queue == "" {
+		return opts, fmt.Errorf("-to-queue requires -queue")
+	}
+
+	var err error
+	if from != "" {
+		if opts.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return opts, fmt.Errorf("invalid -from: %v", err)
+		}
+	}
+	if to != "" {
+		if opts.to, err = time.Parse(time.RFC3339, to); err != nil {
+			return opts, fmt.Errorf("invalid -to: %v", err)
+		}
+	}
+	if since > 0 {
+		opts.from = time.Now().Add(-since)
+	}
+
+	return opts, nil
+}
+
+func run(ctx context.Context, cfg *config.BaseConfig, opts options) error {
+	db, err := shared.NewDatabase(cfg.Database.URL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	events, err := selectEvents(ctx, db.DB, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Selected %d events from %s", len(events), opts.source)
+
+	if opts.dryRun {
+		for _, event := range events {
+			fmt.Printf("%s  %-22s order=%s event_id=%s producer=%s\n",
+				event.Timestamp.Format(time.RFC3339), event.EventType, event.OrderID, event.EventID, event.Producer)
+		}
+		return nil
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	rabbitmq, err := shared.NewRabbitMQ(cfg.RabbitMQ.URL,
+		shared.WithProducer("replay"),
+		shared.WithEventStore(shared.NewEventStore(db.DB)),
+		shared.WithPublishTimeout(cfg.RabbitMQ.PublishTimeout),
+	)
+	if err != nil {
+		return err
+	}
+	defer rabbitmq.Close()
+
+	if err := rabbitmq.SetupExchange(); err != nil {
+		return err
+	}
+
+	for i, event := range events {
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted after %d of %d events", i, len(events))
+		}
+
+		if opts.newIDs {
+			event.CausationID = event.EventID
+			event.EventID = uuid.New().String()
+		}
+
+		if opts.toQueue {
+			err = rabbitmq.PublishEventToQueue(ctx, opts.queue, event)
+		} else {
+			err = rabbitmq.PublishEvent(ctx, event)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay event %s after %d of %d events: %v", event.EventID, i, len(events), err)
+		}
+	}
+
+	log.Printf("Replayed %d events", len(events))
+	return nil
+}
+
+// selectEvents loads the events matching the options from the chosen
+// source, at most opts.limit of them. The filters and the limit are applied
+// by the database.
+func selectEvents(ctx context.Context, db *sql.DB, opts options) ([]shared.OrderEvent, error) {
+	eventTypes, ok := wantedTypes(opts)
+	if !ok {
+		return nil, nil
+	}
+
+	if opts.source == "tables" {
+		events, err := rebuildEvents(ctx, db, opts, eventTypes)
+		if err != nil {
+			return nil, err
+		}
+		if opts.limit > 0 && len(events) > opts.limit {
+			events = events[:opts.limit]
+		}
+		return events, nil
+	}
+
+	return shared.NewEventStore(db).Query(ctx, shared.EventQuery{
+		OrderID:     opts.orderID,
+		EventTypes:  eventTypes,
+		OrderStatus: opts.status,
+		From:        opts.from,
+		To:          opts.to,
+		Limit:       opts.limit,
+	})
+}
+
+// wantedTypes returns the event types the -type and -queue options select,
+// or nil for all of them. ok is false if they select none.
+func wantedTypes(opts options) (eventTypes []string, ok bool) {
+	switch {
+	case opts.queue == "" && opts.eventType == "":
+		return nil, true
+	case opts.queue == "":
+		return []string{opts.eventType}, true
+	case opts.eventType == "":
+		return shared.QueueBindings[opts.queue], true
+	}
+
+	for _, bound := range shared.QueueBindings[opts.queue] {
+		if bound == opts.eventType {
+			return []string{opts.eventType}, true
+		}
+	}
+	return nil, false
+}
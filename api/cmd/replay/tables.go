@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/google/uuid"
+)
+
+// rebuildEvents reconstructs OrderCreated, payment result and StockReserved
+// events from the state tables. The original event IDs are not known there,
+// so each rebuilt event gets an ID derived from its order and type; replaying
+// the same event twice still reaches a service only once.
+func rebuildEvents(ctx context.Context, db *sql.DB, opts options, eventTypes []string) ([]shared.OrderEvent, error) {
+	var events []shared.OrderEvent
+
+	wants := func(eventType string) bool {
+		if eventTypes == nil {
+			return true
+		}
+		for _, wanted := range eventTypes {
+			if wanted == eventType {
+				return true
+			}
+		}
+		return false
+	}
+
+	if wants(shared.EventOrderCreated) {
+		created, err := rebuildOrderCreated(ctx, db, opts)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, created...)
+	}
+	if successful, failed := wants(shared.EventPaymentSuccessful), wants(shared.EventPaymentFailed); successful || failed {
+		payments, err := rebuildPaymentResults(ctx, db, opts, successful, failed)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, payments...)
+	}
+	if wants(shared.EventStockReserved) {
+		reserved, err := rebuildStockReserved(ctx, db, opts)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, reserved...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	return events, nil
+}
+
+func rebuildOrderCreated(ctx context.Context, db *sql.DB, opts options) ([]shared.OrderEvent, error) {
+	where, args := filters("o.id", "o.created_at", opts)
+	rows, err := db.QueryContext(ctx, `
+		SELECT o.id, o.user_id, o.total_amount, o.created_at
+		FROM orders o`+where+`
+		ORDER BY o.created_at`+limit(&args, opts), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load orders: %v", err)
+	}
+
+	var events []shared.OrderEvent
+	for rows.Next() {
+		var orderID, userID string
+		var totalAmount float64
+		var createdAt time.Time
+		if err := rows.Scan(&orderID, &userID, &totalAmount, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		event := rebuiltEvent(shared.EventOrderCreated, orderID, createdAt)
+		event.UserID = userID
+		event.TotalAmount = totalAmount
+		event.Status = shared.StatusCreated
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		items, err := orderItems(ctx, db, events[i].OrderID)
+		if err != nil {
+			return nil, err
+		}
+		events[i].Items = items
+	}
+	return events, nil
+}
+
+func orderItems(ctx context.Context, db *sql.DB, orderID string) ([]shared.OrderItem, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, order_id, product_id, quantity, price FROM order_items WHERE order_id = $1",
+		orderID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load items of order %s: %v", orderID, err)
+	}
+	defer rows.Close()
+
+	var items []shared.OrderItem
+	for rows.Next() {
+		var item shared.OrderItem
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.Quantity, &item.Price); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// rebuildPaymentResults rebuilds the PaymentSuccessful events, the
+// PaymentFailed events or both
+func rebuildPaymentResults(ctx context.Context, db *sql.DB, opts options, successful, failed bool) ([]shared.OrderEvent, error) {
+	where, args := filters("pt.order_id", "pt.created_at", opts)
+	if !successful {
+		where = and(where, "pt.status = 'FAILED'")
+	}
+	if !failed {
+		where = and(where, "pt.status <> 'FAILED'")
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT pt.order_id, o.user_id, pt.amount, pt.status, pt.payment_method,
+			COALESCE(pt.transaction_id, ''), COALESCE(pt.message, ''), pt.created_at
+		FROM payment_transactions pt
+		JOIN orders o ON o.id = pt.order_id`+where+`
+		ORDER BY pt.created_at`+limit(&args, opts), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payment transactions: %v", err)
+	}
+	defer rows.Close()
+
+	var events []shared.OrderEvent
+	for rows.Next() {
+		var orderID, userID, status, method, transactionID, message string
+		var amount float64
+		var createdAt time.Time
+		err := rows.Scan(&orderID, &userID, &amount, &status, &method, &transactionID, &message, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Every payment but a failed one was authorized at first
+		eventType := shared.EventPaymentFailed
+		if status != "FAILED" {
+			eventType = shared.EventPaymentSuccessful
+		}
+
+		event := rebuiltEvent(eventType, orderID, createdAt)
+		event.UserID = userID
+		event.TotalAmount = amount
+		event.Status = eventType
+		event.Metadata = map[string]interface{}{
+			"transaction_id": transactionID,
+			"payment_method": method,
+			"message":        message,
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func rebuildStockReserved(ctx context.Context, db *sql.DB, opts options) ([]shared.OrderEvent, error) {
+	where, args := filters("sr.order_id", "sr.created_at", opts)
+	where = and(where, "sr.status = 'RESERVED'")
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT sr.id, sr.order_id, o.user_id, o.total_amount, sr.product_id, sr.quantity, sr.created_at
+		FROM stock_reservations sr
+		JOIN orders o ON o.id = sr.order_id`+where+`
+		ORDER BY sr.order_id, sr.created_at`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stock reservations: %v", err)
+	}
+	defer rows.Close()
+
+	var events []shared.OrderEvent
+	var current *shared.OrderEvent
+	var reservations []map[string]interface{}
+	flush := func() {
+		if current != nil {
+			current.Metadata = map[string]interface{}{
+				"message":      "Stock reserved successfully",
+				"reservations": reservations,
+			}
+			events = append(events, *current)
+		}
+		current, reservations = nil, nil
+	}
+
+	for rows.Next() {
+		var reservationID, orderID, userID, productID string
+		var totalAmount float64
+		var quantity int
+		var createdAt time.Time
+		err := rows.Scan(&reservationID, &orderID, &userID, &totalAmount, &productID, &quantity, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.OrderID != orderID {
+			flush()
+			// Reservations are grouped per order, so stop at the limit
+			// without reading the reservations of further orders
+			if opts.limit > 0 && len(events) == opts.limit {
+				break
+			}
+			event := rebuiltEvent(shared.EventStockReserved, orderID, createdAt)
+			event.UserID = userID
+			event.TotalAmount = totalAmount
+			event.Status = shared.EventStockReserved
+			current = &event
+		}
+		current.Items = append(current.Items, shared.OrderItem{OrderID: orderID, ProductID: productID, Quantity: quantity})
+		reservations = append(reservations, map[string]interface{}{
+			"product_id":     productID,
+			"quantity":       quantity,
+			"reservation_id": reservationID,
+		})
+	}
+	flush()
+	return events, rows.Err()
+}
+
+// rebuiltEvent starts an event with a stable ID derived from its order and type
+func rebuiltEvent(eventType, orderID string, at time.Time) shared.OrderEvent {
+	return shared.OrderEvent{
+		EventID:       uuid.NewSHA1(uuid.NameSpaceURL, []byte("replay/"+eventType+"/"+orderID)).String(),
+		CorrelationID: orderID,
+		Producer:      "replay",
+		SchemaVersion: shared.CurrentSchemaVersion,
+		EventType:     eventType,
+		OrderID:       orderID,
+		Timestamp:     at,
+	}
+}
+
+// filters builds the WHERE clause for the order, order status and time
+// window options
+func filters(orderColumn, timeColumn string, opts options) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if opts.orderID != "" {
+		args = append(args, opts.orderID)
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", orderColumn, len(args)))
+	}
+	if opts.status != "" {
+		args = append(args, opts.status)
+		conditions = append(conditions, fmt.Sprintf("%s IN (SELECT id FROM orders WHERE status = $%d)", orderColumn, len(args)))
+	}
+	if !opts.from.IsZero() {
+		args = append(args, opts.from)
+		conditions = append(conditions, fmt.Sprintf("%s >= $%d", timeColumn, len(args)))
+	}
+	if !opts.to.IsZero() {
+		args = append(args, opts.to)
+		conditions = append(conditions, fmt.Sprintf("%s < $%d", timeColumn, len(args)))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// and adds a condition to a WHERE clause built by filters
+func and(where, condition string) string {
+	if where == "" {
+		return " WHERE " + condition
+	}
+	return where + " AND " + condition
+}
+
+// limit returns the LIMIT clause for the limit option, adding its argument
+// to args
+func limit(args *[]interface{}, opts options) string {
+	if opts.limit <= 0 {
+		return ""
+	}
+	*args = append(*args, opts.limit)
+	return fmt.Sprintf(" LIMIT $%d", len(*args))
+}
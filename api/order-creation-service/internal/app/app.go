@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"log"
 	"net/http"
 
@@ -9,16 +10,21 @@ import (
 	"go-rabbitmq-order-system/order-creation-service/internal/repository"
 	"go-rabbitmq-order-system/order-creation-service/internal/service"
 	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/pkg/server"
+	"go-rabbitmq-order-system/pkg/tracing"
 	"go-rabbitmq-order-system/shared"
 
 	"github.com/gin-gonic/gin"
 )
 
+// serviceName identifies this service as the producer of its events
+const serviceName = "order-creation"
+
 type App struct {
 	config   *config.Config
 	router   *gin.Engine
 	database *shared.Database
-	rabbitMQ *shared.RabbitMQ
+	broker   shared.Broker
 }
 
 func New(cfg *config.Config) *App {
@@ -27,7 +33,14 @@ func New(cfg *config.Config) *App {
 	}
 }
 
-func (a *App) Run() error {
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, serviceName, a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.Server.ShutdownTimeout)
+
 	// Initialize database
 	db, err := shared.NewDatabase(a.config.Database.URL)
 	if err != nil {
@@ -36,27 +49,42 @@ func (a *App) Run() error {
 	a.database = db
 
 	// Initialize RabbitMQ
-	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL)
+	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL,
+		shared.WithProducer(serviceName),
+		shared.WithEventStore(shared.NewEventStore(db.DB)),
+		shared.WithStateHook(shared.LogConnectionState(serviceName)),
+	)
 	if err != nil {
 		return err
 	}
-	a.rabbitMQ = rabbitmq
+	a.broker = rabbitmq
 
-	// Setup RabbitMQ exchanges and queues
-	if err := rabbitmq.SetupExchangeAndQueues(); err != nil {
+	// Setup RabbitMQ exchange
+	if err := rabbitmq.SetupExchange(); err != nil {
 		return err
 	}
 
+	// Start publishing stored events
+	outbox := shared.NewOutbox(db.DB, serviceName, a.config.Outbox.PollInterval)
+	go outbox.Relay(ctx, rabbitmq)
+
 	// Initialize layers
-	repo := repository.New(db.DB)
-	svc := service.New(repo, rabbitmq)
-	h := handler.New(svc)
+	repo := repository.New(db.DB, outbox)
+	svc := service.New(repo)
+	h := handler.New(svc, rabbitmq.State)
 
 	// Setup router
 	a.setupRouter(h)
 
+	srv := &http.Server{
+		Addr:    ":" + a.config.Server.Port,
+		Handler: a.router,
+	}
+
 	log.Printf("Order Creation Service started on port %s", a.config.Server.Port)
-	return http.ListenAndServe(":"+a.config.Server.Port, a.router)
+	err = server.Run(ctx, srv, a.config.Server.ShutdownTimeout)
+	a.Close()
+	return err
 }
 
 func (a *App) setupRouter(h *handler.Handler) {
@@ -64,6 +92,7 @@ func (a *App) setupRouter(h *handler.Handler) {
 
 	// Add middleware (skip CORS since API Gateway handles it)
 	r.Use(middleware.RequestID())
+	r.Use(tracing.Middleware())
 	r.Use(middleware.StructuredLogger("order-creation"))
 	r.Use(middleware.Recovery("order-creation"))
 
@@ -76,6 +105,7 @@ func (a *App) setupRouter(h *handler.Handler) {
 		api.GET("/orders", h.GetOrders)
 		api.POST("/orders", h.CreateOrder)
 		api.GET("/orders/:id", h.GetOrder)
+		api.POST("/orders/:id/cancel", h.CancelOrder)
 		api.GET("/products", h.GetProducts)
 		api.GET("/products/:id", h.GetProduct)
 	}
@@ -84,11 +114,11 @@ func (a *App) setupRouter(h *handler.Handler) {
 }
 
 func (a *App) Close() error {
+	if a.broker != nil {
+		a.broker.Close()
+	}
 	if a.database != nil {
 		a.database.Close()
 	}
-	if a.rabbitMQ != nil {
-		a.rabbitMQ.Close()
-	}
 	return nil
 } 
\ No newline at end of file
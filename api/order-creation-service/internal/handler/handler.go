@@ -6,24 +6,35 @@ import (
 
 	"go-rabbitmq-order-system/order-creation-service/internal/repository"
 	"go-rabbitmq-order-system/order-creation-service/internal/service"
+	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/shared"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Handler struct {
-	service service.OrderService
+	service     service.OrderService
+	brokerState func() shared.ConnectionState
 }
 
-func New(svc service.OrderService) *Handler {
+func New(svc service.OrderService, brokerState func() shared.ConnectionState) *Handler {
 	return &Handler{
-		service: svc,
+		service:     svc,
+		brokerState: brokerState,
 	}
 }
 
 func (h *Handler) Health(c *gin.Context) {
+	status := "healthy"
+	brokerState := h.brokerState()
+	if brokerState != shared.StateConnected {
+		status = "degraded"
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"status":  "healthy",
-		"service": "order-creation",
+		"status":   status,
+		"service":  "order-creation",
+		"rabbitmq": brokerState,
 	})
 }
 
@@ -55,6 +66,39 @@ func (h *Handler) GetOrder(c *gin.Context) {
 	c.JSON(http.StatusOK, order)
 }
 
+// CancelOrder cancels an order for the user the gateway authenticated the
+// request for, or for any user when the gateway marked the request as
+// coming from an admin
+func (h *Handler) CancelOrder(c *gin.Context) {
+	var req service.CancelOrderRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	req.Admin = c.GetHeader(middleware.HeaderAdminRequest) == "true"
+	req.UserID = c.GetHeader(middleware.HeaderUserID)
+	if !req.Admin && req.UserID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	response, err := h.service.CancelOrder(c.Request.Context(), c.Param("id"), &req)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, response)
+	case service.ErrOrderNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+	case service.ErrOrderNotOwned:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case service.ErrOrderAlreadyShipped, service.ErrOrderAlreadyCancelled, service.ErrInvalidOrderStatus:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order"})
+	}
+}
+
 func (h *Handler) GetOrders(c *gin.Context) {
 	userID := c.Query("user_id")
 	if userID == "" {
@@ -37,24 +37,33 @@ type PaginatedResponse struct {
 }
 
 type OrderRepository interface {
-	CreateOrder(ctx context.Context, order *shared.Order) error
+	CreateOrder(ctx context.Context, order *shared.Order, event shared.OrderEvent) error
 	GetOrder(ctx context.Context, orderID string) (*shared.Order, error)
 	GetOrders(ctx context.Context, userID string) ([]shared.Order, error)
+	CancelOrder(ctx context.Context, orderID string, decide CancelDecision) error
 	GetProducts(ctx context.Context, filter *ProductsFilter, pagination *PaginationParams) (*PaginatedResponse, error)
 	GetProduct(ctx context.Context, productID string) (*shared.Product, error)
 }
 
+// CancelDecision inspects a locked order and whether a shipment exists for
+// it, and returns the event that cancels it or an error refusing to
+type CancelDecision func(order *shared.Order, shipped bool) (shared.OrderEvent, error)
+
 type orderRepository struct {
-	db *sql.DB
+	db     *sql.DB
+	outbox shared.EventOutbox
 }
 
-func New(db *sql.DB) OrderRepository {
+func New(db *sql.DB, outbox shared.EventOutbox) OrderRepository {
 	return &orderRepository{
-		db: db,
+		db:     db,
+		outbox: outbox,
 	}
 }
 
-func (r *orderRepository) CreateOrder(ctx context.Context, order *shared.Order) error {
+// CreateOrder stores the order, its items and the event announcing it in a
+// single transaction
+func (r *orderRepository) CreateOrder(ctx context.Context, order *shared.Order, event shared.OrderEvent) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -81,15 +90,76 @@ func (r *orderRepository) CreateOrder(ctx context.Context, order *shared.Order)
 		}
 	}
 
+	// Store the event for the outbox relay
+	if err := r.outbox.Add(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelOrder locks the order, lets decide accept or refuse the
+// cancellation and stores the cancelled status with the event in one
+// transaction. The lock serializes concurrent cancellations and shipping.
+func (r *orderRepository) CancelOrder(ctx context.Context, orderID string, decide CancelDecision) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var order shared.Order
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, user_id, total_amount, status FROM orders WHERE id = $1 FOR UPDATE",
+		orderID,
+	).Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrOrderNotFound
+		}
+		return err
+	}
+
+	var shipped bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM shipping_info WHERE order_id = $1 AND status = 'SHIPPED')",
+		orderID,
+	).Scan(&shipped)
+	if err != nil {
+		return err
+	}
+
+	event, err := decide(&order, shipped)
+	if err != nil {
+		return err
+	}
+
+	reason, _ := event.Metadata["reason"].(string)
+	_, err = tx.ExecContext(ctx,
+		"UPDATE orders SET status = $1, cancellation_reason = $2, updated_at = $3 WHERE id = $4",
+		shared.StatusCancelled, reason, event.Timestamp, orderID,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Store the events for the outbox relay
+	if err := r.outbox.Add(ctx, tx, event); err != nil {
+		return err
+	}
+	if err := r.outbox.Add(ctx, tx, event.StatusChanged(order.Status, shared.StatusCancelled)); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
 func (r *orderRepository) GetOrder(ctx context.Context, orderID string) (*shared.Order, error) {
 	var order shared.Order
 	err := r.db.QueryRowContext(ctx,
-		"SELECT id, user_id, total_amount, status, created_at, updated_at FROM orders WHERE id = $1",
+		"SELECT id, user_id, total_amount, status, COALESCE(cancellation_reason, ''), created_at, updated_at FROM orders WHERE id = $1",
 		orderID,
-	).Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CancellationReason, &order.CreatedAt, &order.UpdatedAt)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -124,7 +194,7 @@ func (r *orderRepository) GetOrder(ctx context.Context, orderID string) (*shared
 
 func (r *orderRepository) GetOrders(ctx context.Context, userID string) ([]shared.Order, error) {
 	rows, err := r.db.QueryContext(ctx,
-		"SELECT id, user_id, total_amount, status, created_at, updated_at FROM orders WHERE user_id = $1 ORDER BY created_at DESC",
+		"SELECT id, user_id, total_amount, status, COALESCE(cancellation_reason, ''), created_at, updated_at FROM orders WHERE user_id = $1 ORDER BY created_at DESC",
 		userID,
 	)
 	if err != nil {
@@ -135,7 +205,7 @@ func (r *orderRepository) GetOrders(ctx context.Context, userID string) ([]share
 	var orders []shared.Order
 	for rows.Next() {
 		var order shared.Order
-		err := rows.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.UpdatedAt)
+		err := rows.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CancellationReason, &order.CreatedAt, &order.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
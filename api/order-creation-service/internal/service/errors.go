@@ -6,4 +6,8 @@ var (
 	ErrOrderNotFound      = errors.New("order not found")
 	ErrInsufficientStock  = errors.New("insufficient stock")
 	ErrInvalidOrderStatus = errors.New("invalid order status")
+
+	ErrOrderNotOwned         = errors.New("order belongs to another user")
+	ErrOrderAlreadyShipped   = errors.New("order has already shipped and can no longer be cancelled")
+	ErrOrderAlreadyCancelled = errors.New("order is already cancelled")
 ) 
\ No newline at end of file
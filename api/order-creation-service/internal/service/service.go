@@ -2,10 +2,12 @@ package service
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"go-rabbitmq-order-system/order-creation-service/internal/repository"
 	"go-rabbitmq-order-system/shared"
+	"go-rabbitmq-order-system/shared/orderfsm"
 
 	"github.com/google/uuid"
 )
@@ -14,13 +16,13 @@ type OrderService interface {
 	CreateOrder(ctx context.Context, req *CreateOrderRequest) (*CreateOrderResponse, error)
 	GetOrder(ctx context.Context, orderID string) (*shared.Order, error)
 	GetOrders(ctx context.Context, userID string) ([]shared.Order, error)
+	CancelOrder(ctx context.Context, orderID string, req *CancelOrderRequest) (*CancelOrderResponse, error)
 	GetProducts(ctx context.Context, filter *repository.ProductsFilter, pagination *repository.PaginationParams) (*repository.PaginatedResponse, error)
 	GetProduct(ctx context.Context, productID string) (*shared.Product, error)
 }
 
 type orderService struct {
-	repo     repository.OrderRepository
-	rabbitMQ *shared.RabbitMQ
+	repo repository.OrderRepository
 }
 
 type CreateOrderRequest struct {
@@ -41,10 +43,25 @@ type CreateOrderResponse struct {
 	Message     string  `json:"message"`
 }
 
-func New(repo repository.OrderRepository, rabbitMQ *shared.RabbitMQ) OrderService {
+// CancelOrderRequest cancels an order on behalf of its owner or, when Admin
+// is set by the caller, of an administrator. UserID is set by the caller
+// from the authenticated request, never from the body.
+type CancelOrderRequest struct {
+	UserID string `json:"-"`
+	Reason string `json:"reason"`
+	Admin  bool   `json:"-"`
+}
+
+type CancelOrderResponse struct {
+	OrderID string `json:"order_id"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func New(repo repository.OrderRepository) OrderService {
 	return &orderService{
-		repo:     repo,
-		rabbitMQ: rabbitMQ,
+		repo: repo,
 	}
 }
 
@@ -89,11 +106,7 @@ func (s *orderService) CreateOrder(ctx context.Context, req *CreateOrderRequest)
 		UpdatedAt:   time.Now(),
 	}
 
-	if err := s.repo.CreateOrder(ctx, order); err != nil {
-		return nil, err
-	}
-
-	// Publish order created event
+	// Order created event, stored with the order and published by the outbox relay
 	event := shared.OrderEvent{
 		EventType:   shared.EventOrderCreated,
 		OrderID:     orderID,
@@ -104,9 +117,8 @@ func (s *orderService) CreateOrder(ctx context.Context, req *CreateOrderRequest)
 		Timestamp:   time.Now(),
 	}
 
-	if err := s.rabbitMQ.PublishEvent(event); err != nil {
-		// Log but don't fail the request
-		// In production, you might want to use a retry mechanism
+	if err := s.repo.CreateOrder(ctx, order, event); err != nil {
+		return nil, err
 	}
 
 	return &CreateOrderResponse{
@@ -126,6 +138,65 @@ func (s *orderService) GetOrders(ctx context.Context, userID string) ([]shared.O
 	return s.repo.GetOrders(ctx, userID)
 }
 
+// CancelOrder cancels an order that has not shipped yet. The OrderCancelled
+// event makes the orchestrator refund the payment and release the stock;
+// shipping skips cancelled orders.
+func (s *orderService) CancelOrder(ctx context.Context, orderID string, req *CancelOrderRequest) (*CancelOrderResponse, error) {
+	cancelledBy := "customer"
+	if req.Admin {
+		cancelledBy = "admin"
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "cancelled by " + cancelledBy
+	}
+
+	err := s.repo.CancelOrder(ctx, orderID, func(order *shared.Order, shipped bool) (shared.OrderEvent, error) {
+		if !req.Admin && order.UserID != req.UserID {
+			return shared.OrderEvent{}, ErrOrderNotOwned
+		}
+		next, err := orderfsm.Order.Apply(orderfsm.State(order.Status), orderfsm.Event(shared.EventOrderCancelled),
+			orderfsm.Input{ShipmentCreated: shipped})
+		switch {
+		case errors.Is(err, orderfsm.ErrGuardRejected),
+			order.Status == shared.StatusShipped, order.Status == shared.StatusDelivered:
+			return shared.OrderEvent{}, ErrOrderAlreadyShipped
+		case err != nil:
+			return shared.OrderEvent{}, ErrInvalidOrderStatus
+		case string(next) == order.Status:
+			return shared.OrderEvent{}, ErrOrderAlreadyCancelled
+		}
+
+		return shared.OrderEvent{
+			EventID:     uuid.New().String(),
+			EventType:   shared.EventOrderCancelled,
+			OrderID:     order.ID,
+			UserID:      order.UserID,
+			TotalAmount: order.TotalAmount,
+			Status:      shared.StatusCancelled,
+			Timestamp:   time.Now(),
+			Metadata: map[string]interface{}{
+				"reason":          reason,
+				"cancelled_by":    cancelledBy,
+				"previous_status": order.Status,
+			},
+		}, nil
+	})
+	if err == repository.ErrOrderNotFound {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &CancelOrderResponse{
+		OrderID: orderID,
+		Status:  shared.StatusCancelled,
+		Reason:  reason,
+		Message: "Order cancelled successfully",
+	}, nil
+}
+
 func (s *orderService) GetProducts(ctx context.Context, filter *repository.ProductsFilter, pagination *repository.PaginationParams) (*repository.PaginatedResponse, error) {
 	return s.repo.GetProducts(ctx, filter, pagination)
 }
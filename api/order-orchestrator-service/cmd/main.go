@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/app"
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/config"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	// Load configuration
+	cfg := config.Load()
+
+	// Shut down gracefully on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Initialize and run application
+	application := app.New(cfg)
+	if err := application.Run(ctx); err != nil {
+		log.Fatal("Failed to run application:", err)
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/config"
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/service"
+	"go-rabbitmq-order-system/pkg/tracing"
+	"go-rabbitmq-order-system/shared"
+)
+
+// serviceName identifies this service as the producer of its events
+const serviceName = "order-orchestrator"
+
+type App struct {
+	config   *config.Config
+	database *shared.Database
+	broker   shared.Broker
+}
+
+func New(cfg *config.Config) *App {
+	return &App{
+		config: cfg,
+	}
+}
+
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, serviceName, a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.ShutdownTimeout)
+
+	// Initialize database
+	db, err := shared.NewDatabase(a.config.Database.URL)
+	if err != nil {
+		return err
+	}
+	a.database = db
+
+	// Initialize RabbitMQ
+	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL,
+		shared.WithRetryPolicy(shared.RetryPolicy{
+			MaxAttempts:  a.config.RabbitMQ.RetryAttempts,
+			InitialDelay: a.config.RabbitMQ.RetryDelay,
+			MaxDelay:     a.config.RabbitMQ.MaxRetryDelay,
+		}),
+		shared.WithReconnectBackoff(a.config.RabbitMQ.ReconnectDelay, a.config.RabbitMQ.MaxReconnectDelay),
+		shared.WithPublishWait(a.config.RabbitMQ.PublishWait),
+		shared.WithPublishTimeout(a.config.RabbitMQ.PublishTimeout),
+		shared.WithPrefetch(a.config.Consumer.Prefetch),
+		shared.WithWorkers(a.config.Consumer.Workers, a.config.Consumer.OrderByOrderID),
+		shared.WithProducer(serviceName),
+		shared.WithEventStore(shared.NewEventStore(db.DB)),
+		shared.WithInbox(shared.NewInbox(db.DB, serviceName)),
+		shared.WithStateHook(shared.LogConnectionState(serviceName)),
+	)
+	if err != nil {
+		return err
+	}
+	a.broker = rabbitmq
+
+	outbox := shared.NewOutbox(db.DB, serviceName, a.config.Outbox.PollInterval)
+	if err := a.Start(ctx, db.DB, rabbitmq, outbox); err != nil {
+		return err
+	}
+
+	log.Println("Order Orchestrator Service started")
+	log.Println("Waiting for order events...")
+
+	// Run until a shutdown signal cancels the context
+	<-ctx.Done()
+	log.Println("Shutting down Order Orchestrator Service")
+	return a.Close()
+}
+
+// Start sets up the service's queue on the broker, starts relaying the outbox
+// and the saga timeout check and consumes events until ctx ends. It does
+// not block.
+func (a *App) Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	// Setup exchange and this service's queue bindings
+	if err := broker.SetupExchange(); err != nil {
+		return err
+	}
+	if err := broker.SetupQueue(shared.OrchestratorQueue); err != nil {
+		return err
+	}
+
+	// Start publishing stored events
+	go outbox.Relay(ctx, broker)
+
+	// Initialize service and cancel sagas that run out of time
+	orchestrator := service.New(db, outbox, &a.config.Saga)
+	go orchestrator.RunTimeouts(ctx)
+
+	// Start consuming events
+	return broker.ConsumeEvents(ctx, shared.OrchestratorQueue, orchestrator.HandleOrderEvent)
+}
+
+// Close waits for in-flight events to be handled, up to the shutdown
+// timeout, and then closes the broker and database connections
+func (a *App) Close() error {
+	var err error
+	if a.broker != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
+		defer cancel()
+		err = a.broker.Shutdown(ctx)
+	}
+	if a.database != nil {
+		a.database.Close()
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"os"
+	"time"
+
+	"go-rabbitmq-order-system/pkg/config"
+)
+
+type Config struct {
+	*config.BaseConfig
+	Saga SagaConfig
+}
+
+// SagaConfig bounds how long an order may wait for its payment and stock
+// outcomes before the orchestrator cancels it
+type SagaConfig struct {
+	Timeout       time.Duration
+	CheckInterval time.Duration
+	BatchSize     int
+}
+
+func Load() *Config {
+	baseConfig := config.LoadBaseConfig()
+
+	return &Config{
+		BaseConfig: baseConfig,
+		Saga: SagaConfig{
+			Timeout:       getEnvAsDuration("SAGA_TIMEOUT", "5m"),
+			CheckInterval: getEnvAsDuration("SAGA_TIMEOUT_CHECK_INTERVAL", "30s"),
+			BatchSize:     100, // Time out at most 100 sagas per check
+		},
+	}
+}
+
+func getEnvAsDuration(key string, defaultValue string) time.Duration {
+	value := defaultValue
+	if env := os.Getenv(key); env != "" {
+		value = env
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	duration, _ := time.ParseDuration(defaultValue)
+	return duration
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// Saga statuses
+const (
+	SagaStarted          = "STARTED"
+	SagaReadyForShipping = "READY_FOR_SHIPPING"
+	SagaShipped          = "SHIPPED"
+	SagaCompensating     = "COMPENSATING"
+	SagaCancelled        = "CANCELLED"
+)
+
+// Outcomes of the payment and stock steps
+const (
+	StepPending = "PENDING"
+
+	PaymentSucceeded       = "SUCCEEDED" // authorized
+	PaymentFailed          = "FAILED"
+	PaymentCaptured        = "CAPTURED"
+	PaymentCaptureFailed   = "CAPTURE_FAILED"
+	PaymentExpired         = "EXPIRED"
+	PaymentRefundRequested = "REFUND_REQUESTED"
+	PaymentRefunded        = "REFUNDED"
+	PaymentRefundFailed    = "REFUND_FAILED"
+	PaymentVoided          = "VOIDED"
+
+	StockReserved         = "RESERVED"
+	StockInsufficient     = "INSUFFICIENT"
+	StockReleaseRequested = "RELEASE_REQUESTED"
+	StockReleased         = "RELEASED"
+)
+
+// Saga is the persisted state of one order's workflow. Payment and stock
+// run in parallel; the saga records the outcome of each and whether the
+// order went on to shipping or was cancelled. A saga that fails after one
+// step succeeded is compensating until that step has been undone.
+type Saga struct {
+	OrderID       string
+	UserID        string
+	TotalAmount   float64
+	Status        string
+	PaymentStatus string
+	StockStatus   string
+	FailureReason string
+	DeadlineAt    time.Time
+}
+
+const sagaColumns = `order_id, user_id, total_amount, status, payment_status, stock_status,
+		COALESCE(failure_reason, ''), deadline_at`
+
+func scanSaga(row interface{ Scan(...interface{}) error }) (*Saga, error) {
+	var saga Saga
+	err := row.Scan(&saga.OrderID, &saga.UserID, &saga.TotalAmount, &saga.Status,
+		&saga.PaymentStatus, &saga.StockStatus, &saga.FailureReason, &saga.DeadlineAt)
+	if err != nil {
+		return nil, err
+	}
+	return &saga, nil
+}
+
+// lockSaga returns the saga of the event's order locked for update. Only
+// OrderCreated starts a saga; for other events of an order without one it
+// returns sql.ErrNoRows, or an error to retry if the order was created so
+// recently that its OrderCreated may still be on the way.
+func (s *OrchestratorService) lockSaga(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) (*Saga, error) {
+	if event.EventType == shared.EventOrderCreated {
+		now := time.Now()
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_sagas (order_id, user_id, total_amount, status, payment_status, stock_status, deadline_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $5, $6, $7, $7)
+			ON CONFLICT (order_id) DO NOTHING
+		`, event.OrderID, event.UserID, event.TotalAmount, SagaStarted, StepPending, now.Add(s.config.Timeout), now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start saga for order %s: %v", event.OrderID, err)
+		}
+	}
+
+	saga, err := scanSaga(tx.QueryRowContext(ctx,
+		"SELECT "+sagaColumns+" FROM order_sagas WHERE order_id = $1 FOR UPDATE", event.OrderID))
+	if err == sql.ErrNoRows {
+		var createdAt time.Time
+		err := tx.QueryRowContext(ctx, "SELECT created_at FROM orders WHERE id = $1", event.OrderID).Scan(&createdAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to load order %s: %v", event.OrderID, err)
+		}
+		if err == nil && time.Since(createdAt) < s.config.Timeout {
+			return nil, fmt.Errorf("saga for order %s is not started yet", event.OrderID)
+		}
+		return nil, sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load saga for order %s: %v", event.OrderID, err)
+	}
+	return saga, nil
+}
+
+// lockExpiredSagas returns up to limit started sagas whose deadline passed,
+// skipping sagas another orchestrator is working on
+func (s *OrchestratorService) lockExpiredSagas(ctx context.Context, tx *sql.Tx, limit int) ([]*Saga, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+sagaColumns+`
+		FROM order_sagas
+		WHERE status = $1 AND deadline_at < $2
+		ORDER BY deadline_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	`, SagaStarted, time.Now(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired sagas: %v", err)
+	}
+	defer rows.Close()
+
+	var sagas []*Saga
+	for rows.Next() {
+		saga, err := scanSaga(rows)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, saga)
+	}
+	return sagas, rows.Err()
+}
+
+func (s *OrchestratorService) saveSaga(ctx context.Context, tx *sql.Tx, saga *Saga) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE order_sagas
+		SET status = $1, payment_status = $2, stock_status = $3, failure_reason = NULLIF($4, ''), updated_at = $5
+		WHERE order_id = $6
+	`, saga.Status, saga.PaymentStatus, saga.StockStatus, saga.FailureReason, time.Now(), saga.OrderID)
+	if err != nil {
+		return fmt.Errorf("failed to save saga for order %s: %v", saga.OrderID, err)
+	}
+	return nil
+}
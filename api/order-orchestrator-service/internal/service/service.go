@@ -0,0 +1,332 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/config"
+	"go-rabbitmq-order-system/shared"
+)
+
+// OrchestratorService owns the order workflow. It follows the payment and
+// stock outcomes of each order in a persisted saga and is the only service
+// that decides whether an order ships or is cancelled.
+type OrchestratorService struct {
+	db     *sql.DB
+	outbox shared.EventOutbox
+	config *config.SagaConfig
+}
+
+func New(db *sql.DB, outbox shared.EventOutbox, config *config.SagaConfig) *OrchestratorService {
+	return &OrchestratorService{
+		db:     db,
+		outbox: outbox,
+		config: config,
+	}
+}
+
+// HandleOrderEvent advances the order's saga in the inbox transaction that
+// marks the event as processed. The saga row is locked, so outcomes of the
+// same order arriving together are applied one after the other.
+func (s *OrchestratorService) HandleOrderEvent(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
+	log.Printf("Received event: %s for order: %s", event.EventType, event.OrderID)
+
+	saga, err := s.lockSaga(ctx, tx, event)
+	if err == sql.ErrNoRows {
+		log.Printf("Skipping %s for order %s: no saga was started for it", event.EventType, event.OrderID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch event.EventType {
+	case shared.EventOrderCreated:
+		// The saga was started by lockSaga
+	case shared.EventPaymentSuccessful:
+		if saga.PaymentStatus == StepPending {
+			saga.PaymentStatus = PaymentSucceeded
+		}
+	case shared.EventPaymentFailed:
+		if saga.PaymentStatus == StepPending {
+			saga.PaymentStatus = PaymentFailed
+		}
+		if saga.Status == SagaStarted {
+			err = s.cancel(ctx, tx, saga, &event, "payment failed: "+metadataMessage(event))
+		}
+	case shared.EventStockReserved:
+		if saga.StockStatus == StepPending {
+			saga.StockStatus = StockReserved
+		}
+	case shared.EventStockInsufficient:
+		if saga.StockStatus == StepPending {
+			saga.StockStatus = StockInsufficient
+		}
+		if saga.Status == SagaStarted {
+			err = s.cancel(ctx, tx, saga, &event, "stock unavailable: "+metadataMessage(event))
+		}
+	case shared.EventOrderShipped:
+		switch saga.Status {
+		case SagaReadyForShipping:
+			saga.Status = SagaShipped
+		case SagaCompensating, SagaCancelled:
+			// Compensation goes on; the shipment is left to an admin
+			log.Printf("Order %s shipped while its saga is %s: %s", saga.OrderID, saga.Status, saga.FailureReason)
+		}
+	case shared.EventOrderCancelled:
+		// Cancellations decided here come back as well; only a cancellation
+		// requested by a customer or admin needs the saga to follow it
+		if saga.Status != SagaStarted && saga.Status != SagaReadyForShipping {
+			return nil
+		}
+		saga.Status = SagaCancelled
+		saga.FailureReason, _ = event.Metadata["reason"].(string)
+		log.Printf("Order %s was cancelled: %s", saga.OrderID, saga.FailureReason)
+	case shared.EventOrderCancellationRequested:
+		if saga.Status != SagaStarted && saga.Status != SagaReadyForShipping {
+			log.Printf("Not cancelling order %s on request: saga is %s", saga.OrderID, saga.Status)
+			return nil
+		}
+		err = s.cancel(ctx, tx, saga, &event, "cancellation requested: "+metadataMessage(event))
+	case shared.EventPaymentCaptured:
+		if saga.PaymentStatus == PaymentSucceeded {
+			saga.PaymentStatus = PaymentCaptured
+		}
+	case shared.EventPaymentCaptureFailed:
+		if saga.PaymentStatus == PaymentSucceeded {
+			saga.PaymentStatus = PaymentCaptureFailed
+		}
+		switch saga.Status {
+		case SagaReadyForShipping:
+			err = s.cancel(ctx, tx, saga, &event, "payment capture failed: "+metadataMessage(event))
+		case SagaShipped:
+			// The goods are gone; collecting the payment is left to an admin
+			log.Printf("Order %s shipped without its payment being captured: %s", saga.OrderID, metadataMessage(event))
+		}
+	case shared.EventPaymentAuthorizationExpired:
+		if saga.PaymentStatus == PaymentSucceeded {
+			saga.PaymentStatus = PaymentExpired
+		}
+		if saga.Status == SagaStarted || saga.Status == SagaReadyForShipping {
+			err = s.cancel(ctx, tx, saga, &event, "payment authorization expired: "+metadataMessage(event))
+		}
+	case shared.EventRefundIssued:
+		// Refunds for returns or issued by an admin do not concern the saga
+		if saga.PaymentStatus == PaymentRefundRequested && !isManualRefund(event) {
+			saga.PaymentStatus = PaymentRefunded
+		}
+	case shared.EventRefundFailed:
+		if saga.PaymentStatus != PaymentRefundRequested || isManualRefund(event) {
+			return nil
+		}
+		// The order is cancelled regardless; the refund is left to an admin
+		saga.PaymentStatus = PaymentRefundFailed
+		log.Printf("Refund of cancelled order %s failed: %s", saga.OrderID, metadataMessage(event))
+	case shared.EventPaymentVoided:
+		saga.PaymentStatus = PaymentVoided
+	case shared.EventStockReleased:
+		saga.StockStatus = StockReleased
+	case shared.EventStockReservationExpired:
+		// The stock is already given back; an order still waiting to be
+		// paid, or paid just as the reservation expired, cannot ship
+		saga.StockStatus = StockReleased
+		if saga.Status == SagaStarted || saga.Status == SagaReadyForShipping {
+			err = s.cancel(ctx, tx, saga, &event, "stock reservation expired: "+metadataMessage(event))
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.advance(ctx, tx, saga, &event); err != nil {
+		return err
+	}
+
+	return s.saveSaga(ctx, tx, saga)
+}
+
+// advance emits the next command once the outcomes recorded on the saga
+// allow one. A started saga with payment and stock done is ready for
+// shipping. A failed saga is cancelled once its compensations are done; a
+// cancelled saga compensates its steps, including successes that arrive
+// after the cancellation.
+func (s *OrchestratorService) advance(ctx context.Context, tx *sql.Tx, saga *Saga, cause *shared.OrderEvent) error {
+	switch saga.Status {
+	case SagaStarted:
+		if saga.PaymentStatus != PaymentSucceeded || saga.StockStatus != StockReserved {
+			return nil
+		}
+		saga.Status = SagaReadyForShipping
+		if err := s.emit(ctx, tx, saga, cause, shared.EventOrderReadyForShipping, nil); err != nil {
+			return err
+		}
+		log.Printf("Order %s is now ready for shipping", saga.OrderID)
+		return nil
+	case SagaCompensating:
+		if err := s.compensate(ctx, tx, saga, cause); err != nil {
+			return err
+		}
+		return s.finishCancellation(ctx, tx, saga, cause)
+	case SagaCancelled:
+		return s.compensate(ctx, tx, saga, cause)
+	}
+	return nil
+}
+
+// cancel fails a saga that cannot complete. Steps that already succeeded
+// are compensated first; the order is cancelled with the reason once no
+// compensation is outstanding.
+func (s *OrchestratorService) cancel(ctx context.Context, tx *sql.Tx, saga *Saga, cause *shared.OrderEvent, reason string) error {
+	saga.Status = SagaCompensating
+	saga.FailureReason = reason
+	log.Printf("Compensating order %s: %s", saga.OrderID, reason)
+
+	if err := s.compensate(ctx, tx, saga, cause); err != nil {
+		return err
+	}
+	return s.finishCancellation(ctx, tx, saga, cause)
+}
+
+// finishCancellation cancels the order of a compensating saga when neither
+// a refund nor a stock release is still awaited
+func (s *OrchestratorService) finishCancellation(ctx context.Context, tx *sql.Tx, saga *Saga, cause *shared.OrderEvent) error {
+	if saga.PaymentStatus == PaymentRefundRequested || saga.StockStatus == StockReleaseRequested {
+		return nil
+	}
+
+	saga.Status = SagaCancelled
+	if err := s.emit(ctx, tx, saga, cause, shared.EventOrderCancelled, map[string]interface{}{
+		"reason": saga.FailureReason,
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("Cancelled order %s: %s", saga.OrderID, saga.FailureReason)
+	return nil
+}
+
+// compensate requests a refund for a successful payment and a release for
+// reserved stock of a failed saga. Each is requested at most once; the
+// payment service voids a payment that was only authorized, or whose
+// capture failed with the authorization still held.
+func (s *OrchestratorService) compensate(ctx context.Context, tx *sql.Tx, saga *Saga, cause *shared.OrderEvent) error {
+	metadata := map[string]interface{}{
+		"reason": saga.FailureReason,
+	}
+
+	switch saga.PaymentStatus {
+	case PaymentSucceeded, PaymentCaptured, PaymentCaptureFailed:
+		saga.PaymentStatus = PaymentRefundRequested
+		if err := s.emit(ctx, tx, saga, cause, shared.EventPaymentRefundRequested, metadata); err != nil {
+			return err
+		}
+	}
+
+	if saga.StockStatus == StockReserved {
+		saga.StockStatus = StockReleaseRequested
+		if err := s.emit(ctx, tx, saga, cause, shared.EventStockReleaseRequested, metadata); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// emit stores an event of the saga in the outbox. Events decided on a timeout
+// have no cause and start from the saga itself.
+func (s *OrchestratorService) emit(ctx context.Context, tx *sql.Tx, saga *Saga, cause *shared.OrderEvent, eventType string, metadata map[string]interface{}) error {
+	var event shared.OrderEvent
+	if cause != nil {
+		event = cause.FollowUp(eventType)
+	} else {
+		event = shared.OrderEvent{
+			CorrelationID: saga.OrderID,
+			EventType:     eventType,
+			OrderID:       saga.OrderID,
+			Timestamp:     time.Now(),
+		}
+	}
+	event.UserID = saga.UserID
+	event.TotalAmount = saga.TotalAmount
+	event.Status = eventType
+	event.Metadata = metadata
+
+	return s.outbox.Add(ctx, tx, event)
+}
+
+// RunTimeouts cancels sagas that are still waiting for payment or stock
+// after the saga timeout, until ctx is cancelled
+func (s *OrchestratorService) RunTimeouts(ctx context.Context) {
+	ticker := time.NewTicker(s.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.timeOutExpired(ctx); err != nil {
+			log.Printf("Saga timeout check failed: %v", err)
+		}
+	}
+}
+
+// timeOutExpired cancels one batch of expired sagas in a single transaction
+func (s *OrchestratorService) timeOutExpired(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sagas, err := s.lockExpiredSagas(ctx, tx, s.config.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, saga := range sagas {
+		reason := fmt.Sprintf("timed out after %s waiting for %s", s.config.Timeout, pendingSteps(saga))
+		if err := s.cancel(ctx, tx, saga, nil, reason); err != nil {
+			return err
+		}
+		if err := s.saveSaga(ctx, tx, saga); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// pendingSteps names the steps a saga is still waiting for
+func pendingSteps(saga *Saga) string {
+	switch {
+	case saga.PaymentStatus == StepPending && saga.StockStatus == StepPending:
+		return "payment and stock"
+	case saga.PaymentStatus == StepPending:
+		return "payment"
+	default:
+		return "stock"
+	}
+}
+
+// metadataMessage returns the message a service attached to its result event
+func metadataMessage(event shared.OrderEvent) string {
+	if message, ok := event.Metadata["message"].(string); ok && message != "" {
+		return message
+	}
+	return "no reason given"
+}
+
+// isManualRefund reports whether a refund result is of a refund made for a
+// return or by an admin rather than requested by a saga
+func isManualRefund(event shared.OrderEvent) bool {
+	source, _ := event.Metadata["source"].(string)
+	return source == "admin" || source == "return"
+}
@@ -0,0 +1,18 @@
+// Package orchestrator starts the order orchestrator service with its configuration from the
+// environment, for tests that run the services in one process.
+package orchestrator
+
+import (
+	"context"
+	"database/sql"
+
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/app"
+	"go-rabbitmq-order-system/order-orchestrator-service/internal/config"
+	"go-rabbitmq-order-system/shared"
+)
+
+// Start starts the service on db and broker, storing its events in outbox,
+// until ctx ends. It does not block.
+func Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	return app.New(config.Load()).Start(ctx, db, broker, outbox)
+}
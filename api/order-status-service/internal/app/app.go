@@ -1,17 +1,30 @@
 package app
 
 import (
+	"context"
+	"database/sql"
 	"log"
+	"net/http"
 
 	"go-rabbitmq-order-system/order-status-service/internal/config"
+	"go-rabbitmq-order-system/order-status-service/internal/handler"
 	"go-rabbitmq-order-system/order-status-service/internal/service"
+	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/pkg/server"
+	"go-rabbitmq-order-system/pkg/tracing"
 	"go-rabbitmq-order-system/shared"
+
+	"github.com/gin-gonic/gin"
 )
 
+// serviceName identifies this service as the producer of its events
+const serviceName = "order-status"
+
 type App struct {
 	config   *config.Config
 	database *shared.Database
-	rabbitMQ *shared.RabbitMQ
+	broker   shared.Broker
+	service  *service.OrderStatusService
 }
 
 func New(cfg *config.Config) *App {
@@ -20,7 +33,14 @@ func New(cfg *config.Config) *App {
 	}
 }
 
-func (a *App) Run() error {
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, serviceName, a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.ShutdownTimeout)
+
 	// Initialize database
 	db, err := shared.NewDatabase(a.config.Database.URL)
 	if err != nil {
@@ -29,34 +49,103 @@ func (a *App) Run() error {
 	a.database = db
 
 	// Initialize RabbitMQ
-	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL)
+	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL,
+		shared.WithRetryPolicy(shared.RetryPolicy{
+			MaxAttempts:  a.config.RabbitMQ.RetryAttempts,
+			InitialDelay: a.config.RabbitMQ.RetryDelay,
+			MaxDelay:     a.config.RabbitMQ.MaxRetryDelay,
+		}),
+		shared.WithReconnectBackoff(a.config.RabbitMQ.ReconnectDelay, a.config.RabbitMQ.MaxReconnectDelay),
+		shared.WithPublishWait(a.config.RabbitMQ.PublishWait),
+		shared.WithPublishTimeout(a.config.RabbitMQ.PublishTimeout),
+		shared.WithPrefetch(a.config.Consumer.Prefetch),
+		shared.WithWorkers(a.config.Consumer.Workers, a.config.Consumer.OrderByOrderID),
+		shared.WithProducer(serviceName),
+		shared.WithEventStore(shared.NewEventStore(db.DB)),
+		shared.WithInbox(shared.NewInbox(db.DB, serviceName)),
+		shared.WithStateHook(shared.LogConnectionState(serviceName)),
+	)
 	if err != nil {
 		return err
 	}
-	a.rabbitMQ = rabbitmq
+	a.broker = rabbitmq
 
-	// Initialize service
-	orderStatusService := service.New(db.DB, rabbitmq, &a.config.OrderStatus)
-
-	// Start consuming events
-	err = rabbitmq.ConsumeEvents("order_status_queue", orderStatusService.HandleOrderEvent)
-	if err != nil {
+	outbox := shared.NewOutbox(db.DB, serviceName, a.config.Outbox.PollInterval)
+	if err := a.Start(ctx, db.DB, rabbitmq, outbox); err != nil {
 		return err
 	}
 
 	log.Println("Order Status Update Service started")
 	log.Println("Waiting for order events...")
 
-	// Keep the service running
-	select {}
+	// Serve the API until a shutdown signal cancels the context
+	srv := &http.Server{
+		Addr:    ":" + a.config.Port,
+		Handler: a.router(handler.New(a.service, rabbitmq.State)),
+	}
+	log.Printf("Order Status Update Service listening on port %s", a.config.Port)
+	err = server.Run(ctx, srv, a.config.ShutdownTimeout)
+
+	log.Println("Shutting down Order Status Update Service")
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (a *App) router(h *handler.Handler) http.Handler {
+	r := gin.Default()
+	r.Use(middleware.RequestID())
+	r.Use(tracing.Middleware())
+	r.Use(middleware.Recovery(serviceName))
+
+	r.GET("/health", h.Health)
+	r.GET("/metrics", h.Metrics)
+
+	// API routes
+	api := r.Group("/api/v1")
+	{
+		api.GET("/orders/:id/history", h.GetOrderHistory)
+	}
+
+	return r
 }
 
+// Start sets up the service's queue on the broker, starts relaying the outbox
+// and the stuck order watchdog and consumes events until ctx ends. It does
+// not block.
+func (a *App) Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	// Setup exchange and this service's queue bindings
+	if err := broker.SetupExchange(); err != nil {
+		return err
+	}
+	if err := broker.SetupQueue(shared.OrderStatusQueue); err != nil {
+		return err
+	}
+
+	// Start publishing stored events
+	go outbox.Relay(ctx, broker)
+
+	// Initialize service and watch for orders stuck mid-saga
+	orderStatusService := service.New(db, outbox, &a.config.OrderStatus, &a.config.Watchdog)
+	a.service = orderStatusService
+	go orderStatusService.RunWatchdog(ctx)
+
+	// Start consuming events
+	return broker.ConsumeEvents(ctx, shared.OrderStatusQueue, orderStatusService.HandleOrderEvent)
+}
+
+// Close waits for in-flight events to be handled, up to the shutdown
+// timeout, and then closes the broker and database connections
 func (a *App) Close() error {
+	var err error
+	if a.broker != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
+		defer cancel()
+		err = a.broker.Shutdown(ctx)
+	}
 	if a.database != nil {
 		a.database.Close()
 	}
-	if a.rabbitMQ != nil {
-		a.rabbitMQ.Close()
-	}
-	return nil
+	return err
 } 
\ No newline at end of file
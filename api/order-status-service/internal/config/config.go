@@ -1,12 +1,18 @@
 package config
 
 import (
+	"os"
+	"time"
+
 	"go-rabbitmq-order-system/pkg/config"
+	"go-rabbitmq-order-system/shared"
 )
 
 type Config struct {
 	*config.BaseConfig
+	Port        string
 	OrderStatus OrderStatusConfig
+	Watchdog    WatchdogConfig
 }
 
 type OrderStatusConfig struct {
@@ -15,15 +21,52 @@ type OrderStatusConfig struct {
 	EnableAuditLog  bool
 }
 
+// WatchdogConfig sets how long an order may stay in a status before the
+// watchdog re-drives it, and after how long in the same status it is
+// cancelled instead
+type WatchdogConfig struct {
+	SLA           map[string]time.Duration
+	HardLimit     time.Duration
+	CheckInterval time.Duration
+	BatchSize     int
+}
+
 func Load() *Config {
 	baseConfig := config.LoadBaseConfig()
-	
+
 	return &Config{
 		BaseConfig: baseConfig,
+		Port:       getEnv("PORT", "8085"),
 		OrderStatus: OrderStatusConfig{
-			UpdateBatchSize: 100,   // Process 100 updates at a time
+			UpdateBatchSize: 100,    // Process 100 updates at a time
 			LogLevel:        "INFO", // INFO, DEBUG, WARN, ERROR
 			EnableAuditLog:  true,   // Enable audit logging
 		},
+		Watchdog: WatchdogConfig{
+			SLA: map[string]time.Duration{
+				shared.StatusCreated:           getEnvAsDuration("WATCHDOG_SLA_CREATED", "2m"),
+				shared.StatusPaymentSuccessful: getEnvAsDuration("WATCHDOG_SLA_PAYMENT_SUCCESSFUL", "2m"),
+				shared.StatusStockReserved:     getEnvAsDuration("WATCHDOG_SLA_STOCK_RESERVED", "2m"),
+			},
+			HardLimit:     getEnvAsDuration("WATCHDOG_HARD_LIMIT", "30m"),
+			CheckInterval: getEnvAsDuration("WATCHDOG_CHECK_INTERVAL", "30s"),
+			BatchSize:     100, // Handle at most 100 stuck orders per status and check
+		},
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue string) time.Duration {
+	value := getEnv(key, defaultValue)
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
 	}
-} 
\ No newline at end of file
+	duration, _ := time.ParseDuration(defaultValue)
+	return duration
+}
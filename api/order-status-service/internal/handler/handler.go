@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"go-rabbitmq-order-system/order-status-service/internal/service"
+	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	service     *service.OrderStatusService
+	brokerState func() shared.ConnectionState
+}
+
+func New(svc *service.OrderStatusService, brokerState func() shared.ConnectionState) *Handler {
+	return &Handler{
+		service:     svc,
+		brokerState: brokerState,
+	}
+}
+
+func (h *Handler) Health(c *gin.Context) {
+	status := "healthy"
+	brokerState := h.brokerState()
+	if brokerState != shared.StateConnected {
+		status = "degraded"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   status,
+		"service":  "order-status",
+		"rabbitmq": brokerState,
+	})
+}
+
+// GetOrderHistory returns the timeline of an order's status changes to the
+// user the gateway authenticated the request for, if they own the order
+func (h *Handler) GetOrderHistory(c *gin.Context) {
+	userID := c.GetHeader(middleware.HeaderUserID)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	history, err := h.service.GetOrderHistory(c.Request.Context(), c.Param("id"), userID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, history)
+	case service.ErrOrderNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+	case service.ErrOrderNotOwned:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get order history"})
+	}
+}
+
+// Metrics reports how many stuck orders the watchdog re-drove or asked to
+// cancel, by the status they were stuck in
+func (h *Handler) Metrics(c *gin.Context) {
+	watchdog, err := h.service.WatchdogActions(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get metrics"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"metrics": gin.H{
+			"watchdog": watchdog,
+		},
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
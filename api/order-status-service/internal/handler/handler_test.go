@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/order-status-service/internal/config"
+	"go-rabbitmq-order-system/order-status-service/internal/service"
+	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+const testOrderID = "0b6f2c4e-8a1d-4f3b-9e7c-5d2a1b3c4e5f"
+
+// getHistory requests the test order's history as userID from a handler
+// whose database is mocked by mock
+func getHistory(t *testing.T, userID string, expect func(mock sqlmock.Sqlmock)) *httptest.ResponseRecorder {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expect(mock)
+
+	svc := service.New(db, shared.NewMemoryOutbox("order-status"), &config.OrderStatusConfig{}, &config.WatchdogConfig{})
+	h := New(svc, func() shared.ConnectionState { return shared.StateConnected })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/orders/:id/history", h.GetOrderHistory)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/orders/"+testOrderID+"/history", nil)
+	if userID != "" {
+		req.Header.Set(middleware.HeaderUserID, userID)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	return w
+}
+
+// expectOrder expects the test order, owned by user-1, to be looked up
+func expectOrder(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, user_id FROM orders")).
+		WithArgs(testOrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "user_id"}).AddRow(shared.StatusCreated, "user-1"))
+}
+
+func TestGetOrderHistoryOfOwner(t *testing.T) {
+	w := getHistory(t, "user-1", func(mock sqlmock.Sqlmock) {
+		expectOrder(mock)
+		mock.ExpectQuery(regexp.QuoteMeta("FROM order_status_history")).
+			WithArgs(testOrderID, service.WatchdogRedrive, service.WatchdogCancel).
+			WillReturnRows(sqlmock.NewRows([]string{"old_status", "new_status", "event_type", "metadata", "created_at"}).
+				AddRow("", shared.StatusCreated, shared.EventOrderCreated, []byte(`{}`), time.Now()))
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var history service.OrderHistory
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if history.OrderID != testOrderID || len(history.History) != 1 || history.History[0].NewStatus != shared.StatusCreated {
+		t.Errorf("history = %+v, want the order's creation", history)
+	}
+}
+
+func TestGetOrderHistoryOfAnotherUser(t *testing.T) {
+	w := getHistory(t, "user-2", expectOrder)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestGetOrderHistoryUnauthenticated(t *testing.T) {
+	w := getHistory(t, "", func(sqlmock.Sqlmock) {})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrOrderNotOwned = errors.New("order belongs to another user")
+)
+
+// HistoryEntry is one status change of an order, with the metadata of the
+// event that caused it, such as the transaction ID or tracking number
+type HistoryEntry struct {
+	OldStatus string                 `json:"old_status"`
+	NewStatus string                 `json:"new_status"`
+	EventType string                 `json:"event_type"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// OrderHistory is the timeline of an order's status changes, oldest first
+type OrderHistory struct {
+	OrderID string         `json:"order_id"`
+	Status  string         `json:"status"`
+	History []HistoryEntry `json:"history"`
+}
+
+// GetOrderHistory returns the current status and the status changes of an
+// order owned by userID. The watchdog's actions are left out: they are
+// operational records, not changes of the order.
+func (s *OrderStatusService) GetOrderHistory(ctx context.Context, orderID, userID string) (*OrderHistory, error) {
+	if _, err := uuid.Parse(orderID); err != nil {
+		return nil, ErrOrderNotFound
+	}
+
+	history := OrderHistory{
+		OrderID: orderID,
+		History: []HistoryEntry{},
+	}
+	var owner string
+	err := s.db.QueryRowContext(ctx, "SELECT status, user_id FROM orders WHERE id = $1", orderID).Scan(&history.Status, &owner)
+	if err == sql.ErrNoRows {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order %s: %v", orderID, err)
+	}
+	if owner != userID {
+		return nil, ErrOrderNotOwned
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT COALESCE(old_status, ''), new_status, event_type, COALESCE(metadata, '{}'), created_at
+		FROM order_status_history
+		WHERE order_id = $1 AND event_type NOT IN ($2, $3)
+		ORDER BY created_at, id
+	`, orderID, WatchdogRedrive, WatchdogCancel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history of order %s: %v", orderID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry HistoryEntry
+		var metadata []byte
+		err := rows.Scan(&entry.OldStatus, &entry.NewStatus, &entry.EventType, &metadata, &entry.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &entry.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode history metadata: %v", err)
+		}
+		history.History = append(history.History, entry)
+	}
+
+	return &history, rows.Err()
+}
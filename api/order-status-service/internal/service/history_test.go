@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testOrderID is the order whose history the tests read
+const testOrderID = "0b6f2c4e-8a1d-4f3b-9e7c-5d2a1b3c4e5f"
+
+// expectOrderHistory expects the history of the test order, owned by
+// user-1, to be read
+func expectOrderHistory(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, user_id FROM orders")).
+		WithArgs(testOrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "user_id"}).AddRow(shared.StatusPaymentSuccessful, "user-1"))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM order_status_history")).
+		WithArgs(testOrderID, WatchdogRedrive, WatchdogCancel).
+		WillReturnRows(sqlmock.NewRows([]string{"old_status", "new_status", "event_type", "metadata", "created_at"}).
+			AddRow("", shared.StatusCreated, shared.EventOrderCreated, []byte(`{}`), time.Now().Add(-time.Minute)).
+			AddRow(shared.StatusCreated, shared.StatusPaymentSuccessful, shared.EventPaymentSuccessful,
+				[]byte(`{"transaction_id":"TXN_1"}`), time.Now()))
+}
+
+func TestGetOrderHistory(t *testing.T) {
+	s, mock, _ := newTestService(t)
+	expectOrderHistory(mock)
+
+	history, err := s.GetOrderHistory(context.Background(), testOrderID, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Status != shared.StatusPaymentSuccessful || len(history.History) != 2 {
+		t.Fatalf("history = %s with %d entries, want %s with 2", history.Status, len(history.History), shared.StatusPaymentSuccessful)
+	}
+	if entry := history.History[1]; entry.NewStatus != shared.StatusPaymentSuccessful || entry.Metadata["transaction_id"] != "TXN_1" {
+		t.Errorf("last entry = %s with %v, want %s with TXN_1", entry.NewStatus, entry.Metadata, shared.StatusPaymentSuccessful)
+	}
+}
+
+func TestGetOrderHistoryOfAnotherUser(t *testing.T) {
+	s, mock, _ := newTestService(t)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, user_id FROM orders")).
+		WithArgs(testOrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "user_id"}).AddRow(shared.StatusPaymentSuccessful, "user-1"))
+
+	// The history itself is never read
+	if _, err := s.GetOrderHistory(context.Background(), testOrderID, "user-2"); err != ErrOrderNotOwned {
+		t.Errorf("err = %v, want ErrOrderNotOwned", err)
+	}
+}
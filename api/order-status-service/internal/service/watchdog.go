@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/google/uuid"
+)
+
+// Watchdog actions, recorded as the event type of the order's status history
+const (
+	WatchdogRedrive = "WatchdogRedrive"
+	WatchdogCancel  = "WatchdogCancel"
+)
+
+// redriveEvents are the events that move an order on from the statuses the
+// watchdog looks after. Re-driving publishes the stored ones again.
+var redriveEvents = []string{
+	shared.EventOrderCreated,
+	shared.EventPaymentSuccessful,
+	shared.EventPaymentFailed,
+	shared.EventStockReserved,
+	shared.EventStockInsufficient,
+}
+
+// WatchdogActions counts the orders the watchdog re-drove and asked to
+// cancel, by the status they were stuck in. The counts come from the
+// actions recorded in the order status history, so they cover every
+// instance and survive restarts.
+func (s *OrderStatusService) WatchdogActions(ctx context.Context) (map[string]map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT event_type, old_status, COUNT(*)
+		FROM order_status_history
+		WHERE event_type IN ($1, $2)
+		GROUP BY event_type, old_status
+	`, WatchdogRedrive, WatchdogCancel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count watchdog actions: %v", err)
+	}
+	defer rows.Close()
+
+	actions := map[string]map[string]int64{
+		"redriven":  {},
+		"cancelled": {},
+	}
+	for rows.Next() {
+		var action, status string
+		var count int64
+		if err := rows.Scan(&action, &status, &count); err != nil {
+			return nil, err
+		}
+		if action == WatchdogCancel {
+			actions["cancelled"][status] = count
+		} else {
+			actions["redriven"][status] = count
+		}
+	}
+	return actions, rows.Err()
+}
+
+// stuckOrder is an order that stayed in its status past the status SLA
+type stuckOrder struct {
+	ID          string
+	UserID      string
+	TotalAmount float64
+	Status      string
+	Since       time.Time
+}
+
+// RunWatchdog looks for orders stuck in a status past its SLA until ctx is
+// cancelled
+func (s *OrderStatusService) RunWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(s.watchdog.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for status, sla := range s.watchdog.SLA {
+			if err := s.checkStuckOrders(ctx, status, sla); err != nil {
+				log.Printf("Watchdog check for %s orders failed: %v", status, err)
+			}
+		}
+	}
+}
+
+// checkStuckOrders handles one batch of orders stuck in status in a single
+// transaction. An order is re-driven at most once per SLA period; once it
+// has been stuck for the hard limit the orchestrator is asked, once, to
+// cancel it.
+func (s *OrderStatusService) checkStuckOrders(ctx context.Context, status string, sla time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	orders, err := s.lockStuckOrders(ctx, tx, status, now.Add(-sla), now.Add(-s.watchdog.HardLimit))
+	if err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		stuckFor := now.Sub(order.Since).Round(time.Second)
+		if stuckFor >= s.watchdog.HardLimit {
+			err = s.cancelStuckOrder(ctx, tx, order, stuckFor)
+		} else {
+			err = s.redriveStuckOrder(ctx, tx, order, stuckFor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// lockStuckOrders returns the orders in status since before stuckBefore
+// that were not re-driven since then, or that are in it since before
+// cancelBefore. Orders whose cancellation was already requested and orders
+// another instance is working on are skipped.
+func (s *OrderStatusService) lockStuckOrders(ctx context.Context, tx *sql.Tx, status string, stuckBefore, cancelBefore time.Time) ([]stuckOrder, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT o.id, o.user_id, o.total_amount, o.status, o.updated_at
+		FROM orders o
+		WHERE o.status = $1 AND o.updated_at < $2
+		  AND (o.updated_at < $3 OR NOT EXISTS (
+			SELECT 1 FROM order_status_history h
+			WHERE h.order_id = o.id AND h.event_type = $4 AND h.created_at >= $2
+		  ))
+		  AND NOT EXISTS (
+			SELECT 1 FROM order_status_history h
+			WHERE h.order_id = o.id AND h.event_type = $6
+		  )
+		ORDER BY o.updated_at
+		LIMIT $5
+		FOR UPDATE OF o SKIP LOCKED
+	`, status, stuckBefore, cancelBefore, WatchdogRedrive, s.watchdog.BatchSize, WatchdogCancel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find stuck %s orders: %v", status, err)
+	}
+	defer rows.Close()
+
+	var orders []stuckOrder
+	for rows.Next() {
+		var order stuckOrder
+		if err := rows.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.Since); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// redriveStuckOrder publishes the order's stored saga events again. The
+// services that missed one handle it; the others skip it in their inbox.
+func (s *OrderStatusService) redriveStuckOrder(ctx context.Context, tx *sql.Tx, order stuckOrder, stuckFor time.Duration) error {
+	requeued, err := s.outbox.Requeue(ctx, tx, order.ID, redriveEvents...)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Watchdog re-drove order %s stuck in %s for %s (%d events)", order.ID, order.Status, stuckFor, requeued)
+	return s.logStatusChange(ctx, tx, StatusChange{
+		OrderID:   order.ID,
+		OldStatus: order.Status,
+		NewStatus: order.Status,
+		EventType: WatchdogRedrive,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"stuck_for":       stuckFor.String(),
+			"requeued_events": requeued,
+		},
+	})
+}
+
+// cancelStuckOrder asks the orchestrator to cancel an order that stayed
+// stuck for the hard limit. The orchestrator compensates the saga and
+// publishes OrderCancelled, which changes the order's status like any other
+// cancellation.
+func (s *OrderStatusService) cancelStuckOrder(ctx context.Context, tx *sql.Tx, order stuckOrder, stuckFor time.Duration) error {
+	reason := fmt.Sprintf("stuck in %s for %s", order.Status, stuckFor)
+	now := time.Now()
+
+	metadata := map[string]interface{}{
+		"message":      reason,
+		"requested_by": "watchdog",
+		"stuck_status": order.Status,
+	}
+	err := s.outbox.Add(ctx, tx, shared.OrderEvent{
+		EventID:       uuid.New().String(),
+		CorrelationID: order.ID,
+		EventType:     shared.EventOrderCancellationRequested,
+		OrderID:       order.ID,
+		UserID:        order.UserID,
+		TotalAmount:   order.TotalAmount,
+		Status:        order.Status,
+		Timestamp:     now,
+		Metadata:      metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Watchdog asked to cancel order %s: %s", order.ID, reason)
+	return s.logStatusChange(ctx, tx, StatusChange{
+		OrderID:   order.ID,
+		OldStatus: order.Status,
+		NewStatus: order.Status,
+		EventType: WatchdogCancel,
+		Timestamp: now,
+		Metadata:  metadata,
+	})
+}
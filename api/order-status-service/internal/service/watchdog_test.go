@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/order-status-service/internal/config"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	testSLA       = 2 * time.Minute
+	testHardLimit = 30 * time.Minute
+)
+
+// requeueOutbox is a memory outbox that records the orders it requeues
+type requeueOutbox struct {
+	*shared.MemoryOutbox
+	requeued []string
+}
+
+func (o *requeueOutbox) Requeue(ctx context.Context, exec shared.Execer, orderID string, eventTypes ...string) (int64, error) {
+	o.requeued = append(o.requeued, orderID)
+	return int64(len(eventTypes)), nil
+}
+
+// ago matches a time about d before the check
+type ago time.Duration
+
+func (d ago) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	if !ok {
+		return false
+	}
+	diff := time.Since(t) - time.Duration(d)
+	return diff >= 0 && diff < time.Minute
+}
+
+func newTestService(t *testing.T) (*OrderStatusService, sqlmock.Sqlmock, *requeueOutbox) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	outbox := &requeueOutbox{MemoryOutbox: shared.NewMemoryOutbox("order-status")}
+	s := New(db, outbox, &config.OrderStatusConfig{}, &config.WatchdogConfig{
+		SLA:       map[string]time.Duration{shared.StatusPaymentSuccessful: testSLA},
+		HardLimit: testHardLimit,
+		BatchSize: 10,
+	})
+	return s, mock, outbox
+}
+
+// expectStuckOrders expects the orders stuck in PAYMENT_SUCCESSFUL past the
+// SLA to be locked, returning one stuck for each of stuckFor
+func expectStuckOrders(mock sqlmock.Sqlmock, stuckFor ...time.Duration) {
+	rows := sqlmock.NewRows([]string{"id", "user_id", "total_amount", "status", "updated_at"})
+	for i, d := range stuckFor {
+		rows.AddRow(fmt.Sprint("order-", i+1), "user-1", 25.0, shared.StatusPaymentSuccessful, time.Now().Add(-d))
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE OF o SKIP LOCKED")).
+		WithArgs(shared.StatusPaymentSuccessful, ago(testSLA), ago(testHardLimit), WatchdogRedrive, 10, WatchdogCancel).
+		WillReturnRows(rows)
+}
+
+// expectWatchdogAction expects action to be recorded in the order's status
+// history
+func expectWatchdogAction(mock sqlmock.Sqlmock, orderID, action string) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO order_status_history")).
+		WithArgs(sqlmock.AnyArg(), orderID, shared.StatusPaymentSuccessful, shared.StatusPaymentSuccessful, action,
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestWatchdogRedrivesStuckOrder(t *testing.T) {
+	s, mock, outbox := newTestService(t)
+
+	expectStuckOrders(mock, 5*time.Minute)
+	expectWatchdogAction(mock, "order-1", WatchdogRedrive)
+	mock.ExpectCommit()
+
+	if err := s.checkStuckOrders(context.Background(), shared.StatusPaymentSuccessful, testSLA); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(outbox.requeued); got != "[order-1]" {
+		t.Errorf("requeued %s, want [order-1]", got)
+	}
+	if events := outbox.Events(); len(events) != 0 {
+		t.Errorf("emitted %d events, want none", len(events))
+	}
+}
+
+func TestWatchdogCancelsOrderPastHardLimit(t *testing.T) {
+	s, mock, outbox := newTestService(t)
+
+	expectStuckOrders(mock, time.Hour)
+	expectWatchdogAction(mock, "order-1", WatchdogCancel)
+	mock.ExpectCommit()
+
+	if err := s.checkStuckOrders(context.Background(), shared.StatusPaymentSuccessful, testSLA); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.requeued) != 0 {
+		t.Errorf("requeued %v, want nothing", outbox.requeued)
+	}
+	events := outbox.Events()
+	if len(events) != 1 || events[0].EventType != shared.EventOrderCancellationRequested {
+		t.Fatalf("emitted %v, want one %s", events, shared.EventOrderCancellationRequested)
+	}
+	if events[0].OrderID != "order-1" || events[0].Metadata["requested_by"] != "watchdog" {
+		t.Errorf("cancellation of %s requested by %v, want order-1 by the watchdog", events[0].OrderID, events[0].Metadata["requested_by"])
+	}
+}
+
+func TestWatchdogLeavesHealthyOrderAlone(t *testing.T) {
+	s, mock, outbox := newTestService(t)
+
+	// Orders within the SLA are not selected, so the batch is empty
+	expectStuckOrders(mock)
+	mock.ExpectCommit()
+
+	if err := s.checkStuckOrders(context.Background(), shared.StatusPaymentSuccessful, testSLA); err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox.requeued) != 0 || len(outbox.Events()) != 0 {
+		t.Errorf("requeued %v and emitted %v, want nothing", outbox.requeued, outbox.Events())
+	}
+}
@@ -0,0 +1,136 @@
+// Command mockprovider serves the payment simulator over the JSON API the
+// HTTP provider adapter speaks, so the adapter can be run against a local
+// provider. A share of the requests can be failed with 503s to exercise the
+// adapter's retries.
+//
+// Example:
+//
+//	go run ./payment-processing-service/cmd/mockprovider -addr :8090 -unavailable-rate 0.2
+//	PAYMENT_PROVIDER=http PAYMENT_PROVIDER_URL=http://localhost:8090 go run ./payment-processing-service/cmd
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"math/rand"
+	"net/http"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/provider"
+
+	"github.com/gin-gonic/gin"
+)
+
+type amountRequest struct {
+	Amount float64 `json:"amount"`
+}
+
+type authorizeRequest struct {
+	OrderID  string  `json:"order_id"`
+	UserID   string  `json:"user_id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+func main() {
+	addr := flag.String("addr", ":8090", "address to listen on")
+	successRate := flag.Float64("success-rate", 0.9, "share of authorizations approved")
+	delayMS := flag.Int("delay-ms", 500, "authorization delay in milliseconds")
+	unavailableRate := flag.Float64("unavailable-rate", 0, "share of requests answered with 503")
+	flag.Parse()
+
+	simulator := provider.NewSimulator(*successRate, *delayMS)
+
+	r := gin.Default()
+	r.Use(func(c *gin.Context) {
+		if rand.Float64() < *unavailableRate {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody("service_unavailable", "Injected failure"))
+		}
+	})
+
+	r.POST("/payments", func(c *gin.Context) {
+		var req authorizeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody("invalid_request", err.Error()))
+			return
+		}
+		respond(c, func(ctx context.Context) (*provider.Transaction, error) {
+			return simulator.Authorize(ctx, provider.AuthorizeRequest{
+				OrderID:        req.OrderID,
+				UserID:         req.UserID,
+				Amount:         req.Amount,
+				Currency:       req.Currency,
+				IdempotencyKey: c.GetHeader("Idempotency-Key"),
+			})
+		})
+	})
+	r.POST("/payments/:id/capture", func(c *gin.Context) {
+		var req amountRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody("invalid_request", err.Error()))
+			return
+		}
+		respond(c, func(ctx context.Context) (*provider.Transaction, error) {
+			return simulator.Capture(ctx, c.Param("id"), req.Amount, c.GetHeader("Idempotency-Key"))
+		})
+	})
+	r.POST("/payments/:id/void", func(c *gin.Context) {
+		respond(c, func(ctx context.Context) (*provider.Transaction, error) {
+			return simulator.Void(ctx, c.Param("id"), c.GetHeader("Idempotency-Key"))
+		})
+	})
+	r.POST("/payments/:id/refund", func(c *gin.Context) {
+		var req amountRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody("invalid_request", err.Error()))
+			return
+		}
+		respond(c, func(ctx context.Context) (*provider.Transaction, error) {
+			return simulator.Refund(ctx, c.Param("id"), req.Amount, c.GetHeader("Idempotency-Key"))
+		})
+	})
+	r.GET("/payments/:id", func(c *gin.Context) {
+		respond(c, func(ctx context.Context) (*provider.Transaction, error) {
+			return simulator.Status(ctx, c.Param("id"))
+		})
+	})
+
+	log.Printf("Mock payment provider listening on %s", *addr)
+	if err := r.Run(*addr); err != nil {
+		log.Fatal("Failed to run mock payment provider:", err)
+	}
+}
+
+// respond writes the transaction, or the simulator's error with the status
+// the adapter maps back to it
+func respond(c *gin.Context, call func(ctx context.Context) (*provider.Transaction, error)) {
+	transaction, err := call(c.Request.Context())
+	if err == nil {
+		c.JSON(http.StatusOK, transaction)
+		return
+	}
+
+	code, message := "", err.Error()
+	var providerErr *provider.Error
+	if errors.As(err, &providerErr) {
+		code, message = providerErr.Code, providerErr.Message
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, provider.ErrDeclined):
+		status = http.StatusPaymentRequired
+	case errors.Is(err, provider.ErrInvalidRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, provider.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, provider.ErrUnavailable):
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, errorBody(code, message))
+}
+
+func errorBody(code, message string) gin.H {
+	return gin.H{"error": gin.H{"code": code, "message": message}}
+}
@@ -1,17 +1,31 @@
 package app
 
 import (
+	"context"
+	"database/sql"
 	"log"
+	"net/http"
 
 	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+	"go-rabbitmq-order-system/payment-processing-service/internal/handler"
+	"go-rabbitmq-order-system/payment-processing-service/internal/provider"
 	"go-rabbitmq-order-system/payment-processing-service/internal/service"
+	"go-rabbitmq-order-system/pkg/middleware"
+	"go-rabbitmq-order-system/pkg/server"
+	"go-rabbitmq-order-system/pkg/tracing"
 	"go-rabbitmq-order-system/shared"
+
+	"github.com/gin-gonic/gin"
 )
 
+// serviceName identifies this service as the producer of its events
+const serviceName = "payment-processing"
+
 type App struct {
 	config   *config.Config
 	database *shared.Database
-	rabbitMQ *shared.RabbitMQ
+	broker   shared.Broker
+	service  *service.PaymentService
 }
 
 func New(cfg *config.Config) *App {
@@ -20,7 +34,14 @@ func New(cfg *config.Config) *App {
 	}
 }
 
-func (a *App) Run() error {
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, serviceName, a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.ShutdownTimeout)
+
 	// Initialize database
 	db, err := shared.NewDatabase(a.config.Database.URL)
 	if err != nil {
@@ -29,34 +50,109 @@ func (a *App) Run() error {
 	a.database = db
 
 	// Initialize RabbitMQ
-	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL)
+	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL,
+		shared.WithRetryPolicy(shared.RetryPolicy{
+			MaxAttempts:  a.config.RabbitMQ.RetryAttempts,
+			InitialDelay: a.config.RabbitMQ.RetryDelay,
+			MaxDelay:     a.config.RabbitMQ.MaxRetryDelay,
+		}),
+		shared.WithReconnectBackoff(a.config.RabbitMQ.ReconnectDelay, a.config.RabbitMQ.MaxReconnectDelay),
+		shared.WithPublishWait(a.config.RabbitMQ.PublishWait),
+		shared.WithPublishTimeout(a.config.RabbitMQ.PublishTimeout),
+		shared.WithPrefetch(a.config.Consumer.Prefetch),
+		shared.WithWorkers(a.config.Consumer.Workers, a.config.Consumer.OrderByOrderID),
+		shared.WithProducer(serviceName),
+		shared.WithEventStore(shared.NewEventStore(db.DB)),
+		shared.WithInbox(shared.NewInbox(db.DB, serviceName)),
+		shared.WithStateHook(shared.LogConnectionState(serviceName)),
+	)
 	if err != nil {
 		return err
 	}
-	a.rabbitMQ = rabbitmq
-
-	// Initialize service
-	paymentService := service.New(db.DB, rabbitmq, &a.config.PaymentGateway)
+	a.broker = rabbitmq
 
-	// Start consuming events
-	err = rabbitmq.ConsumeEvents("payment_queue", paymentService.HandleOrderEvent)
-	if err != nil {
+	outbox := shared.NewOutbox(db.DB, serviceName, a.config.Outbox.PollInterval)
+	if err := a.Start(ctx, db.DB, rabbitmq, outbox); err != nil {
 		return err
 	}
 
 	log.Println("Payment Processing Service started")
 	log.Println("Waiting for order events...")
 
-	// Keep the service running
-	select {}
+	// Serve the refund API until a shutdown signal cancels the context
+	srv := &http.Server{
+		Addr:    ":" + a.config.Port,
+		Handler: a.router(handler.New(a.service, rabbitmq.State)),
+	}
+	log.Printf("Payment Processing Service listening on port %s", a.config.Port)
+	err = server.Run(ctx, srv, a.config.ShutdownTimeout)
+
+	log.Println("Shutting down Payment Processing Service")
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (a *App) router(h *handler.Handler) http.Handler {
+	r := gin.Default()
+	r.Use(middleware.RequestID())
+	r.Use(tracing.Middleware())
+	r.Use(middleware.Recovery(serviceName))
+
+	r.GET("/health", h.Health)
+
+	// API routes
+	api := r.Group("/api/v1")
+	{
+		api.POST("/orders/:id/refunds", h.RefundOrder)
+		api.GET("/orders/:id/payments", h.GetOrderPayments)
+	}
+
+	return r
 }
 
+// Start sets up the service's queue on the broker, starts relaying the outbox
+// and consumes events until ctx ends. It does not block.
+func (a *App) Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	// Setup exchange and this service's queue bindings
+	if err := broker.SetupExchange(); err != nil {
+		return err
+	}
+	if err := broker.SetupQueue(shared.PaymentQueue); err != nil {
+		return err
+	}
+
+	// Start publishing stored events
+	go outbox.Relay(ctx, broker)
+
+	// Initialize service with the configured payment provider
+	paymentProvider, err := provider.New(&a.config.PaymentGateway)
+	if err != nil {
+		return err
+	}
+	log.Printf("Using %s payment provider, capturing on %s", a.config.PaymentGateway.Provider, a.config.PaymentGateway.CaptureEvent)
+	paymentService := service.New(db, outbox, paymentProvider, &a.config.PaymentGateway)
+	a.service = paymentService
+
+	// Expire authorizations that were never captured
+	go paymentService.RunAuthorizationExpiry(ctx)
+
+	// Start consuming events
+	return broker.ConsumePreparedEvents(ctx, shared.PaymentQueue, paymentService.PrepareOrderEvent, paymentService.HandleOrderEvent)
+}
+
+// Close waits for in-flight events to be handled, up to the shutdown
+// timeout, and then closes the broker and database connections
 func (a *App) Close() error {
+	var err error
+	if a.broker != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
+		defer cancel()
+		err = a.broker.Shutdown(ctx)
+	}
 	if a.database != nil {
 		a.database.Close()
 	}
-	if a.rabbitMQ != nil {
-		a.rabbitMQ.Close()
-	}
-	return nil
+	return err
 } 
\ No newline at end of file
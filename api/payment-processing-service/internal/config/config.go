@@ -1,27 +1,123 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
 	"go-rabbitmq-order-system/pkg/config"
+	"go-rabbitmq-order-system/shared"
+)
+
+// Payment providers
+const (
+	ProviderSimulator = "simulator"
+	ProviderHTTP      = "http"
 )
 
 type Config struct {
 	*config.BaseConfig
+	Port           string
 	PaymentGateway PaymentGatewayConfig
 }
 
+// PaymentGatewayConfig selects the payment provider and configures it.
+// Payments are authorized when the order is created and captured on
+// CaptureEvent, either OrderShipped or OrderReadyForShipping. An
+// authorization not captured within AuthorizationTTL expires.
 type PaymentGatewayConfig struct {
-	SuccessRate      float64
+	Provider string // simulator or http
+	Currency string
+
+	CaptureEvent        string
+	AuthorizationTTL    time.Duration
+	ExpiryCheckInterval time.Duration
+	ExpiryBatchSize     int
+
+	// Simulator
+	SuccessRate       float64
 	ProcessingDelayMS int
+
+	HTTP HTTPProviderConfig
 }
 
-func Load() *Config {
+// HTTPProviderConfig configures the HTTP/JSON provider adapter. Requests
+// that fail on the network or with a retryable provider error are retried
+// up to MaxRetries times, with the delay doubling after each attempt.
+type HTTPProviderConfig struct {
+	URL        string
+	APIKey     string
+	Timeout    time.Duration
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+// Load reads the configuration from the environment. It fails if the
+// capture event is not one payments can be captured on.
+func Load() (*Config, error) {
 	baseConfig := config.LoadBaseConfig()
-	
-	return &Config{
+
+	cfg := &Config{
 		BaseConfig: baseConfig,
+		Port:       getEnv("PORT", "8082"),
 		PaymentGateway: PaymentGatewayConfig{
-			SuccessRate:      0.9, // 90% success rate
-			ProcessingDelayMS: 2000, // 2 seconds
+			Provider:            getEnv("PAYMENT_PROVIDER", ProviderSimulator),
+			Currency:            getEnv("PAYMENT_CURRENCY", "USD"),
+			CaptureEvent:        getEnv("PAYMENT_CAPTURE_EVENT", shared.EventOrderShipped),
+			AuthorizationTTL:    getEnvAsDuration("PAYMENT_AUTHORIZATION_TTL", "168h"),
+			ExpiryCheckInterval: getEnvAsDuration("PAYMENT_EXPIRY_CHECK_INTERVAL", "1m"),
+			ExpiryBatchSize:     100,                                                  // Expire at most 100 authorizations per check
+			SuccessRate:         getEnvAsFloat("PAYMENT_SIMULATOR_SUCCESS_RATE", 0.9), // 90% success rate
+			ProcessingDelayMS:   getEnvAsInt("PAYMENT_SIMULATOR_DELAY_MS", 2000),      // 2 seconds
+			HTTP: HTTPProviderConfig{
+				URL:        getEnv("PAYMENT_PROVIDER_URL", "http://localhost:8090"),
+				APIKey:     getEnv("PAYMENT_PROVIDER_API_KEY", ""),
+				Timeout:    getEnvAsDuration("PAYMENT_PROVIDER_TIMEOUT", "10s"),
+				MaxRetries: getEnvAsInt("PAYMENT_PROVIDER_MAX_RETRIES", 3),
+				RetryDelay: getEnvAsDuration("PAYMENT_PROVIDER_RETRY_DELAY", "200ms"),
+			},
 		},
 	}
-} 
\ No newline at end of file
+
+	captureEvent := cfg.PaymentGateway.CaptureEvent
+	if captureEvent != shared.EventOrderShipped && captureEvent != shared.EventOrderReadyForShipping {
+		return nil, fmt.Errorf("PAYMENT_CAPTURE_EVENT must be %s or %s, not %s",
+			shared.EventOrderShipped, shared.EventOrderReadyForShipping, captureEvent)
+	}
+	return cfg, nil
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue string) time.Duration {
+	value := getEnv(key, defaultValue)
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	duration, _ := time.ParseDuration(defaultValue)
+	return duration
+}
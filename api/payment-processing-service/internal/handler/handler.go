@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/service"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	service     *service.PaymentService
+	brokerState func() shared.ConnectionState
+}
+
+func New(svc *service.PaymentService, brokerState func() shared.ConnectionState) *Handler {
+	return &Handler{
+		service:     svc,
+		brokerState: brokerState,
+	}
+}
+
+func (h *Handler) Health(c *gin.Context) {
+	status := "healthy"
+	brokerState := h.brokerState()
+	if brokerState != shared.StateConnected {
+		status = "degraded"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   status,
+		"service":  "payment-processing",
+		"rabbitmq": brokerState,
+	})
+}
+
+// RefundOrder refunds part or all of an order's captured payment. A request
+// repeating an Idempotency-Key returns the refund made for it, or the
+// failure the first request met.
+func (h *Handler) RefundOrder(c *gin.Context) {
+	var req service.RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.RequestID = c.GetHeader("Idempotency-Key")
+
+	entry, repeated, err := h.service.Refund(c.Request.Context(), c.Param("id"), req)
+	switch {
+	case err == nil && repeated:
+		c.JSON(http.StatusOK, entry)
+	case err == nil:
+		c.JSON(http.StatusCreated, entry)
+	case errors.Is(err, service.ErrPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+	case errors.Is(err, service.ErrInvalidRefund):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrNothingToRefund), errors.Is(err, service.ErrRefundExceedsCaptured):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "refund": entry})
+	case errors.Is(err, service.ErrRefundRejected):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "refund": entry})
+	case errors.Is(err, service.ErrProviderUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider unavailable, retry with the same Idempotency-Key"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
+	}
+}
+
+// GetOrderPayments returns an order's payment balance and ledger
+func (h *Handler) GetOrderPayments(c *gin.Context) {
+	balance, err := h.service.GetOrderBalance(c.Request.Context(), c.Param("id"))
+	if err == service.ErrPaymentNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get order payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, balance)
+}
@@ -0,0 +1,219 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+	"go-rabbitmq-order-system/pkg/tracing"
+)
+
+// maxResponseSize bounds how much of a provider response is read
+const maxResponseSize = 1 << 20
+
+// errorCodes maps the error codes a provider answers with to the errors
+// the service acts on. Unknown codes are mapped by HTTP status instead.
+// Declines are recognised by their 402 status alone; a decline code on
+// another status is treated like any unknown code.
+var errorCodes = map[string]error{
+	"invalid_request":     ErrInvalidRequest,
+	"invalid_amount":      ErrInvalidRequest,
+	"invalid_state":       ErrInvalidRequest,
+	"amount_too_large":    ErrInvalidRequest,
+	"not_found":           ErrNotFound,
+	"rate_limited":        ErrUnavailable,
+	"processing_error":    ErrUnavailable,
+	"service_unavailable": ErrUnavailable,
+}
+
+// HTTP is an adapter for a provider with a JSON API:
+//
+//	POST /payments              authorize
+//	POST /payments/{id}/capture capture
+//	POST /payments/{id}/void    void
+//	POST /payments/{id}/refund  refund
+//	GET  /payments/{id}         status
+//
+// Successful responses carry the transaction, failures an error object
+// {"error": {"code": "...", "message": "..."}}. Requests are sent with the
+// idempotency key in the Idempotency-Key header, so retrying them after a
+// network error or a retryable provider error is safe.
+type HTTP struct {
+	baseURL    string
+	apiKey     string
+	client     *http.Client
+	maxRetries int
+	retryDelay time.Duration
+}
+
+type amountRequest struct {
+	Amount float64 `json:"amount"`
+}
+
+type authorizeRequest struct {
+	OrderID  string  `json:"order_id"`
+	UserID   string  `json:"user_id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewHTTP(cfg config.HTTPProviderConfig) (*HTTP, error) {
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid payment provider URL %q: %v", cfg.URL, err)
+	}
+
+	return &HTTP{
+		baseURL: strings.TrimRight(cfg.URL, "/"),
+		apiKey:  cfg.APIKey,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: tracing.Transport(nil),
+		},
+		maxRetries: cfg.MaxRetries,
+		retryDelay: cfg.RetryDelay,
+	}, nil
+}
+
+func (p *HTTP) Authorize(ctx context.Context, req AuthorizeRequest) (*Transaction, error) {
+	return p.do(ctx, http.MethodPost, "/payments", req.IdempotencyKey, authorizeRequest{
+		OrderID:  req.OrderID,
+		UserID:   req.UserID,
+		Amount:   req.Amount,
+		Currency: req.Currency,
+	})
+}
+
+func (p *HTTP) Capture(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*Transaction, error) {
+	return p.do(ctx, http.MethodPost, "/payments/"+url.PathEscape(transactionID)+"/capture", idempotencyKey, amountRequest{Amount: amount})
+}
+
+func (p *HTTP) Void(ctx context.Context, transactionID string, idempotencyKey string) (*Transaction, error) {
+	return p.do(ctx, http.MethodPost, "/payments/"+url.PathEscape(transactionID)+"/void", idempotencyKey, struct{}{})
+}
+
+func (p *HTTP) Refund(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*Transaction, error) {
+	return p.do(ctx, http.MethodPost, "/payments/"+url.PathEscape(transactionID)+"/refund", idempotencyKey, amountRequest{Amount: amount})
+}
+
+func (p *HTTP) Status(ctx context.Context, transactionID string) (*Transaction, error) {
+	return p.do(ctx, http.MethodGet, "/payments/"+url.PathEscape(transactionID), "", nil)
+}
+
+// do sends a request, retrying it while the provider is unavailable
+func (p *HTTP) do(ctx context.Context, method, path, idempotencyKey string, body interface{}) (*Transaction, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to marshal payment request: %v", err)
+		}
+	}
+
+	delay := p.retryDelay
+	for attempt := 0; ; attempt++ {
+		transaction, err := p.send(ctx, method, path, idempotencyKey, payload)
+		if err == nil || !errors.Is(err, ErrUnavailable) || attempt >= p.maxRetries {
+			return transaction, err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// send makes a single request and maps a failure to the provider errors
+func (p *HTTP) send(ctx context.Context, method, path, idempotencyKey string, payload []byte) (*Transaction, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payment request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, &Error{Message: err.Error(), Err: ErrUnavailable}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, &Error{Message: fmt.Sprintf("failed to read response: %v", err), Err: ErrUnavailable}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, responseError(resp.StatusCode, data)
+	}
+
+	var transaction Transaction
+	if err := json.Unmarshal(data, &transaction); err != nil {
+		return nil, fmt.Errorf("invalid payment provider response: %v", err)
+	}
+	return &transaction, nil
+}
+
+// responseError maps an error response. Statuses that say nothing about the
+// payment, refused credentials and temporary failures, and the 402 of a
+// decline are mapped by status; other responses by their code, or by their
+// status when the code is unknown.
+func responseError(status int, data []byte) *Error {
+	var resp errorResponse
+	json.Unmarshal(data, &resp)
+
+	e := &Error{Code: resp.Error.Code, Message: resp.Error.Message}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+
+	switch {
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		e.Err = ErrUnauthorized
+		return e
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests, status >= 500:
+		e.Err = ErrUnavailable
+		return e
+	case status == http.StatusPaymentRequired:
+		e.Err = ErrDeclined
+		return e
+	}
+
+	if err, ok := errorCodes[e.Code]; ok {
+		e.Err = err
+	} else if status == http.StatusNotFound {
+		e.Err = ErrNotFound
+	} else {
+		e.Err = ErrInvalidRequest
+	}
+	return e
+}
@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+)
+
+// newTestHTTP returns an adapter for a provider served by handler
+func newTestHTTP(t *testing.T, handler http.HandlerFunc, timeout time.Duration, maxRetries int) *HTTP {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	p, err := NewHTTP(config.HTTPProviderConfig{
+		URL:        server.URL,
+		APIKey:     "test-key",
+		Timeout:    timeout,
+		MaxRetries: maxRetries,
+		RetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHTTPSendsRequest(t *testing.T) {
+	p := newTestHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/payments/TXN_1/capture" {
+			t.Errorf("request = %s %s, want POST /payments/TXN_1/capture", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Idempotency-Key"); got != "event-1" {
+			t.Errorf("Idempotency-Key = %q, want event-1", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Authorization = %q, want Bearer test-key", got)
+		}
+		w.Write([]byte(`{"id": "TXN_1", "status": "CAPTURED", "amount": 25}`))
+	}, time.Second, 0)
+
+	transaction, err := p.Capture(context.Background(), "TXN_1", 25, "event-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.ID != "TXN_1" || transaction.Status != StatusCaptured || transaction.Amount != 25 {
+		t.Errorf("transaction = %+v, want TXN_1 CAPTURED 25", transaction)
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	var requests int32
+	p := newTestHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+	}, 10*time.Millisecond, 1)
+
+	_, err := p.Void(context.Background(), "TXN_1", "event-1")
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("err = %v, want ErrUnavailable", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		want     error
+		requests int32
+	}{
+		{"unavailable until the last retry", http.StatusServiceUnavailable, `{}`, nil, 3},
+		{"rate limited until the last retry", http.StatusTooManyRequests, `{"error": {"code": "rate_limited"}}`, nil, 3},
+		{"declined", http.StatusPaymentRequired, `{"error": {"code": "card_declined"}}`, ErrDeclined, 1},
+		{"invalid", http.StatusBadRequest, `{"error": {"code": "invalid_amount"}}`, ErrInvalidRequest, 1},
+		{"credentials refused", http.StatusUnauthorized, ``, ErrUnauthorized, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The provider fails twice, then succeeds
+			var requests int32
+			p := newTestHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= 2 || tt.want != nil {
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.body))
+					return
+				}
+				w.Write([]byte(`{"id": "TXN_1", "status": "REFUNDED"}`))
+			}, time.Second, 2)
+
+			_, err := p.Refund(context.Background(), "TXN_1", 25, "event-1")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.requests {
+				t.Errorf("sent %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestHTTPGivesUpRetrying(t *testing.T) {
+	var requests int32
+	p := newTestHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}, time.Second, 2)
+
+	_, err := p.Authorize(context.Background(), AuthorizeRequest{OrderID: "order-1", Amount: 25, IdempotencyKey: "event-1"})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("err = %v, want ErrUnavailable", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("sent %d requests, want 3", got)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		want    error
+		code    string
+		message string
+	}{
+		// Only a 402 declines, whatever the code
+		{http.StatusPaymentRequired, `{"error": {"code": "insufficient_funds", "message": "Insufficient funds"}}`,
+			ErrDeclined, "insufficient_funds", "Insufficient funds"},
+		{http.StatusPaymentRequired, `{"error": {"code": "do_not_honor"}}`, ErrDeclined, "do_not_honor", "Payment Required"},
+		{http.StatusBadRequest, `{"error": {"code": "card_declined"}}`, ErrInvalidRequest, "card_declined", "Bad Request"},
+
+		// Refused credentials and temporary failures are never declines
+		{http.StatusUnauthorized, `{"error": {"code": "card_declined"}}`, ErrUnauthorized, "card_declined", "Unauthorized"},
+		{http.StatusForbidden, ``, ErrUnauthorized, "", "Forbidden"},
+		{http.StatusRequestTimeout, `{"error": {"code": "invalid_request"}}`, ErrUnavailable, "invalid_request", "Request Timeout"},
+		{http.StatusTooManyRequests, `not json`, ErrUnavailable, "", "Too Many Requests"},
+		{http.StatusInternalServerError, ``, ErrUnavailable, "", "Internal Server Error"},
+
+		// Known codes win over other statuses
+		{http.StatusBadRequest, `{"error": {"code": "processing_error"}}`, ErrUnavailable, "processing_error", "Bad Request"},
+		{http.StatusConflict, `{"error": {"code": "invalid_state"}}`, ErrInvalidRequest, "invalid_state", "Conflict"},
+		{http.StatusBadRequest, `{"error": {"code": "not_found"}}`, ErrNotFound, "not_found", "Bad Request"},
+
+		// Unknown codes and bodies are mapped by status
+		{http.StatusNotFound, ``, ErrNotFound, "", "Not Found"},
+		{http.StatusUnprocessableEntity, `{"error": {"message": "amount is negative"}}`,
+			ErrInvalidRequest, "", "amount is negative"},
+	}
+
+	for _, tt := range tests {
+		err := responseError(tt.status, []byte(tt.body))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%d %s: err = %v, want %v", tt.status, tt.body, err, tt.want)
+		}
+		if err.Code != tt.code || err.Message != tt.message {
+			t.Errorf("%d %s: code, message = %q, %q; want %q, %q", tt.status, tt.body, err.Code, err.Message, tt.code, tt.message)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Package provider abstracts the payment provider that moves the money.
+// The payment service only talks to a PaymentProvider; which one it gets is
+// chosen by configuration.
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+)
+
+// Errors a provider's failures map to. Callers check them with errors.Is.
+var (
+	// ErrDeclined means the provider refused the payment, e.g. for
+	// insufficient funds. Retrying does not help.
+	ErrDeclined = errors.New("payment declined")
+	// ErrInvalidRequest means the provider rejected the request itself
+	ErrInvalidRequest = errors.New("invalid payment request")
+	// ErrNotFound means the provider does not know the transaction
+	ErrNotFound = errors.New("payment transaction not found")
+	// ErrUnavailable means the provider could not be reached or failed
+	// temporarily. The operation may be retried with the same idempotency
+	// key.
+	ErrUnavailable = errors.New("payment provider unavailable")
+	// ErrUnauthorized means the provider refused the service's credentials.
+	// It is a configuration error, not a verdict on the payment; the
+	// operation may be retried once the credentials are fixed.
+	ErrUnauthorized = errors.New("payment provider refused the credentials")
+)
+
+// Error is a failure reported by a provider, keeping its own error code
+// next to the error it maps to
+type Error struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%v: %s", e.Err, e.Message)
+	}
+	return fmt.Sprintf("%v: %s (%s)", e.Err, e.Message, e.Code)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Status of a transaction at the provider
+type Status string
+
+const (
+	StatusAuthorized Status = "AUTHORIZED"
+	StatusCaptured   Status = "CAPTURED"
+	StatusRefunded   Status = "REFUNDED"
+	StatusVoided     Status = "VOIDED"
+	StatusDeclined   Status = "DECLINED"
+)
+
+// Transaction is the provider's view of a payment
+type Transaction struct {
+	ID       string  `json:"id"`
+	Status   Status  `json:"status"`
+	Amount   float64 `json:"amount"`
+	Refunded float64 `json:"refunded_amount"`
+	Currency string  `json:"currency"`
+	Method   string  `json:"payment_method"`
+	Message  string  `json:"message"`
+}
+
+// AuthorizeRequest reserves an amount on the customer's payment method
+type AuthorizeRequest struct {
+	OrderID  string
+	UserID   string
+	Amount   float64
+	Currency string
+	// IdempotencyKey makes a repeated request return the first result
+	// instead of authorizing again
+	IdempotencyKey string
+}
+
+// PaymentProvider moves the money for orders. A declined payment is
+// returned as an error wrapping ErrDeclined. Every operation taking an
+// idempotency key may be repeated safely with the same key.
+type PaymentProvider interface {
+	// Authorize reserves the amount without taking it
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Transaction, error)
+	// Capture takes amount of an authorized transaction
+	Capture(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*Transaction, error)
+	// Void releases an authorization that was not captured
+	Void(ctx context.Context, transactionID string, idempotencyKey string) (*Transaction, error)
+	// Refund returns amount of a captured transaction to the customer
+	Refund(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*Transaction, error)
+	// Status returns the transaction as the provider currently sees it
+	Status(ctx context.Context, transactionID string) (*Transaction, error)
+}
+
+// New returns the provider selected by cfg.Provider
+func New(cfg *config.PaymentGatewayConfig) (PaymentProvider, error) {
+	switch cfg.Provider {
+	case config.ProviderSimulator:
+		return NewSimulator(cfg.SuccessRate, cfg.ProcessingDelayMS), nil
+	case config.ProviderHTTP:
+		return NewHTTP(cfg.HTTP)
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", cfg.Provider)
+	}
+}
@@ -0,0 +1,229 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// simulatedDeclines are the codes and messages of the declines the
+// simulator makes up
+var simulatedDeclines = []struct{ code, message string }{
+	{"insufficient_funds", "Insufficient funds"},
+	{"expired_card", "Card expired"},
+	{"card_declined", "Payment declined by bank"},
+	{"issuer_unavailable", "Network timeout"},
+	{"invalid_payment_details", "Invalid payment details"},
+}
+
+var simulatedMethods = []string{"credit_card", "debit_card", "bank_transfer", "digital_wallet"}
+
+// The simulator answers a repeated idempotency key with the first result
+// for resultTTL, and keeps at most maxResults, forgetting the oldest first
+const (
+	resultTTL  = 24 * time.Hour
+	maxResults = 10000
+)
+
+// Simulator is an in-memory provider that approves a share of the
+// authorizations at random, after a fixed processing delay; captures and
+// refunds are immediate. It forgets its transactions on restart, so it
+// accepts captures and refunds of transactions it does not know.
+type Simulator struct {
+	successRate float64
+	delay       time.Duration
+
+	mu           sync.Mutex
+	transactions map[string]*Transaction
+	results      map[string]simulatedResult // by idempotency key
+	keys         []string                   // of results, oldest first
+	resultTTL    time.Duration
+	maxResults   int
+}
+
+type simulatedResult struct {
+	transaction Transaction
+	err         error
+	storedAt    time.Time
+}
+
+func NewSimulator(successRate float64, processingDelayMS int) *Simulator {
+	return &Simulator{
+		successRate:  successRate,
+		delay:        time.Duration(processingDelayMS) * time.Millisecond,
+		transactions: make(map[string]*Transaction),
+		results:      make(map[string]simulatedResult),
+		resultTTL:    resultTTL,
+		maxResults:   maxResults,
+	}
+}
+
+func (s *Simulator) Authorize(ctx context.Context, req AuthorizeRequest) (*Transaction, error) {
+	if err := s.process(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result, ok := s.result(req.IdempotencyKey); ok {
+		return result.get()
+	}
+
+	transaction := Transaction{
+		ID:       "TXN_" + uuid.New().String()[:8],
+		Amount:   req.Amount,
+		Currency: req.Currency,
+		Method:   simulatedMethods[rand.Intn(len(simulatedMethods))],
+	}
+
+	var err error
+	if rand.Float64() < s.successRate {
+		transaction.Status = StatusAuthorized
+		transaction.Message = "Payment authorized"
+		s.transactions[transaction.ID] = &transaction
+	} else {
+		decline := simulatedDeclines[rand.Intn(len(simulatedDeclines))]
+		transaction.Status = StatusDeclined
+		transaction.Message = decline.message
+		err = &Error{Code: decline.code, Message: decline.message, Err: ErrDeclined}
+	}
+
+	log.Printf("Payment simulation: Order=%s, Amount=%.2f, Method=%s, Status=%s, Message=%s",
+		req.OrderID, req.Amount, transaction.Method, transaction.Status, transaction.Message)
+
+	return s.remember(req.IdempotencyKey, transaction, err)
+}
+
+func (s *Simulator) Capture(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*Transaction, error) {
+	return s.update(ctx, transactionID, idempotencyKey, func(t *Transaction) error {
+		if t.Status != StatusAuthorized {
+			return &Error{Code: "invalid_state", Message: fmt.Sprintf("transaction is %s", t.Status), Err: ErrInvalidRequest}
+		}
+		if amount > t.Amount {
+			return &Error{Code: "amount_too_large", Message: "capture exceeds the authorized amount", Err: ErrInvalidRequest}
+		}
+		t.Amount = amount
+		t.Status = StatusCaptured
+		t.Message = "Payment captured"
+		return nil
+	}, StatusAuthorized, amount)
+}
+
+func (s *Simulator) Void(ctx context.Context, transactionID string, idempotencyKey string) (*Transaction, error) {
+	return s.update(ctx, transactionID, idempotencyKey, func(t *Transaction) error {
+		if t.Status != StatusAuthorized {
+			return &Error{Code: "invalid_state", Message: fmt.Sprintf("transaction is %s", t.Status), Err: ErrInvalidRequest}
+		}
+		t.Status = StatusVoided
+		t.Message = "Authorization voided"
+		return nil
+	}, StatusAuthorized, 0)
+}
+
+func (s *Simulator) Refund(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*Transaction, error) {
+	return s.update(ctx, transactionID, idempotencyKey, func(t *Transaction) error {
+		if t.Status != StatusCaptured {
+			return &Error{Code: "invalid_state", Message: fmt.Sprintf("transaction is %s", t.Status), Err: ErrInvalidRequest}
+		}
+		if amount > t.Amount-t.Refunded {
+			return &Error{Code: "amount_too_large", Message: "refund exceeds the captured amount", Err: ErrInvalidRequest}
+		}
+		t.Refunded += amount
+		t.Message = "Payment refunded"
+		if t.Refunded >= t.Amount {
+			t.Status = StatusRefunded
+		}
+		return nil
+	}, StatusCaptured, amount)
+}
+
+func (s *Simulator) Status(ctx context.Context, transactionID string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transactions[transactionID]
+	if !ok {
+		return nil, &Error{Code: "not_found", Message: transactionID, Err: ErrNotFound}
+	}
+	transaction := *t
+	return &transaction, nil
+}
+
+// update applies change to a known transaction, or to one assumed to be in
+// the assumed status for amount when the simulator does not know it
+func (s *Simulator) update(ctx context.Context, transactionID, idempotencyKey string, change func(t *Transaction) error, assumed Status, amount float64) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &Error{Message: err.Error(), Err: ErrUnavailable}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if result, ok := s.result(idempotencyKey); ok {
+		return result.get()
+	}
+
+	t, ok := s.transactions[transactionID]
+	if !ok {
+		t = &Transaction{ID: transactionID, Status: assumed, Amount: amount}
+		s.transactions[transactionID] = t
+	}
+	err := change(t)
+	return s.remember(idempotencyKey, *t, err)
+}
+
+// process waits for the simulated authorization delay
+func (s *Simulator) process(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return &Error{Message: ctx.Err().Error(), Err: ErrUnavailable}
+	}
+}
+
+// result returns the result remembered for an idempotency key unless it
+// expired. s.mu must be held.
+func (s *Simulator) result(idempotencyKey string) (simulatedResult, bool) {
+	result, ok := s.results[idempotencyKey]
+	if !ok || idempotencyKey == "" || time.Since(result.storedAt) > s.resultTTL {
+		return simulatedResult{}, false
+	}
+	return result, true
+}
+
+// remember stores the result of a request under its idempotency key,
+// forgetting expired results and, beyond maxResults, the oldest ones. s.mu
+// must be held.
+func (s *Simulator) remember(idempotencyKey string, transaction Transaction, err error) (*Transaction, error) {
+	result := simulatedResult{transaction: transaction, err: err, storedAt: time.Now()}
+	if idempotencyKey == "" {
+		return result.get()
+	}
+
+	for len(s.keys) > 0 {
+		oldest := s.results[s.keys[0]]
+		if len(s.keys) < s.maxResults && time.Since(oldest.storedAt) <= s.resultTTL {
+			break
+		}
+		delete(s.results, s.keys[0])
+		s.keys = s.keys[1:]
+	}
+	if _, ok := s.results[idempotencyKey]; !ok {
+		s.keys = append(s.keys, idempotencyKey)
+	}
+	s.results[idempotencyKey] = result
+	return result.get()
+}
+
+func (r simulatedResult) get() (*Transaction, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	transaction := r.transaction
+	return &transaction, nil
+}
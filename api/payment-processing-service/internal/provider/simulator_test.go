@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSimulatorRepeatsResults(t *testing.T) {
+	s := NewSimulator(1, 0)
+	ctx := context.Background()
+
+	first, err := s.Authorize(ctx, AuthorizeRequest{OrderID: "order-1", Amount: 25, IdempotencyKey: "event-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repeated, err := s.Authorize(ctx, AuthorizeRequest{OrderID: "order-1", Amount: 25, IdempotencyKey: "event-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeated.ID != first.ID {
+		t.Errorf("repeated authorization = %s, want %s", repeated.ID, first.ID)
+	}
+}
+
+func TestSimulatorBoundsResults(t *testing.T) {
+	s := NewSimulator(1, 0)
+	s.maxResults = 3
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.Void(ctx, fmt.Sprint("TXN_", i), fmt.Sprint("void-", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.results) != 3 || len(s.keys) != 3 {
+		t.Fatalf("kept %d results under %d keys, want 3", len(s.results), len(s.keys))
+	}
+	if _, ok := s.result("void-1"); ok {
+		t.Error("kept the result of void-1, want the oldest forgotten")
+	}
+	if _, ok := s.result("void-4"); !ok {
+		t.Error("forgot the result of void-4")
+	}
+
+	// Once forgotten, a repeated void reaches the voided transaction again
+	if _, err := s.Void(ctx, "TXN_0", "void-0"); err == nil {
+		t.Error("repeating a forgotten void succeeded, want invalid_state")
+	}
+}
+
+func TestSimulatorExpiresResults(t *testing.T) {
+	s := NewSimulator(1, 0)
+	s.resultTTL = time.Millisecond
+	ctx := context.Background()
+
+	if _, err := s.Void(ctx, "TXN_1", "void-1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := s.result("void-1"); ok {
+		t.Error("returned an expired result")
+	}
+
+	if _, err := s.Void(ctx, "TXN_2", "void-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.results["void-1"]; ok {
+		t.Error("kept the expired result of void-1")
+	}
+}
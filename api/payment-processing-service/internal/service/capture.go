@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// paymentTransaction is an order's payment as stored
+type paymentTransaction struct {
+	ID             string
+	TransactionID  string
+	Amount         float64
+	CapturedAmount float64
+	Status         string
+	ExpiresAt      sql.NullTime
+}
+
+// lockTransaction returns the order's latest payment transaction locked for
+// update, or sql.ErrNoRows
+func (s *PaymentService) lockTransaction(ctx context.Context, tx *sql.Tx, orderID string) (*paymentTransaction, error) {
+	var payment paymentTransaction
+	err := tx.QueryRowContext(ctx, `
+		SELECT id, COALESCE(transaction_id, ''), amount, COALESCE(captured_amount, 0), status, authorization_expires_at
+		FROM payment_transactions
+		WHERE order_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+		FOR UPDATE
+	`, orderID).Scan(&payment.ID, &payment.TransactionID, &payment.Amount, &payment.CapturedAmount, &payment.Status,
+		&payment.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payment transaction of order %s: %v", orderID, err)
+	}
+	return &payment, nil
+}
+
+// capturePayment records the capture of the authorized amount of an order
+// that is shipping. A capture the provider refused, or of an authorization
+// that expired, is reported as PaymentCaptureFailed for the orchestrator to
+// act on.
+func (s *PaymentService) capturePayment(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
+	payment, err := s.lockTransaction(ctx, tx, event.OrderID)
+	if err == sql.ErrNoRows {
+		log.Printf("No payment to capture for order %s", event.OrderID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch payment.Status {
+	case TransactionCapturing:
+	case TransactionAuthorized:
+		// Only an expired authorization is not claimed for capturing
+		if payment.ExpiresAt.Valid && time.Now().After(payment.ExpiresAt.Time) {
+			return s.failCapture(ctx, tx, event, payment, TransactionExpired, "payment authorization expired", "")
+		}
+		return fmt.Errorf("%w: capture of order %s", errNotPrepared, event.OrderID)
+	case TransactionCaptured, TransactionPartiallyRefunded, TransactionRefunded:
+		return nil
+	case TransactionExpiring:
+		return fmt.Errorf("payment of order %s is expiring, failing the capture once it has expired", event.OrderID)
+	case TransactionVoiding, TransactionVoided:
+		// The order was cancelled as it became ready for shipping
+		log.Printf("Not capturing voided payment of order %s", event.OrderID)
+		return nil
+	default:
+		return s.failCapture(ctx, tx, event, payment, payment.Status, "payment is "+payment.Status, "")
+	}
+
+	call, ok := preparedCall(ctx)
+	if !ok {
+		return fmt.Errorf("%w: capture of order %s", errNotPrepared, event.OrderID)
+	}
+	if call.err != nil {
+		message, code := providerError(call.err)
+		return s.failCapture(ctx, tx, event, payment, TransactionCaptureFailed, message, code)
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE payment_transactions
+		SET status = $1, captured_amount = $2, captured_at = $3, message = $4, updated_at = $3
+		WHERE id = $5
+	`, TransactionCaptured, payment.Amount, now, "Payment captured", payment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mark payment transaction captured: %v", err)
+	}
+	err = addLedgerEntry(ctx, tx, &LedgerEntry{
+		OrderID:              event.OrderID,
+		PaymentTransactionID: payment.ID,
+		EntryType:            EntryCapture,
+		Amount:               payment.Amount,
+		Status:               EntrySucceeded,
+		Source:               SourceShipping,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Captured payment of order %s: %.2f", event.OrderID, payment.Amount)
+	return s.emit(ctx, tx, event, shared.EventPaymentCaptured, map[string]interface{}{
+		"transaction_id":  payment.TransactionID,
+		"payment_status":  TransactionCaptured,
+		"captured_amount": payment.Amount,
+		"message":         "Payment captured",
+	})
+}
+
+// failCapture records that the payment of a shipping order could not be
+// captured
+func (s *PaymentService) failCapture(ctx context.Context, tx *sql.Tx, event shared.OrderEvent, payment *paymentTransaction, status, message, code string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE payment_transactions SET status = $1, message = $2, updated_at = $3
+		WHERE id = $4
+	`, status, message, time.Now(), payment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record failed capture: %v", err)
+	}
+
+	log.Printf("Failed to capture payment of order %s: %s", event.OrderID, message)
+	metadata := map[string]interface{}{
+		"transaction_id": payment.TransactionID,
+		"payment_status": status,
+		"message":        message,
+	}
+	if code != "" {
+		metadata["error_code"] = code
+	}
+	return s.emit(ctx, tx, event, shared.EventPaymentCaptureFailed, metadata)
+}
+
+// releasePayment records how the payment of an order whose saga was
+// cancelled was given back: an authorization is voided and what is left of
+// a captured payment refunded, unless the request names a smaller amount.
+// An order with neither has nothing to give back; that is reported as a
+// refund of nothing so the saga can finish.
+func (s *PaymentService) releasePayment(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
+	reason, _ := event.Metadata["reason"].(string)
+
+	payment, err := s.lockTransaction(ctx, tx, event.OrderID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		switch payment.Status {
+		case TransactionVoiding:
+			return s.voidPayment(ctx, tx, event, payment, reason)
+		case TransactionAuthorized, TransactionCaptureFailed, TransactionCapturing, TransactionExpiring:
+			return fmt.Errorf("%w: release of order %s", errNotPrepared, event.OrderID)
+		case TransactionCaptured, TransactionPartiallyRefunded, TransactionRefunded:
+			// A refund that could not be made was recorded as failed when
+			// it was prepared; one that was not prepared is retried
+			entry, err := ledgerEntryByRequest(ctx, tx, event.EventID+":refund")
+			if err == nil {
+				if entry.Status != EntryPending {
+					return nil
+				}
+				call, ok := preparedCall(ctx)
+				if !ok {
+					return fmt.Errorf("%w: refund of order %s", errNotPrepared, event.OrderID)
+				}
+				return s.settleRefund(ctx, tx, event, payment, entry, call.err)
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+			if payment.Status != TransactionRefunded {
+				return fmt.Errorf("%w: refund of order %s", errNotPrepared, event.OrderID)
+			}
+		}
+	}
+
+	log.Printf("No payment to refund for order %s", event.OrderID)
+	return s.emit(ctx, tx, event, shared.EventRefundIssued, map[string]interface{}{
+		"amount":  0.0,
+		"message": "No payment to refund",
+	})
+}
+
+// voidPayment records the release of the authorization of a cancelled
+// order. An authorization the provider no longer holds has lapsed, which
+// releases it as well.
+func (s *PaymentService) voidPayment(ctx context.Context, tx *sql.Tx, event shared.OrderEvent, payment *paymentTransaction, reason string) error {
+	call, ok := preparedCall(ctx)
+	if !ok {
+		return fmt.Errorf("%w: void of order %s", errNotPrepared, event.OrderID)
+	}
+	log.Printf("Voided payment authorization for order: %s, reason: %s", event.OrderID, reason)
+	if call.err != nil {
+		log.Printf("Provider did not void payment %s, treating it as released: %v", payment.TransactionID, call.err)
+	}
+
+	now := time.Now()
+	_, err := tx.ExecContext(ctx, `
+		UPDATE payment_transactions SET status = $1, voided_at = $2, message = $3, updated_at = $2
+		WHERE id = $4
+	`, TransactionVoided, now, "Voided: "+reason, payment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mark payment transaction voided: %v", err)
+	}
+	err = addLedgerEntry(ctx, tx, &LedgerEntry{
+		OrderID:              event.OrderID,
+		PaymentTransactionID: payment.ID,
+		EntryType:            EntryVoid,
+		Amount:               payment.Amount,
+		Status:               EntrySucceeded,
+		Source:               SourceCancellation,
+		Reason:               reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.emit(ctx, tx, event, shared.EventPaymentVoided, map[string]interface{}{
+		"transaction_id": payment.TransactionID,
+		"payment_status": TransactionVoided,
+		"amount":         payment.Amount,
+		"reason":         reason,
+		"message":        "Payment authorization voided",
+	})
+}
+
+// emit stores a follow-up event of the payment in the outbox
+func (s *PaymentService) emit(ctx context.Context, tx *sql.Tx, cause shared.OrderEvent, eventType string, metadata map[string]interface{}) error {
+	event := cause.FollowUp(eventType)
+	event.Status = eventType
+	event.Metadata = metadata
+	return s.outbox.Add(ctx, tx, event)
+}
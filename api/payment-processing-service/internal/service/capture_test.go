@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func orderShipped() shared.OrderEvent {
+	return shared.OrderEvent{EventID: "event-2", EventType: shared.EventOrderShipped, OrderID: testOrderID, UserID: "user-1", TotalAmount: 25}
+}
+
+func refundRequested() shared.OrderEvent {
+	return shared.OrderEvent{
+		EventID:     "event-3",
+		EventType:   shared.EventPaymentRefundRequested,
+		OrderID:     testOrderID,
+		UserID:      "user-1",
+		TotalAmount: 25,
+		Metadata:    map[string]interface{}{"reason": "stock insufficient"},
+	}
+}
+
+// expectCaptureClaim expects an authorized payment to be claimed for
+// capturing
+func (s *testService) expectCaptureClaim() {
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionAuthorized, time.Hour)
+	s.expectStatus(TransactionCapturing)
+	s.mock.ExpectCommit()
+}
+
+// expectFailedCapture expects the payment to be marked status for a capture
+// that failed
+func (s *testService) expectFailedCapture(status string) {
+	s.mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_transactions SET status = $1, message = $2")).
+		WithArgs(status, sqlmock.AnyArg(), sqlmock.AnyArg(), "payment-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestCapture(t *testing.T) {
+	s := newTestService(t)
+
+	s.expectCaptureClaim()
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCapturing, time.Hour)
+	s.mock.ExpectExec(regexp.QuoteMeta("SET status = $1, captured_amount = $2")).
+		WithArgs(TransactionCaptured, 25.0, sqlmock.AnyArg(), "Payment captured", "payment-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.expectLedger(EntryCapture, EntrySucceeded, 25)
+	s.mock.ExpectCommit()
+
+	if err := s.handle(orderShipped()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fmt.Sprint(s.provider.called()); calls != "[capture event-2]" {
+		t.Errorf("provider calls = %s, want [capture event-2]", calls)
+	}
+	if event := s.lastEvent(t); event.EventType != shared.EventPaymentCaptured {
+		t.Errorf("emitted %s, want %s", event.EventType, shared.EventPaymentCaptured)
+	}
+}
+
+func TestCaptureRejected(t *testing.T) {
+	s := newTestService(t)
+	s.provider.errs["capture"] = errDeclined
+
+	s.expectCaptureClaim()
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCapturing, time.Hour)
+	s.expectFailedCapture(TransactionCaptureFailed)
+	s.mock.ExpectCommit()
+
+	if err := s.handle(orderShipped()); err != nil {
+		t.Fatal(err)
+	}
+	event := s.lastEvent(t)
+	if event.EventType != shared.EventPaymentCaptureFailed || event.Metadata["error_code"] != "card_declined" {
+		t.Errorf("emitted %s with code %v, want %s with card_declined", event.EventType, event.Metadata["error_code"], shared.EventPaymentCaptureFailed)
+	}
+}
+
+func TestCaptureProviderUnavailable(t *testing.T) {
+	s := newTestService(t)
+	s.provider.errs["capture"] = errUnavailable
+
+	// The payment stays claimed; the retried event captures it with the
+	// same idempotency key
+	s.expectCaptureClaim()
+	if err := s.handle(orderShipped()); err == nil {
+		t.Fatal("handled the event without an answer from the provider")
+	}
+
+	s.provider.errs["capture"] = nil
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCapturing, time.Hour)
+	s.mock.ExpectCommit()
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCapturing, time.Hour)
+	s.mock.ExpectExec(regexp.QuoteMeta("SET status = $1, captured_amount = $2")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.expectLedger(EntryCapture, EntrySucceeded, 25)
+	s.mock.ExpectCommit()
+
+	if err := s.handle(orderShipped()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fmt.Sprint(s.provider.called()); calls != "[capture event-2 capture event-2]" {
+		t.Errorf("provider calls = %s, want the capture repeated with its key", calls)
+	}
+}
+
+func TestCaptureExpiredAuthorization(t *testing.T) {
+	s := newTestService(t)
+
+	// An expired authorization is not claimed, nor sent to the provider
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionAuthorized, -time.Minute)
+	s.mock.ExpectRollback()
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionAuthorized, -time.Minute)
+	s.expectFailedCapture(TransactionExpired)
+	s.mock.ExpectCommit()
+
+	if err := s.handle(orderShipped()); err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.provider.called(); len(calls) != 0 {
+		t.Errorf("provider calls = %v, want none", calls)
+	}
+	event := s.lastEvent(t)
+	if event.EventType != shared.EventPaymentCaptureFailed || event.Metadata["payment_status"] != TransactionExpired {
+		t.Errorf("emitted %s with status %v, want %s with %s", event.EventType, event.Metadata["payment_status"], shared.EventPaymentCaptureFailed, TransactionExpired)
+	}
+}
+
+func TestCaptureIgnoresOtherEvent(t *testing.T) {
+	s := newTestService(t)
+	event := orderShipped()
+	event.EventType = shared.EventOrderReadyForShipping
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectCommit()
+	if err := s.handle(event); err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.provider.called(); len(calls) != 0 {
+		t.Errorf("provider calls = %v, want none", calls)
+	}
+}
+
+func TestVoid(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		err    error
+	}{
+		{"authorized", TransactionAuthorized, nil},
+		{"capture failed", TransactionCaptureFailed, nil},
+		{"lapsed at the provider", TransactionAuthorized, errNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			s.provider.errs["void"] = tt.err
+
+			s.mock.ExpectBegin()
+			s.expectLock(tt.status, time.Hour)
+			s.expectStatus(TransactionVoiding)
+			s.mock.ExpectCommit()
+			s.mock.ExpectBegin()
+			s.expectLock(TransactionVoiding, time.Hour)
+			s.mock.ExpectExec(regexp.QuoteMeta("SET status = $1, voided_at = $2")).
+				WithArgs(TransactionVoided, sqlmock.AnyArg(), "Voided: stock insufficient", "payment-1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			s.expectLedger(EntryVoid, EntrySucceeded, 25)
+			s.mock.ExpectCommit()
+
+			if err := s.handle(refundRequested()); err != nil {
+				t.Fatal(err)
+			}
+			if calls := fmt.Sprint(s.provider.called()); calls != "[void event-3]" {
+				t.Errorf("provider calls = %s, want [void event-3]", calls)
+			}
+			if event := s.lastEvent(t); event.EventType != shared.EventPaymentVoided {
+				t.Errorf("emitted %s, want %s", event.EventType, shared.EventPaymentVoided)
+			}
+		})
+	}
+}
+
+func TestReleaseWaitsForCapture(t *testing.T) {
+	s := newTestService(t)
+
+	// A payment being captured is refunded once the capture is recorded
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCapturing, time.Hour)
+	s.mock.ExpectRollback()
+
+	if err := s.handle(refundRequested()); err == nil {
+		t.Fatal("released a payment that is being captured")
+	}
+	if calls := s.provider.called(); len(calls) != 0 {
+		t.Errorf("provider calls = %v, want none", calls)
+	}
+}
+
+func TestReleaseWithoutPayment(t *testing.T) {
+	s := newTestService(t)
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta("FROM payment_transactions")).WillReturnError(sql.ErrNoRows)
+	s.mock.ExpectRollback()
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta("FROM payment_transactions")).WillReturnError(sql.ErrNoRows)
+	s.mock.ExpectCommit()
+
+	if err := s.handle(refundRequested()); err != nil {
+		t.Fatal(err)
+	}
+	event := s.lastEvent(t)
+	if event.EventType != shared.EventRefundIssued || event.Metadata["amount"] != 0.0 {
+		t.Errorf("emitted %s of %v, want %s of nothing", event.EventType, event.Metadata["amount"], shared.EventRefundIssued)
+	}
+}
+
+func TestUnpreparedReleaseIsRetried(t *testing.T) {
+	s := newTestService(t)
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionVoiding, time.Hour)
+	s.mock.ExpectRollback()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = s.HandleOrderEvent(context.Background(), tx, refundRequested())
+	if !errors.Is(err, errNotPrepared) {
+		t.Errorf("err = %v, want errNotPrepared", err)
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// expiredAuthorization is an authorization that was not captured in time
+type expiredAuthorization struct {
+	paymentTransaction
+	OrderID string
+	UserID  string
+}
+
+// RunAuthorizationExpiry expires authorizations that were not captured in
+// time, until ctx is cancelled
+func (s *PaymentService) RunAuthorizationExpiry(ctx context.Context) {
+	ticker := time.NewTicker(s.config.ExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.expireAuthorizations(ctx); err != nil {
+			log.Printf("Payment authorization expiry check failed: %v", err)
+		}
+	}
+}
+
+// expireAuthorizations expires one batch of authorizations. They are
+// claimed as EXPIRING in a transaction of their own, the provider is asked
+// to void each one outside it so the customer's funds are released, and
+// each is then recorded as expired with a PaymentAuthorizationExpired
+// event, on which the orchestrator cancels the order if it has not shipped.
+func (s *PaymentService) expireAuthorizations(ctx context.Context) error {
+	authorizations, err := s.claimExpiredAuthorizations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, auth := range authorizations {
+		// The hold lapses at the provider on its own as well
+		if _, err := s.provider.Void(ctx, auth.TransactionID, "expire:"+auth.ID); err != nil {
+			log.Printf("Failed to void expired payment %s: %v", auth.TransactionID, err)
+		}
+		if err := s.finishExpiry(ctx, auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimExpiredAuthorizations marks a batch of expired authorizations
+// EXPIRING and returns them. Authorizations left EXPIRING by a check that
+// did not finish are claimed again.
+func (s *PaymentService) claimExpiredAuthorizations(ctx context.Context) ([]expiredAuthorization, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	authorizations, err := s.lockExpiredAuthorizations(ctx, tx, s.config.ExpiryBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	for i := range authorizations {
+		if err := s.setStatus(ctx, tx, &authorizations[i].paymentTransaction, TransactionExpiring); err != nil {
+			return nil, err
+		}
+	}
+	return authorizations, tx.Commit()
+}
+
+// finishExpiry records an authorization claimed for expiry as expired
+func (s *PaymentService) finishExpiry(ctx context.Context, auth expiredAuthorization) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	message := fmt.Sprintf("Payment authorization expired after %s without capture", s.config.AuthorizationTTL)
+	result, err := tx.ExecContext(ctx, `
+		UPDATE payment_transactions SET status = $1, message = $2, updated_at = $3
+		WHERE id = $4 AND status = $5
+	`, TransactionExpired, message, now, auth.ID, TransactionExpiring)
+	if err != nil {
+		return fmt.Errorf("failed to mark payment transaction expired: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	err = addLedgerEntry(ctx, tx, &LedgerEntry{
+		OrderID:              auth.OrderID,
+		PaymentTransactionID: auth.ID,
+		EntryType:            EntryVoid,
+		Amount:               auth.Amount,
+		Status:               EntrySucceeded,
+		Source:               SourceExpiry,
+		Reason:               message,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.outbox.Add(ctx, tx, shared.OrderEvent{
+		CorrelationID: auth.OrderID,
+		EventType:     shared.EventPaymentAuthorizationExpired,
+		OrderID:       auth.OrderID,
+		UserID:        auth.UserID,
+		TotalAmount:   auth.Amount,
+		Status:        shared.EventPaymentAuthorizationExpired,
+		Timestamp:     now,
+		Metadata: map[string]interface{}{
+			"transaction_id": auth.TransactionID,
+			"payment_status": TransactionExpired,
+			"amount":         auth.Amount,
+			"message":        message,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Expired payment authorization of order %s", auth.OrderID)
+	return nil
+}
+
+// lockExpiredAuthorizations returns up to limit authorizations past their
+// expiry, including those still held after a failed capture, and those a
+// check left EXPIRING, skipping those a capture or void is working on
+func (s *PaymentService) lockExpiredAuthorizations(ctx context.Context, tx *sql.Tx, limit int) ([]expiredAuthorization, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT p.id, COALESCE(p.transaction_id, ''), p.amount, p.status, p.authorization_expires_at,
+			p.order_id, o.user_id
+		FROM payment_transactions p
+		JOIN orders o ON o.id = p.order_id
+		WHERE (p.status IN ($1, $2) AND p.authorization_expires_at < $3) OR p.status = $4
+		ORDER BY p.authorization_expires_at
+		LIMIT $5
+		FOR UPDATE OF p SKIP LOCKED
+	`, TransactionAuthorized, TransactionCaptureFailed, time.Now(), TransactionExpiring, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired payment authorizations: %v", err)
+	}
+	defer rows.Close()
+
+	var authorizations []expiredAuthorization
+	for rows.Next() {
+		var auth expiredAuthorization
+		err := rows.Scan(&auth.ID, &auth.TransactionID, &auth.Amount, &auth.Status, &auth.ExpiresAt,
+			&auth.OrderID, &auth.UserID)
+		if err != nil {
+			return nil, err
+		}
+		authorizations = append(authorizations, auth)
+	}
+	return authorizations, rows.Err()
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectExpiredAuthorizations expects the expired authorizations to be
+// claimed, returning one row per status
+func (s *testService) expectExpiredAuthorizations(statuses ...string) {
+	rows := sqlmock.NewRows([]string{"id", "transaction_id", "amount", "status", "authorization_expires_at", "order_id", "user_id"})
+	for i, status := range statuses {
+		rows.AddRow(fmt.Sprint("payment-", i+1), fmt.Sprint("TXN_", i+1), 25.0, status, time.Now().Add(-time.Minute),
+			testOrderID, "user-1")
+	}
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta("authorization_expires_at < $3) OR p.status = $4")).
+		WithArgs(TransactionAuthorized, TransactionCaptureFailed, sqlmock.AnyArg(), TransactionExpiring, 10).
+		WillReturnRows(rows)
+	for i, status := range statuses {
+		if status != TransactionExpiring {
+			s.mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_transactions SET status = $1, updated_at = $2")).
+				WithArgs(TransactionExpiring, sqlmock.AnyArg(), fmt.Sprint("payment-", i+1)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+	}
+	s.mock.ExpectCommit()
+}
+
+// expectExpiry expects the payment to be recorded as expired if it is still
+// being expired
+func (s *testService) expectExpiry(paymentID string, expiring bool) {
+	s.mock.ExpectBegin()
+	var affected int64
+	if expiring {
+		affected = 1
+	}
+	s.mock.ExpectExec(regexp.QuoteMeta("WHERE id = $4 AND status = $5")).
+		WithArgs(TransactionExpired, sqlmock.AnyArg(), sqlmock.AnyArg(), paymentID, TransactionExpiring).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+	if !expiring {
+		s.mock.ExpectRollback()
+		return
+	}
+	s.expectLedger(EntryVoid, EntrySucceeded, 25)
+	s.mock.ExpectCommit()
+}
+
+func TestExpireAuthorizations(t *testing.T) {
+	s := newTestService(t)
+
+	// An authorization held after a failed capture expires as well, and one
+	// a previous check left expiring is finished
+	s.expectExpiredAuthorizations(TransactionAuthorized, TransactionCaptureFailed, TransactionExpiring)
+	s.expectExpiry("payment-1", true)
+	s.expectExpiry("payment-2", true)
+	s.expectExpiry("payment-3", true)
+
+	if err := s.expireAuthorizations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "[void expire:payment-1 void expire:payment-2 void expire:payment-3]"
+	if calls := fmt.Sprint(s.provider.called()); calls != want {
+		t.Errorf("provider calls = %s, want %s", calls, want)
+	}
+	for _, eventType := range s.emitted() {
+		if eventType != shared.EventPaymentAuthorizationExpired {
+			t.Errorf("emitted %s, want only %s", eventType, shared.EventPaymentAuthorizationExpired)
+		}
+	}
+	if got := len(s.emitted()); got != 3 {
+		t.Errorf("emitted %d events, want 3", got)
+	}
+}
+
+func TestExpireAuthorizationsProviderUnavailable(t *testing.T) {
+	s := newTestService(t)
+	s.provider.errs["void"] = errUnavailable
+
+	// The hold lapses at the provider on its own, so the expiry is recorded
+	s.expectExpiredAuthorizations(TransactionAuthorized)
+	s.expectExpiry("payment-1", true)
+
+	if err := s.expireAuthorizations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.emitted(); fmt.Sprint(got) != fmt.Sprint([]string{shared.EventPaymentAuthorizationExpired}) {
+		t.Errorf("emitted %v, want one %s", got, shared.EventPaymentAuthorizationExpired)
+	}
+}
+
+func TestExpireAuthorizationsSkipsSettled(t *testing.T) {
+	s := newTestService(t)
+
+	// Another check finished the expiry while the provider was asked
+	s.expectExpiredAuthorizations(TransactionAuthorized)
+	s.expectExpiry("payment-1", false)
+
+	if err := s.expireAuthorizations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.emitted(); len(got) != 0 {
+		t.Errorf("emitted %v, want nothing", got)
+	}
+}
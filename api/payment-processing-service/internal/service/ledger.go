@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Ledger entry types
+const (
+	EntryAuthorization = "AUTHORIZATION"
+	EntryCapture       = "CAPTURE"
+	EntryVoid          = "VOID"
+	EntryRefund        = "REFUND"
+)
+
+// Ledger entry statuses
+const (
+	EntrySucceeded = "SUCCEEDED"
+	EntryFailed    = "FAILED"
+	EntryPending   = "PENDING"
+)
+
+// Why a ledger entry failed
+const (
+	FailureDeclined        = "declined"          // refused by the payment provider
+	FailureExceedsBalance  = "exceeds_balance"   // more than is left of the payment
+	FailureNothingToRefund = "nothing_to_refund" // nothing is left of the payment
+)
+
+// What a ledger entry was made for
+const (
+	SourceCheckout     = "checkout"
+	SourceShipping     = "shipping"
+	SourceCancellation = "cancellation"
+	SourceExpiry       = "expiry"
+	SourceReturn       = "return"
+	SourceAdmin        = "admin"
+)
+
+// LedgerEntry is one movement of an order's payment
+type LedgerEntry struct {
+	ID                   string    `json:"id"`
+	OrderID              string    `json:"order_id"`
+	PaymentTransactionID string    `json:"payment_transaction_id"`
+	EntryType            string    `json:"entry_type"`
+	Amount               float64   `json:"amount"`
+	Status               string    `json:"status"`
+	Source               string    `json:"source"`
+	Reason               string    `json:"reason,omitempty"`
+	FailureCode          string    `json:"failure_code,omitempty"`
+	FailureReason        string    `json:"failure_reason,omitempty"`
+	RequestID            string    `json:"request_id,omitempty"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+// OrderBalance is an order's payment position as finance sees it: what was
+// captured, what was refunded and what is left
+type OrderBalance struct {
+	OrderID          string        `json:"order_id"`
+	AuthorizedAmount float64       `json:"authorized_amount"`
+	CapturedAmount   float64       `json:"captured_amount"`
+	RefundedAmount   float64       `json:"refunded_amount"`
+	Balance          float64       `json:"balance"`
+	FailedRefunds    int           `json:"failed_refunds"`
+	Entries          []LedgerEntry `json:"entries"`
+}
+
+// addLedgerEntry records an entry in the caller's transaction
+func addLedgerEntry(ctx context.Context, tx *sql.Tx, entry *LedgerEntry) error {
+	entry.ID = uuid.New().String()
+	entry.CreatedAt = time.Now()
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_ledger (id, order_id, payment_transaction_id, entry_type, amount, status, source,
+			reason, failure_code, failure_reason, request_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''), $12)
+	`, entry.ID, entry.OrderID, entry.PaymentTransactionID, entry.EntryType, entry.Amount, entry.Status,
+		entry.Source, entry.Reason, entry.FailureCode, entry.FailureReason, entry.RequestID, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to add %s ledger entry for order %s: %v", entry.EntryType, entry.OrderID, err)
+	}
+	return nil
+}
+
+// ledgerEntryByRequest returns the entry recorded for requestID, or
+// sql.ErrNoRows
+func ledgerEntryByRequest(ctx context.Context, tx *sql.Tx, requestID string) (*LedgerEntry, error) {
+	entry, err := scanLedgerEntry(tx.QueryRowContext(ctx,
+		"SELECT "+ledgerColumns+" FROM payment_ledger WHERE request_id = $1", requestID))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to look up refund request %s: %v", requestID, err)
+	}
+	return entry, err
+}
+
+// settleLedgerEntry records the outcome of a pending entry, with the code
+// and reason of a failure
+func settleLedgerEntry(ctx context.Context, tx *sql.Tx, entry *LedgerEntry, status, failureCode, failure string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE payment_ledger SET status = $1, failure_code = NULLIF($2, ''), failure_reason = NULLIF($3, '')
+		WHERE id = $4
+	`, status, failureCode, failure, entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to settle %s ledger entry %s: %v", entry.EntryType, entry.ID, err)
+	}
+	entry.Status = status
+	entry.FailureCode = failureCode
+	entry.FailureReason = failure
+	return nil
+}
+
+// refundedAmount returns how much of a payment transaction was refunded
+func refundedAmount(ctx context.Context, tx *sql.Tx, paymentTransactionID string) (float64, error) {
+	return sumRefunds(ctx, tx, paymentTransactionID, EntrySucceeded)
+}
+
+// reservedAmount returns how much of a payment transaction was refunded or
+// is being refunded
+func reservedAmount(ctx context.Context, tx *sql.Tx, paymentTransactionID string) (float64, error) {
+	return sumRefunds(ctx, tx, paymentTransactionID, EntrySucceeded, EntryPending)
+}
+
+func sumRefunds(ctx context.Context, tx *sql.Tx, paymentTransactionID string, statuses ...string) (float64, error) {
+	var refunded float64
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount), 0) FROM payment_ledger
+		WHERE payment_transaction_id = $1 AND entry_type = $2 AND status = ANY($3)
+	`, paymentTransactionID, EntryRefund, pq.Array(statuses)).Scan(&refunded)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum refunds of payment %s: %v", paymentTransactionID, err)
+	}
+	return refunded, nil
+}
+
+const ledgerColumns = `id, order_id, payment_transaction_id, entry_type, amount, status, source,
+		COALESCE(reason, ''), COALESCE(failure_code, ''), COALESCE(failure_reason, ''), COALESCE(request_id, ''), created_at`
+
+func scanLedgerEntry(row interface{ Scan(...interface{}) error }) (*LedgerEntry, error) {
+	var entry LedgerEntry
+	err := row.Scan(&entry.ID, &entry.OrderID, &entry.PaymentTransactionID, &entry.EntryType, &entry.Amount,
+		&entry.Status, &entry.Source, &entry.Reason, &entry.FailureCode, &entry.FailureReason, &entry.RequestID,
+		&entry.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetOrderBalance returns the order's balance and the ledger entries it is
+// built from, oldest first
+func (s *PaymentService) GetOrderBalance(ctx context.Context, orderID string) (*OrderBalance, error) {
+	if _, err := uuid.Parse(orderID); err != nil {
+		return nil, ErrPaymentNotFound
+	}
+
+	balance := OrderBalance{OrderID: orderID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT authorized_amount, captured_amount, refunded_amount, balance, failed_refunds
+		FROM order_payment_balances
+		WHERE order_id = $1
+	`, orderID).Scan(&balance.AuthorizedAmount, &balance.CapturedAmount, &balance.RefundedAmount,
+		&balance.Balance, &balance.FailedRefunds)
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load balance of order %s: %v", orderID, err)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+ledgerColumns+" FROM payment_ledger WHERE order_id = $1 ORDER BY created_at", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ledger of order %s: %v", orderID, err)
+	}
+	defer rows.Close()
+
+	balance.Entries = []LedgerEntry{}
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		balance.Entries = append(balance.Entries, *entry)
+	}
+	return &balance, rows.Err()
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"go-rabbitmq-order-system/shared/testdb"
+
+	"github.com/google/uuid"
+)
+
+func TestOrderPaymentBalance(t *testing.T) {
+	db := testdb.Open(t, "payment_ledger")
+	orderID, paymentID := uuid.New().String(), uuid.New().String()
+
+	_, err := db.Exec(`
+		INSERT INTO payment_transactions (id, order_id, amount, payment_method, status, captured_amount)
+		VALUES ($1, $2, 25, 'credit_card', $3, 25)
+	`, paymentID, orderID, TransactionPartiallyRefunded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only succeeded refunds count against the capture; pending and failed
+	// ones do not, and failed ones are counted apart
+	entries := []struct {
+		entryType string
+		amount    float64
+		status    string
+	}{
+		{EntryAuthorization, 25, EntrySucceeded},
+		{EntryCapture, 25, EntrySucceeded},
+		{EntryRefund, 10, EntrySucceeded},
+		{EntryRefund, 2.5, EntrySucceeded},
+		{EntryRefund, 30, EntryFailed},
+		{EntryRefund, 5, EntryFailed},
+		{EntryRefund, 4, EntryPending},
+	}
+	for _, e := range entries {
+		_, err := db.Exec(`
+			INSERT INTO payment_ledger (id, order_id, payment_transaction_id, entry_type, amount, status, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, uuid.New().String(), orderID, paymentID, e.entryType, e.amount, e.status, SourceAdmin)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(db, nil, nil, nil)
+	balance, err := s.GetOrderBalance(context.Background(), orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.AuthorizedAmount != 25 || balance.CapturedAmount != 25 || balance.RefundedAmount != 12.5 ||
+		balance.Balance != 12.5 || balance.FailedRefunds != 2 {
+		t.Errorf("balance = authorized %.2f, captured %.2f, refunded %.2f, balance %.2f, %d failed refunds; "+
+			"want 25.00, 25.00, 12.50, 12.50, 2", balance.AuthorizedAmount, balance.CapturedAmount,
+			balance.RefundedAmount, balance.Balance, balance.FailedRefunds)
+	}
+	if len(balance.Entries) != len(entries) {
+		t.Errorf("balance lists %d entries, want %d", len(balance.Entries), len(entries))
+	}
+
+	if _, err := s.GetOrderBalance(context.Background(), uuid.New().String()); err != ErrPaymentNotFound {
+		t.Errorf("balance of an order without payments: err = %v, want ErrPaymentNotFound", err)
+	}
+}
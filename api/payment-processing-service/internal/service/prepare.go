@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/provider"
+	"go-rabbitmq-order-system/shared"
+)
+
+// Provider calls are made before the transaction of the event that needs
+// them, so no transaction is held open while the provider answers. The
+// payment is claimed first in a short transaction of its own, by moving it
+// to CAPTURING or VOIDING or, for a refund, by recording a pending ledger
+// entry. Other operations on the payment wait until the event's handler has
+// recorded the answer. A retried event finds its claim and repeats the call
+// with the same idempotency key, which returns the first answer.
+
+// errNotPrepared fails an event whose handler finds no provider answer for
+// the payment it has to change; the event is retried and prepared again
+var errNotPrepared = errors.New("payment operation was not prepared")
+
+// providerCall is the provider's answer to the call prepared for an event
+type providerCall struct {
+	transaction *provider.Transaction
+	err         error
+}
+
+type providerCallKey struct{}
+
+func withProviderCall(ctx context.Context, transaction *provider.Transaction, err error) context.Context {
+	return context.WithValue(ctx, providerCallKey{}, providerCall{transaction: transaction, err: err})
+}
+
+// preparedCall returns the answer to the provider call prepared for the
+// event being handled
+func preparedCall(ctx context.Context) (providerCall, bool) {
+	call, ok := ctx.Value(providerCallKey{}).(providerCall)
+	return call, ok
+}
+
+// PrepareOrderEvent makes the provider call an event needs before its inbox
+// transaction. A provider that cannot be reached fails the event, which is
+// retried with the same idempotency key.
+func (s *PaymentService) PrepareOrderEvent(ctx context.Context, event shared.OrderEvent) (context.Context, error) {
+	switch event.EventType {
+	case shared.EventOrderCreated:
+		return s.authorize(ctx, event)
+	case shared.EventOrderReadyForShipping, shared.EventOrderShipped:
+		if event.EventType != s.config.CaptureEvent {
+			return ctx, nil
+		}
+		return s.prepareCapture(ctx, event)
+	case shared.EventPaymentRefundRequested:
+		return s.prepareRelease(ctx, event)
+	default:
+		return ctx, nil
+	}
+}
+
+// prepareCapture claims an authorized payment that has not expired and asks
+// the provider to capture it
+func (s *PaymentService) prepareCapture(ctx context.Context, event shared.OrderEvent) (context.Context, error) {
+	payment, err := s.claimPayment(ctx, event.OrderID, TransactionCapturing, func(p *paymentTransaction) bool {
+		return p.Status == TransactionAuthorized && !(p.ExpiresAt.Valid && time.Now().After(p.ExpiresAt.Time))
+	})
+	if payment == nil {
+		return ctx, err
+	}
+
+	transaction, err := s.provider.Capture(ctx, payment.TransactionID, payment.Amount, event.EventID)
+	if err != nil && !isRejection(err) {
+		return ctx, fmt.Errorf("failed to capture payment %s: %v", payment.TransactionID, err)
+	}
+	return withProviderCall(ctx, transaction, err), nil
+}
+
+// prepareRelease claims the payment of a cancelled order and asks the
+// provider to void it, also when its capture failed and left the
+// authorization held, or, once captured, to refund it. A payment the
+// provider is still capturing or expiring fails the event until it has
+// settled.
+func (s *PaymentService) prepareRelease(ctx context.Context, event shared.OrderEvent) (context.Context, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ctx, err
+	}
+	defer tx.Rollback()
+
+	payment, err := s.lockTransaction(ctx, tx, event.OrderID)
+	if err == sql.ErrNoRows {
+		return ctx, nil
+	}
+	if err != nil {
+		return ctx, err
+	}
+
+	switch payment.Status {
+	case TransactionAuthorized, TransactionCaptureFailed, TransactionVoiding:
+		if err := s.setStatus(ctx, tx, payment, TransactionVoiding); err != nil {
+			return ctx, err
+		}
+		if err := tx.Commit(); err != nil {
+			return ctx, err
+		}
+
+		transaction, err := s.provider.Void(ctx, payment.TransactionID, event.EventID)
+		if err != nil && !isRejection(err) && !errors.Is(err, provider.ErrNotFound) {
+			return ctx, fmt.Errorf("failed to void payment %s: %v", payment.TransactionID, err)
+		}
+		return withProviderCall(ctx, transaction, err), nil
+	case TransactionCaptured, TransactionPartiallyRefunded:
+		reason, _ := event.Metadata["reason"].(string)
+		amount, _ := event.Metadata["amount"].(float64)
+		source, _ := event.Metadata["source"].(string)
+		if source == "" {
+			source = SourceCancellation
+		}
+		// A retried event carries on with the refund it reserved
+		req := RefundRequest{Amount: amount, Reason: reason, Source: source, RequestID: event.EventID + ":refund"}
+		entry, err := ledgerEntryByRequest(ctx, tx, req.RequestID)
+		if err == sql.ErrNoRows {
+			entry, err = s.reserveRefund(ctx, tx, event, payment, req)
+		}
+		if entry == nil {
+			return ctx, err
+		}
+		// A refund that cannot be made is recorded as failed already
+		if err := tx.Commit(); err != nil || entry.Status != EntryPending {
+			return ctx, err
+		}
+
+		transaction, err := s.provider.Refund(ctx, payment.TransactionID, entry.Amount, entry.RequestID)
+		if err != nil && !isRejection(err) && !errors.Is(err, provider.ErrNotFound) {
+			return ctx, fmt.Errorf("failed to refund payment %s: %v", payment.TransactionID, err)
+		}
+		return withProviderCall(ctx, transaction, err), nil
+	case TransactionCapturing, TransactionExpiring:
+		return ctx, fmt.Errorf("payment of order %s is %s, releasing it once that is done", event.OrderID, payment.Status)
+	default:
+		return ctx, nil
+	}
+}
+
+// claimPayment moves the order's latest payment to claimed, in a
+// transaction of its own, if claimable accepts it, and returns it. A payment
+// already in claimed is returned as it is, so a retried event carries on
+// with its call. Any other payment is left alone and nil returned.
+func (s *PaymentService) claimPayment(ctx context.Context, orderID, claimed string, claimable func(p *paymentTransaction) bool) (*paymentTransaction, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	payment, err := s.lockTransaction(ctx, tx, orderID)
+	if err == sql.ErrNoRows {
+		log.Printf("No payment to claim for order %s", orderID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if payment.Status != claimed && !claimable(payment) {
+		return nil, nil
+	}
+
+	if err := s.setStatus(ctx, tx, payment, claimed); err != nil {
+		return nil, err
+	}
+	return payment, tx.Commit()
+}
+
+// setStatus changes the status of a locked payment
+func (s *PaymentService) setStatus(ctx context.Context, tx *sql.Tx, payment *paymentTransaction, status string) error {
+	if payment.Status == status {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE payment_transactions SET status = $1, updated_at = $2
+		WHERE id = $3
+	`, status, time.Now(), payment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mark payment transaction %s: %v", status, err)
+	}
+	payment.Status = status
+	return nil
+}
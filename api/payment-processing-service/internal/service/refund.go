@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/provider"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrPaymentNotFound       = errors.New("payment not found")
+	ErrInvalidRefund         = errors.New("invalid refund")
+	ErrNothingToRefund       = errors.New("payment has nothing left to refund")
+	ErrRefundExceedsCaptured = errors.New("refund exceeds the captured amount")
+	ErrRefundRejected        = errors.New("refund rejected by the payment provider")
+	ErrProviderUnavailable   = errors.New("payment provider unavailable")
+)
+
+// RefundRequest asks for part or all of an order's captured payment back.
+// An Amount of zero refunds whatever is left.
+type RefundRequest struct {
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason" binding:"required"`
+	Source    string  `json:"source"`
+	RequestID string  `json:"-"` // idempotency key of the refund
+}
+
+// Refund refunds part or all of an order's captured payment, as a return or
+// an admin asks. A request that repeats an earlier RequestID returns the
+// entry recorded for it with the error it failed with, and carries on with
+// it if the provider's answer was not recorded. A refund the provider rejects, or that would take the
+// refunds past the captured amount, is recorded as a failed ledger entry
+// and returned along with the error.
+func (s *PaymentService) Refund(ctx context.Context, orderID string, req RefundRequest) (*LedgerEntry, bool, error) {
+	if _, err := uuid.Parse(orderID); err != nil {
+		return nil, false, ErrPaymentNotFound
+	}
+	if req.Amount < 0 || math.IsNaN(req.Amount) || math.IsInf(req.Amount, 0) {
+		return nil, false, fmt.Errorf("%w: amount must not be negative", ErrInvalidRefund)
+	}
+	switch req.Source {
+	case "":
+		req.Source = SourceAdmin
+	case SourceAdmin, SourceReturn:
+	default:
+		return nil, false, fmt.Errorf("%w: source must be %s or %s", ErrInvalidRefund, SourceAdmin, SourceReturn)
+	}
+	if req.RequestID == "" {
+		req.RequestID = uuid.New().String()
+	}
+
+	payment, entry, cause, repeated, err := s.reserveRequestedRefund(ctx, orderID, req)
+	if entry == nil || repeated || entry.Status != EntryPending {
+		return entry, repeated, err
+	}
+
+	// The provider is called outside any transaction; a provider that
+	// cannot be reached leaves the entry pending for the request to be
+	// repeated
+	_, callErr := s.provider.Refund(ctx, payment.TransactionID, entry.Amount, entry.RequestID)
+	if callErr != nil && !isRejection(callErr) && !errors.Is(callErr, provider.ErrNotFound) {
+		return nil, false, fmt.Errorf("%w: failed to refund payment %s: %v", ErrProviderUnavailable, payment.TransactionID, callErr)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	if payment, err = s.lockTransaction(ctx, tx, orderID); err != nil {
+		return nil, false, err
+	}
+	if entry, err = ledgerEntryByRequest(ctx, tx, req.RequestID); err != nil {
+		return nil, false, err
+	}
+	if entry.Status == EntryPending {
+		if err := s.settleRefund(ctx, tx, cause, payment, entry, callErr); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	if entry.Status == EntryFailed {
+		return entry, false, ErrRefundRejected
+	}
+	return entry, false, nil
+}
+
+// reserveRequestedRefund records the pending entry of an admin or return
+// refund, or a failed one if it cannot be made, and returns it with the
+// payment and the event its follow-up events are caused by. A repeated
+// request returns the entry of the first one, still pending if the
+// provider's answer to it was not recorded.
+func (s *PaymentService) reserveRequestedRefund(ctx context.Context, orderID string, req RefundRequest) (*paymentTransaction, *LedgerEntry, shared.OrderEvent, bool, error) {
+	var cause shared.OrderEvent
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, cause, false, err
+	}
+	defer tx.Rollback()
+
+	payment, err := s.lockTransaction(ctx, tx, orderID)
+	if err == sql.ErrNoRows {
+		return nil, nil, cause, false, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, nil, cause, false, err
+	}
+
+	var userID string
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM orders WHERE id = $1", orderID).Scan(&userID)
+	if err != nil {
+		return nil, nil, cause, false, fmt.Errorf("failed to load order %s: %v", orderID, err)
+	}
+	cause = shared.OrderEvent{
+		CorrelationID: orderID,
+		OrderID:       orderID,
+		UserID:        userID,
+		TotalAmount:   payment.Amount,
+	}
+
+	// The payment lock serializes refunds of the order, so a repeated
+	// request finds the entry of the first one
+	entry, err := ledgerEntryByRequest(ctx, tx, req.RequestID)
+	if err == nil {
+		if entry.OrderID != orderID || entry.EntryType != EntryRefund {
+			return nil, nil, cause, false, fmt.Errorf("%w: request %s was used for another refund", ErrInvalidRefund, req.RequestID)
+		}
+		if entry.Status == EntryFailed {
+			return payment, entry, cause, true, refundFailure(entry)
+		}
+		return payment, entry, cause, entry.Status != EntryPending, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, cause, false, err
+	}
+
+	if payment.Status != TransactionCaptured && payment.Status != TransactionPartiallyRefunded {
+		return nil, nil, cause, false, ErrNothingToRefund
+	}
+
+	entry, refundErr := s.reserveRefund(ctx, tx, cause, payment, req)
+	if entry == nil {
+		return nil, nil, cause, false, refundErr
+	}
+	// A failed attempt is committed too, so it shows in the ledger
+	if err := tx.Commit(); err != nil {
+		return nil, nil, cause, false, err
+	}
+	return payment, entry, cause, false, refundErr
+}
+
+// reserveRefund records a pending refund of req.Amount of a captured
+// payment, or all that is left of it, for the provider to be asked for.
+// Refunds never add up to more than the captured amount, counting those
+// still pending: one that would is recorded as a failed entry with a
+// RefundFailed event and returned along with the reason it failed.
+func (s *PaymentService) reserveRefund(ctx context.Context, tx *sql.Tx, cause shared.OrderEvent, payment *paymentTransaction, req RefundRequest) (*LedgerEntry, error) {
+	reserved, err := reservedAmount(ctx, tx, payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	remaining := toCents(payment.CapturedAmount) - toCents(reserved)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	amount := toCents(req.Amount)
+	if amount == 0 {
+		amount = remaining
+	}
+
+	entry := &LedgerEntry{
+		OrderID:              cause.OrderID,
+		PaymentTransactionID: payment.ID,
+		EntryType:            EntryRefund,
+		Amount:               fromCents(amount),
+		Source:               req.Source,
+		Reason:               req.Reason,
+		RequestID:            req.RequestID,
+	}
+
+	if amount == 0 || amount > remaining {
+		failureCode := FailureExceedsBalance
+		if remaining == 0 {
+			failureCode = FailureNothingToRefund
+		}
+		refundErr := refundFailures[failureCode]
+		failure := fmt.Sprintf("%v: %.2f requested but only %.2f of %.2f captured is left to refund",
+			refundErr, entry.Amount, fromCents(remaining), payment.CapturedAmount)
+		if err := s.failRefund(ctx, tx, cause, payment, entry, failureCode, failure, ""); err != nil {
+			return nil, err
+		}
+		return entry, refundErr
+	}
+
+	log.Printf("Refunding %.2f of payment for order: %s, reason: %s", entry.Amount, cause.OrderID, req.Reason)
+
+	entry.Status = EntryPending
+	if err := addLedgerEntry(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// settleRefund records the provider's answer to a pending refund. A refund
+// the provider made marks the payment refunded, in part or in full, with a
+// RefundIssued event; one it rejected is marked failed with a RefundFailed
+// event.
+func (s *PaymentService) settleRefund(ctx context.Context, tx *sql.Tx, cause shared.OrderEvent, payment *paymentTransaction, entry *LedgerEntry, callErr error) error {
+	if callErr != nil {
+		message, code := providerError(callErr)
+		return s.failRefund(ctx, tx, cause, payment, entry, FailureDeclined, message, code)
+	}
+
+	refunded, err := refundedAmount(ctx, tx, payment.ID)
+	if err != nil {
+		return err
+	}
+	if err := settleLedgerEntry(ctx, tx, entry, EntrySucceeded, "", ""); err != nil {
+		return err
+	}
+
+	refundedTotal := toCents(refunded) + toCents(entry.Amount)
+	left := toCents(payment.CapturedAmount) - refundedTotal
+	if left < 0 {
+		left = 0
+	}
+	status := TransactionPartiallyRefunded
+	if left == 0 {
+		status = TransactionRefunded
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE payment_transactions SET status = $1, message = $2, updated_at = $3
+		WHERE id = $4
+	`, status, "Refunded: "+entry.Reason, time.Now(), payment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mark payment transaction refunded: %v", err)
+	}
+
+	return s.emit(ctx, tx, cause, shared.EventRefundIssued, map[string]interface{}{
+		"transaction_id": payment.TransactionID,
+		"refund_id":      entry.ID,
+		"payment_status": status,
+		"amount":         entry.Amount,
+		"refunded_total": fromCents(refundedTotal),
+		"remaining":      fromCents(left),
+		"reason":         entry.Reason,
+		"source":         entry.Source,
+		"message":        "Payment refunded",
+	})
+}
+
+// failRefund records a refund that did not happen for failureCode, with
+// the provider's error code if it refused the refund
+func (s *PaymentService) failRefund(ctx context.Context, tx *sql.Tx, cause shared.OrderEvent, payment *paymentTransaction, entry *LedgerEntry, failureCode, failure, code string) error {
+	log.Printf("Failed to refund payment of order %s: %s", cause.OrderID, failure)
+
+	if entry.Status == EntryPending {
+		if err := settleLedgerEntry(ctx, tx, entry, EntryFailed, failureCode, failure); err != nil {
+			return err
+		}
+	} else {
+		entry.Status = EntryFailed
+		entry.FailureCode = failureCode
+		entry.FailureReason = failure
+		if err := addLedgerEntry(ctx, tx, entry); err != nil {
+			return err
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"transaction_id": payment.TransactionID,
+		"refund_id":      entry.ID,
+		"payment_status": payment.Status,
+		"amount":         entry.Amount,
+		"reason":         entry.Reason,
+		"source":         entry.Source,
+		"message":        failure,
+	}
+	if code != "" {
+		metadata["error_code"] = code
+	}
+	return s.emit(ctx, tx, cause, shared.EventRefundFailed, metadata)
+}
+
+// refundFailures maps the failure codes of refund entries to the errors
+// their requests fail with
+var refundFailures = map[string]error{
+	FailureDeclined:        ErrRefundRejected,
+	FailureExceedsBalance:  ErrRefundExceedsCaptured,
+	FailureNothingToRefund: ErrNothingToRefund,
+}
+
+// refundFailure returns the error a failed refund entry was recorded with
+func refundFailure(entry *LedgerEntry) error {
+	if err, ok := refundFailures[entry.FailureCode]; ok {
+		return err
+	}
+	return ErrRefundRejected
+}
+
+// toCents converts an amount to whole cents, so refunds add up exactly
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func fromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var ledgerRowColumns = []string{"id", "order_id", "payment_transaction_id", "entry_type", "amount", "status", "source",
+	"reason", "failure_code", "failure_reason", "request_id", "created_at"}
+
+// expectRefundRequest expects an admin refund to lock the captured payment
+// and look up its request, which was recorded with entry if it is not nil
+func (s *testService) expectRefundRequest(status string, entry *LedgerEntry) {
+	s.mock.ExpectBegin()
+	s.expectLock(status, time.Hour)
+	s.mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM orders")).
+		WithArgs(testOrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-1"))
+	s.expectLedgerRequest(entry)
+}
+
+// expectLedgerRequest expects the entry of request-1 to be looked up
+func (s *testService) expectLedgerRequest(entry *LedgerEntry) {
+	query := s.mock.ExpectQuery(regexp.QuoteMeta("FROM payment_ledger WHERE request_id = $1")).WithArgs("request-1")
+	if entry == nil {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows(ledgerRowColumns).AddRow(entry.ID, testOrderID, "payment-1", EntryRefund,
+		entry.Amount, entry.Status, SourceAdmin, entry.Reason, entry.FailureCode, entry.FailureReason, "request-1", time.Now()))
+}
+
+// expectRefundSum expects the refunds of the payment in statuses to be
+// summed to sum
+func (s *testService) expectRefundSum(statuses string, sum float64) {
+	s.mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(amount), 0) FROM payment_ledger")).
+		WithArgs("payment-1", EntryRefund, statuses).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(sum))
+}
+
+// expectSettledRefund expects the pending refund to be looked up and
+// recorded as made, after sum was refunded before, moving the payment to
+// status
+func (s *testService) expectSettledRefund(amount, sum float64, status string) {
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCaptured, time.Hour)
+	s.expectLedgerRequest(&LedgerEntry{ID: "refund-1", Amount: amount, Status: EntryPending, Reason: "damaged"})
+	s.expectRefundSum(`{"SUCCEEDED"}`, sum)
+	s.mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_ledger SET status = $1")).
+		WithArgs(EntrySucceeded, "", "", "refund-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_transactions SET status = $1, message = $2")).
+		WithArgs(status, "Refunded: damaged", sqlmock.AnyArg(), "payment-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+}
+
+func refund(amount float64) RefundRequest {
+	return RefundRequest{Amount: amount, Reason: "damaged", RequestID: "request-1"}
+}
+
+func TestPartialRefundsAccumulate(t *testing.T) {
+	tests := []struct {
+		name      string
+		amount    float64
+		refunded  float64
+		status    string
+		total     float64
+		remaining float64
+	}{
+		{"first part", 10, 0, TransactionPartiallyRefunded, 10, 15},
+		{"second part", 10, 10, TransactionPartiallyRefunded, 20, 5},
+		{"what is left", 5, 20, TransactionRefunded, 25, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+
+			s.expectRefundRequest(TransactionPartiallyRefunded, nil)
+			s.expectRefundSum(`{"SUCCEEDED","PENDING"}`, tt.refunded)
+			s.expectLedger(EntryRefund, EntryPending, tt.amount)
+			s.mock.ExpectCommit()
+			s.expectSettledRefund(tt.amount, tt.refunded, tt.status)
+
+			entry, repeated, err := s.Refund(context.Background(), testOrderID, refund(tt.amount))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repeated || entry.Status != EntrySucceeded || entry.Amount != tt.amount {
+				t.Errorf("refund = %s of %.2f, repeated %v; want %s of %.2f", entry.Status, entry.Amount, repeated, EntrySucceeded, tt.amount)
+			}
+			if calls := fmt.Sprint(s.provider.called()); calls != "[refund request-1]" {
+				t.Errorf("provider calls = %s, want [refund request-1]", calls)
+			}
+
+			event := s.lastEvent(t)
+			if event.EventType != shared.EventRefundIssued {
+				t.Fatalf("emitted %s, want %s", event.EventType, shared.EventRefundIssued)
+			}
+			if event.Metadata["refunded_total"] != tt.total || event.Metadata["remaining"] != tt.remaining ||
+				event.Metadata["payment_status"] != tt.status {
+				t.Errorf("refunded %v with %v left, payment %v; want %.2f with %.2f left, payment %s", event.Metadata["refunded_total"],
+					event.Metadata["remaining"], event.Metadata["payment_status"], tt.total, tt.remaining, tt.status)
+			}
+		})
+	}
+}
+
+func TestRefundGuard(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		reserved float64 // refunded or being refunded
+		want     error
+	}{
+		{"more than captured", 30, 0, ErrRefundExceedsCaptured},
+		{"more than is left", 10, 20, ErrRefundExceedsCaptured},
+		{"more than pending refunds leave", 5.01, 20, ErrRefundExceedsCaptured},
+		{"the rest of nothing", 0, 25, ErrNothingToRefund},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+
+			s.expectRefundRequest(TransactionPartiallyRefunded, nil)
+			s.expectRefundSum(`{"SUCCEEDED","PENDING"}`, tt.reserved)
+			s.expectLedger(EntryRefund, EntryFailed, tt.amount)
+			s.mock.ExpectCommit()
+
+			entry, _, err := s.Refund(context.Background(), testOrderID, refund(tt.amount))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if entry == nil || entry.Status != EntryFailed {
+				t.Errorf("refund = %+v, want a failed entry", entry)
+			}
+			if calls := s.provider.called(); len(calls) != 0 {
+				t.Errorf("provider calls = %v, want none", calls)
+			}
+			if event := s.lastEvent(t); event.EventType != shared.EventRefundFailed {
+				t.Errorf("emitted %s, want %s", event.EventType, shared.EventRefundFailed)
+			}
+		})
+	}
+}
+
+func TestRefundRejected(t *testing.T) {
+	s := newTestService(t)
+	s.provider.errs["refund"] = errDeclined
+
+	s.expectRefundRequest(TransactionCaptured, nil)
+	s.expectRefundSum(`{"SUCCEEDED","PENDING"}`, 0)
+	s.expectLedger(EntryRefund, EntryPending, 10)
+	s.mock.ExpectCommit()
+	s.mock.ExpectBegin()
+	s.expectLock(TransactionCaptured, time.Hour)
+	s.expectLedgerRequest(&LedgerEntry{ID: "refund-1", Amount: 10, Status: EntryPending, Reason: "damaged"})
+	s.mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_ledger SET status = $1")).
+		WithArgs(EntryFailed, FailureDeclined, "Payment declined by bank", "refund-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectCommit()
+
+	entry, _, err := s.Refund(context.Background(), testOrderID, refund(10))
+	if !errors.Is(err, ErrRefundRejected) {
+		t.Fatalf("err = %v, want ErrRefundRejected", err)
+	}
+	if entry.Status != EntryFailed {
+		t.Errorf("refund is %s, want %s", entry.Status, EntryFailed)
+	}
+	if event := s.lastEvent(t); event.EventType != shared.EventRefundFailed {
+		t.Errorf("emitted %s, want %s", event.EventType, shared.EventRefundFailed)
+	}
+}
+
+func TestRefundProviderUnavailable(t *testing.T) {
+	s := newTestService(t)
+	s.provider.errs["refund"] = errUnavailable
+
+	// The refund stays pending until the request is repeated
+	s.expectRefundRequest(TransactionCaptured, nil)
+	s.expectRefundSum(`{"SUCCEEDED","PENDING"}`, 0)
+	s.expectLedger(EntryRefund, EntryPending, 10)
+	s.mock.ExpectCommit()
+
+	if _, _, err := s.Refund(context.Background(), testOrderID, refund(10)); !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("err = %v, want ErrProviderUnavailable", err)
+	}
+
+	s.provider.errs["refund"] = nil
+	s.expectRefundRequest(TransactionCaptured, &LedgerEntry{ID: "refund-1", Amount: 10, Status: EntryPending, Reason: "damaged"})
+	s.mock.ExpectRollback()
+	s.expectSettledRefund(10, 0, TransactionPartiallyRefunded)
+
+	entry, _, err := s.Refund(context.Background(), testOrderID, refund(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != EntrySucceeded {
+		t.Errorf("refund is %s, want %s", entry.Status, EntrySucceeded)
+	}
+	if calls := fmt.Sprint(s.provider.called()); calls != "[refund request-1 refund request-1]" {
+		t.Errorf("provider calls = %s, want the refund repeated with its key", calls)
+	}
+}
+
+func TestRepeatedRefundRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   LedgerEntry
+		wantErr error
+	}{
+		{"succeeded", LedgerEntry{Status: EntrySucceeded}, nil},
+		{"rejected by the provider", LedgerEntry{Status: EntryFailed, FailureCode: FailureDeclined,
+			FailureReason: "Payment declined by bank"}, ErrRefundRejected},
+		{"exceeding the captured amount", LedgerEntry{Status: EntryFailed, FailureCode: FailureExceedsBalance,
+			FailureReason: "30.00 requested but only 25.00 of 25.00 captured is left to refund"}, ErrRefundExceedsCaptured},
+		{"with nothing left", LedgerEntry{Status: EntryFailed, FailureCode: FailureNothingToRefund,
+			FailureReason: "0.00 requested but only 0.00 of 25.00 captured is left to refund"}, ErrNothingToRefund},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			tt.entry.ID, tt.entry.Amount = "refund-1", 10
+
+			// The first request's outcome is returned without calling the
+			// provider again
+			s.expectRefundRequest(TransactionRefunded, &tt.entry)
+			s.mock.ExpectRollback()
+
+			entry, repeated, err := s.Refund(context.Background(), testOrderID, refund(10))
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !repeated || entry.ID != "refund-1" {
+				t.Errorf("refund = %s, repeated %v; want refund-1 repeated", entry.ID, repeated)
+			}
+			if calls := s.provider.called(); len(calls) != 0 {
+				t.Errorf("provider calls = %v, want none", calls)
+			}
+		})
+	}
+}
@@ -1,20 +1,43 @@
 package service
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
 	"time"
 
 	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+	"go-rabbitmq-order-system/payment-processing-service/internal/provider"
 	"go-rabbitmq-order-system/shared"
 
 	"github.com/google/uuid"
 )
 
+// Payment transaction statuses. An authorized payment is captured when the
+// order ships, or voided or left to expire when it does not; one whose
+// capture failed still holds the authorization until it is voided or
+// expires. A captured payment may then be refunded in parts. While the provider is asked to
+// capture, void or expire a payment it is CAPTURING, VOIDING or EXPIRING.
+const (
+	TransactionAuthorized        = "AUTHORIZED"
+	TransactionFailed            = "FAILED"
+	TransactionCapturing         = "CAPTURING"
+	TransactionCaptured          = "CAPTURED"
+	TransactionCaptureFailed     = "CAPTURE_FAILED"
+	TransactionVoiding           = "VOIDING"
+	TransactionVoided            = "VOIDED"
+	TransactionExpiring          = "EXPIRING"
+	TransactionExpired           = "EXPIRED"
+	TransactionPartiallyRefunded = "PARTIALLY_REFUNDED"
+	TransactionRefunded          = "REFUNDED"
+)
+
 type PaymentService struct {
 	db       *sql.DB
-	rabbitMQ *shared.RabbitMQ
+	outbox   shared.EventOutbox
+	provider provider.PaymentProvider
 	config   *config.PaymentGatewayConfig
 }
 
@@ -23,112 +46,158 @@ type PaymentResult struct {
 	TransactionID string `json:"transaction_id"`
 	Method        string `json:"method"`
 	Message       string `json:"message"`
+	Code          string `json:"code,omitempty"` // the provider's error code of a failed payment
 }
 
-func New(db *sql.DB, rabbitMQ *shared.RabbitMQ, config *config.PaymentGatewayConfig) *PaymentService {
+func New(db *sql.DB, outbox shared.EventOutbox, paymentProvider provider.PaymentProvider, config *config.PaymentGatewayConfig) *PaymentService {
 	return &PaymentService{
 		db:       db,
-		rabbitMQ: rabbitMQ,
+		outbox:   outbox,
+		provider: paymentProvider,
 		config:   config,
 	}
 }
 
-func (s *PaymentService) HandleOrderEvent(event shared.OrderEvent) error {
+// HandleOrderEvent handles an event in the inbox transaction that marks it
+// as processed, recording the provider's answer to the call
+// PrepareOrderEvent made for it. A redelivered OrderCreated is never
+// authorized twice and a redelivered capture or refund request never moves
+// money twice.
+func (s *PaymentService) HandleOrderEvent(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
 	log.Printf("Received event: %s for order: %s", event.EventType, event.OrderID)
 
-	if event.EventType != shared.EventOrderCreated {
+	switch event.EventType {
+	case shared.EventOrderCreated:
+		return s.processPayment(ctx, tx, event)
+	case shared.EventOrderReadyForShipping, shared.EventOrderShipped:
+		if event.EventType != s.config.CaptureEvent {
+			return nil
+		}
+		return s.capturePayment(ctx, tx, event)
+	case shared.EventPaymentRefundRequested:
+		return s.releasePayment(ctx, tx, event)
+	default:
 		return nil
 	}
-
-	return s.processPayment(event)
 }
 
-func (s *PaymentService) processPayment(event shared.OrderEvent) error {
-	log.Printf("Processing payment for order: %s, amount: %.2f", event.OrderID, event.TotalAmount)
-
-	// Simulate payment processing
-	result := s.simulatePayment(event.TotalAmount)
-
-	// Store payment transaction
-	err := s.storePaymentTransaction(event.OrderID, event.TotalAmount, result)
-	if err != nil {
-		log.Printf("Failed to store payment transaction: %v", err)
-		return err
+// processPayment records the authorization of the order's amount. The
+// payment is only captured once the order ships, so an order that fails
+// later never charges the customer.
+func (s *PaymentService) processPayment(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
+	call, ok := preparedCall(ctx)
+	if !ok {
+		return fmt.Errorf("%w: authorization of order %s", errNotPrepared, event.OrderID)
 	}
+	result := authorizationResult(event, call)
 
-	// Publish payment result event
-	var eventType string
+	// Build payment result event
+	var eventType, status string
 	if result.Success {
-		eventType = shared.EventPaymentSuccessful
+		eventType, status = shared.EventPaymentSuccessful, TransactionAuthorized
 	} else {
-		eventType = shared.EventPaymentFailed
-	}
-
-	resultEvent := shared.OrderEvent{
-		EventType:   eventType,
-		OrderID:     event.OrderID,
-		UserID:      event.UserID,
-		TotalAmount: event.TotalAmount,
-		Status:      eventType,
-		Timestamp:   time.Now(),
-		Metadata: map[string]interface{}{
-			"transaction_id": result.TransactionID,
-			"payment_method": result.Method,
-			"message":        result.Message,
-		},
+		eventType, status = shared.EventPaymentFailed, TransactionFailed
 	}
 
-	return s.rabbitMQ.PublishEvent(resultEvent)
-}
-
-func (s *PaymentService) simulatePayment(amount float64) PaymentResult {
-	// Simulate processing time
-	time.Sleep(time.Duration(s.config.ProcessingDelayMS) * time.Millisecond)
-
-	// Random payment methods
-	methods := []string{"credit_card", "debit_card", "bank_transfer", "digital_wallet"}
-	method := methods[rand.Intn(len(methods))]
+	now := time.Now()
+	expiresAt := now.Add(s.config.AuthorizationTTL)
 
-	// Generate transaction ID
-	transactionID := "TXN_" + uuid.New().String()[:8]
-
-	// Simulate payment success/failure based on config
-	success := rand.Float64() < s.config.SuccessRate
+	resultEvent := event.FollowUp(eventType)
+	resultEvent.Status = eventType
+	resultEvent.Metadata = map[string]interface{}{
+		"transaction_id": result.TransactionID,
+		"payment_method": result.Method,
+		"payment_status": status,
+		"message":        result.Message,
+	}
+	if result.Success {
+		resultEvent.Metadata["authorization_expires_at"] = expiresAt.Format(time.RFC3339)
+	}
+	if result.Code != "" {
+		resultEvent.Metadata["error_code"] = result.Code
+	}
 
-	var message string
-	if success {
-		message = "Payment processed successfully"
-	} else {
-		failureReasons := []string{
-			"Insufficient funds",
-			"Card expired",
-			"Payment declined by bank",
-			"Network timeout",
-			"Invalid payment details",
+	// Store the transaction and the result event together
+	paymentID := uuid.New().String()
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_transactions (id, order_id, amount, status, transaction_id, payment_method, message,
+			authorized_at, authorization_expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+	`, paymentID, event.OrderID, event.TotalAmount, status, result.TransactionID, result.Method, result.Message,
+		nullTime(result.Success, now), nullTime(result.Success, expiresAt), now)
+	if err != nil {
+		return fmt.Errorf("failed to store payment transaction: %v", err)
+	}
+	if result.Success {
+		err := addLedgerEntry(ctx, tx, &LedgerEntry{
+			OrderID:              event.OrderID,
+			PaymentTransactionID: paymentID,
+			EntryType:            EntryAuthorization,
+			Amount:               event.TotalAmount,
+			Status:               EntrySucceeded,
+			Source:               SourceCheckout,
+		})
+		if err != nil {
+			return err
 		}
-		message = failureReasons[rand.Intn(len(failureReasons))]
 	}
 
-	log.Printf("Payment simulation: Amount=%.2f, Method=%s, Success=%t, Message=%s", amount, method, success, message)
+	return s.outbox.Add(ctx, tx, resultEvent)
+}
 
-	return PaymentResult{
-		Success:       success,
-		TransactionID: transactionID,
-		Method:        method,
-		Message:       message,
+// authorize asks the provider to authorize the order's amount. A declined
+// or rejected payment is answered with the rejection; a provider that
+// cannot be reached is an error, so the event is retried with the same
+// idempotency key.
+func (s *PaymentService) authorize(ctx context.Context, event shared.OrderEvent) (context.Context, error) {
+	log.Printf("Authorizing payment for order: %s, amount: %.2f", event.OrderID, event.TotalAmount)
+
+	transaction, err := s.provider.Authorize(ctx, provider.AuthorizeRequest{
+		OrderID:        event.OrderID,
+		UserID:         event.UserID,
+		Amount:         event.TotalAmount,
+		Currency:       s.config.Currency,
+		IdempotencyKey: event.EventID + ":authorize",
+	})
+	if err != nil && !isRejection(err) {
+		return ctx, fmt.Errorf("payment provider failed for order %s: %v", event.OrderID, err)
 	}
+	return withProviderCall(ctx, transaction, err), nil
 }
 
-func (s *PaymentService) storePaymentTransaction(orderID string, amount float64, result PaymentResult) error {
-	status := "FAILED"
-	if result.Success {
-		status = "SUCCESS"
+// authorizationResult turns the provider's answer to an authorization into
+// the payment result
+func authorizationResult(event shared.OrderEvent, call providerCall) PaymentResult {
+	if call.err != nil {
+		var result PaymentResult
+		result.Message, result.Code = providerError(call.err)
+		log.Printf("Payment for order %s failed: %v", event.OrderID, call.err)
+		return result
 	}
+	return PaymentResult{
+		Success:       true,
+		TransactionID: call.transaction.ID,
+		Method:        call.transaction.Method,
+		Message:       "Payment authorized",
+	}
+}
+
+// isRejection reports whether the provider refused an operation for good,
+// as opposed to being unavailable
+func isRejection(err error) bool {
+	return errors.Is(err, provider.ErrDeclined) || errors.Is(err, provider.ErrInvalidRequest)
+}
 
-	_, err := s.db.Exec(`
-		INSERT INTO payment_transactions (id, order_id, amount, status, transaction_id, payment_method, message, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`, uuid.New().String(), orderID, amount, status, result.TransactionID, result.Method, result.Message, time.Now())
+// providerError returns the message and code of a provider error
+func providerError(err error) (string, string) {
+	var providerErr *provider.Error
+	if errors.As(err, &providerErr) {
+		return providerErr.Message, providerErr.Code
+	}
+	return err.Error(), ""
+}
 
-	return err
-} 
\ No newline at end of file
+// nullTime returns t if set, or NULL
+func nullTime(set bool, t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: set}
+}
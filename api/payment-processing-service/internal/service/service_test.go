@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+	"go-rabbitmq-order-system/payment-processing-service/internal/provider"
+	"go-rabbitmq-order-system/shared"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeProvider records the calls made to it and answers each operation with
+// the error set for it, or a transaction
+type fakeProvider struct {
+	mu    sync.Mutex
+	calls []string // operation and idempotency key
+	errs  map[string]error
+}
+
+func (p *fakeProvider) answer(operation, transactionID, idempotencyKey string, amount float64) (*provider.Transaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, operation+" "+idempotencyKey)
+	if err := p.errs[operation]; err != nil {
+		return nil, err
+	}
+	return &provider.Transaction{ID: transactionID, Amount: amount, Method: "credit_card"}, nil
+}
+
+func (p *fakeProvider) Authorize(ctx context.Context, req provider.AuthorizeRequest) (*provider.Transaction, error) {
+	return p.answer("authorize", "TXN_1", req.IdempotencyKey, req.Amount)
+}
+
+func (p *fakeProvider) Capture(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*provider.Transaction, error) {
+	return p.answer("capture", transactionID, idempotencyKey, amount)
+}
+
+func (p *fakeProvider) Void(ctx context.Context, transactionID string, idempotencyKey string) (*provider.Transaction, error) {
+	return p.answer("void", transactionID, idempotencyKey, 0)
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, transactionID string, amount float64, idempotencyKey string) (*provider.Transaction, error) {
+	return p.answer("refund", transactionID, idempotencyKey, amount)
+}
+
+func (p *fakeProvider) Status(ctx context.Context, transactionID string) (*provider.Transaction, error) {
+	return p.answer("status", transactionID, "", 0)
+}
+
+func (p *fakeProvider) called() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.calls...)
+}
+
+// testOrderID is the order the tests pay for
+const testOrderID = "7d3a5c1e-2b4f-4e8a-9c6d-1f2e3a4b5c6d"
+
+var (
+	errDeclined     = &provider.Error{Code: "card_declined", Message: "Payment declined by bank", Err: provider.ErrDeclined}
+	errUnavailable  = &provider.Error{Message: "connection refused", Err: provider.ErrUnavailable}
+	errNotFound     = &provider.Error{Code: "not_found", Message: "TXN_1", Err: provider.ErrNotFound}
+	errUnauthorized = &provider.Error{Message: "Unauthorized", Err: provider.ErrUnauthorized}
+)
+
+type testService struct {
+	*PaymentService
+	mock     sqlmock.Sqlmock
+	provider *fakeProvider
+	outbox   *shared.MemoryOutbox
+}
+
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	fake := &fakeProvider{errs: make(map[string]error)}
+	outbox := shared.NewMemoryOutbox("payment-processing")
+	s := New(db, outbox, fake, &config.PaymentGatewayConfig{
+		Currency:         "EUR",
+		CaptureEvent:     shared.EventOrderShipped,
+		AuthorizationTTL: time.Hour,
+		ExpiryBatchSize:  10,
+	})
+	return &testService{PaymentService: s, mock: mock, provider: fake, outbox: outbox}
+}
+
+// handle prepares the event and handles it in a transaction, as the broker
+// does
+func (s *testService) handle(event shared.OrderEvent) error {
+	ctx, err := s.PrepareOrderEvent(context.Background(), event)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.HandleOrderEvent(ctx, tx, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// emitted returns the types of the events added to the outbox
+func (s *testService) emitted() []string {
+	var eventTypes []string
+	for _, event := range s.outbox.Events() {
+		eventTypes = append(eventTypes, event.EventType)
+	}
+	return eventTypes
+}
+
+// lastEvent returns the last event added to the outbox
+func (s *testService) lastEvent(t *testing.T) shared.OrderEvent {
+	t.Helper()
+	events := s.outbox.Events()
+	if len(events) == 0 {
+		t.Fatal("no event was emitted")
+	}
+	return events[len(events)-1]
+}
+
+// expectLock expects the order's payment to be locked and returns it with
+// status, expiring in expiresIn
+func (s *testService) expectLock(status string, expiresIn time.Duration) {
+	s.mock.ExpectQuery(regexp.QuoteMeta("FROM payment_transactions")).
+		WithArgs(testOrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "amount", "captured_amount", "status", "authorization_expires_at"}).
+			AddRow("payment-1", "TXN_1", 25.0, capturedAmount(status), status, time.Now().Add(expiresIn)))
+}
+
+func capturedAmount(status string) float64 {
+	switch status {
+	case TransactionCaptured, TransactionPartiallyRefunded, TransactionRefunded:
+		return 25
+	}
+	return 0
+}
+
+// expectStatus expects the payment to be moved to status
+func (s *testService) expectStatus(status string) {
+	s.mock.ExpectExec(regexp.QuoteMeta("UPDATE payment_transactions SET status = $1, updated_at = $2")).
+		WithArgs(status, sqlmock.AnyArg(), "payment-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectLedger expects a ledger entry of entryType with status
+func (s *testService) expectLedger(entryType, status string, amount float64) {
+	s.mock.ExpectExec(regexp.QuoteMeta("INSERT INTO payment_ledger")).
+		WithArgs(sqlmock.AnyArg(), testOrderID, sqlmock.AnyArg(), entryType, amount, status,
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func orderCreated() shared.OrderEvent {
+	return shared.OrderEvent{EventID: "event-1", EventType: shared.EventOrderCreated, OrderID: testOrderID, UserID: "user-1", TotalAmount: 25}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		status    string
+		eventType string
+	}{
+		{"authorized", nil, TransactionAuthorized, shared.EventPaymentSuccessful},
+		{"declined", errDeclined, TransactionFailed, shared.EventPaymentFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			s.provider.errs["authorize"] = tt.err
+
+			s.mock.ExpectBegin()
+			s.mock.ExpectExec(regexp.QuoteMeta("INSERT INTO payment_transactions")).
+				WithArgs(sqlmock.AnyArg(), testOrderID, 25.0, tt.status, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+					sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			if tt.err == nil {
+				s.expectLedger(EntryAuthorization, EntrySucceeded, 25)
+			}
+			s.mock.ExpectCommit()
+
+			if err := s.handle(orderCreated()); err != nil {
+				t.Fatal(err)
+			}
+			if calls := s.provider.called(); len(calls) != 1 || calls[0] != "authorize event-1:authorize" {
+				t.Errorf("provider calls = %v, want one authorization keyed by the event", calls)
+			}
+			event := s.lastEvent(t)
+			if event.EventType != tt.eventType || event.Metadata["payment_status"] != tt.status {
+				t.Errorf("emitted %s with status %v, want %s with %s", event.EventType, event.Metadata["payment_status"], tt.eventType, tt.status)
+			}
+		})
+	}
+}
+
+func TestAuthorizeProviderUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"unavailable", errUnavailable},
+		{"credentials refused", errUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			s.provider.errs["authorize"] = tt.err
+
+			// Nothing is stored, so the event is retried
+			if err := s.handle(orderCreated()); err == nil {
+				t.Fatal("handled the event without an answer from the provider")
+			}
+			if events := s.emitted(); len(events) != 0 {
+				t.Errorf("emitted %v, want nothing", events)
+			}
+		})
+	}
+}
+
+func TestHandleUnpreparedEvent(t *testing.T) {
+	s := newTestService(t)
+	s.mock.ExpectBegin()
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mock.ExpectRollback()
+	defer tx.Rollback()
+
+	err = s.HandleOrderEvent(context.Background(), tx, orderCreated())
+	if !errors.Is(err, errNotPrepared) {
+		t.Errorf("err = %v, want errNotPrepared", err)
+	}
+	if calls := s.provider.called(); len(calls) != 0 {
+		t.Errorf("provider calls = %v, want none", calls)
+	}
+}
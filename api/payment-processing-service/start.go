@@ -0,0 +1,22 @@
+// Package payment starts the payment processing service with its configuration from the
+// environment, for tests that run the services in one process.
+package payment
+
+import (
+	"context"
+	"database/sql"
+
+	"go-rabbitmq-order-system/payment-processing-service/internal/app"
+	"go-rabbitmq-order-system/payment-processing-service/internal/config"
+	"go-rabbitmq-order-system/shared"
+)
+
+// Start starts the service on db and broker, storing its events in outbox,
+// until ctx ends. It does not block.
+func Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	return app.New(cfg).Start(ctx, db, broker, outbox)
+}
@@ -56,11 +56,18 @@ func (am *AuthMiddleware) ValidateToken(next http.HandlerFunc) http.HandlerFunc
 }
 
 func (am *AuthMiddleware) validateTokenWithAuthService(token string) bool {
+	_, ok := am.Authenticate(token)
+	return ok
+}
+
+// Authenticate validates token with the auth service and returns the ID of
+// the user it was issued to
+func (am *AuthMiddleware) Authenticate(token string) (string, bool) {
 	client := &http.Client{}
 	
 	req, err := http.NewRequest("POST", am.authServiceURL+"/auth/validate", nil)
 	if err != nil {
-		return false
+		return "", false
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
@@ -68,18 +75,21 @@ func (am *AuthMiddleware) validateTokenWithAuthService(token string) bool {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return false
+		return "", false
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return false
+		return "", false
 	}
 
 	var authResp AuthResponse
 	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
-		return false
+		return "", false
 	}
 
-	return authResp.Success && authResp.Data.Valid
+	if !authResp.Success || !authResp.Data.Valid {
+		return "", false
+	}
+	return authResp.Data.UserID, true
 } 
\ No newline at end of file
@@ -9,6 +9,14 @@ import (
 	"github.com/google/uuid"
 )
 
+// HeaderAdminRequest marks a request the gateway has authenticated as an
+// admin. The gateway strips it from every other proxied request.
+const HeaderAdminRequest = "X-Admin-Request"
+
+// HeaderUserID carries the ID of the user the gateway authenticated the
+// request for. The gateway strips it from requests it did not authenticate.
+const HeaderUserID = "X-User-ID"
+
 // CORS middleware with configurable origins
 func CORS(allowedOrigins ...string) gin.HandlerFunc {
 	origins := "*"
@@ -0,0 +1,165 @@
+// Package sagatest runs the order saga end to end: the services consuming
+// events are started in one process on a MemoryBroker, each with a
+// MemoryOutbox, against the Postgres database in TEST_DATABASE_URL. Without
+// it the tests are skipped.
+package sagatest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	orchestrator "go-rabbitmq-order-system/order-orchestrator-service"
+	orderstatus "go-rabbitmq-order-system/order-status-service"
+	payment "go-rabbitmq-order-system/payment-processing-service"
+	"go-rabbitmq-order-system/shared"
+	"go-rabbitmq-order-system/shared/testdb"
+	shipping "go-rabbitmq-order-system/shipping-service"
+	stock "go-rabbitmq-order-system/stock-reservation-service"
+
+	"github.com/google/uuid"
+)
+
+// services lists the services consuming events with the producer name each
+// records on its events and the queue it consumes
+var services = []struct {
+	name  string
+	queue string
+	start func(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error
+}{
+	{"order-orchestrator", shared.OrchestratorQueue, orchestrator.Start},
+	{"payment-processing", shared.PaymentQueue, payment.Start},
+	{"stock-reservation", shared.StockReservationQueue, stock.Start},
+	{"shipping", shared.ShippingQueue, shipping.Start},
+	{"order-status", shared.OrderStatusQueue, orderstatus.Start},
+}
+
+// startServices starts every service on a new MemoryBroker until the test
+// ends and returns the broker
+func startServices(t *testing.T, db *sql.DB) *shared.MemoryBroker {
+	t.Helper()
+	t.Setenv("PAYMENT_SIMULATOR_DELAY_MS", "0")
+	t.Setenv("PAYMENT_CAPTURE_EVENT", shared.EventOrderShipped)
+	t.Setenv("SHIPPING_PROCESSING_DELAY", "0s")
+	t.Setenv("SHIPPING_DISPATCH_INTERVAL", "50ms")
+
+	broker := shared.NewMemoryBroker(
+		shared.RetryPolicy{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond},
+		func(queueName string) shared.EventInbox { return shared.NewInbox(db, queueName) },
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		broker.Shutdown(shutdownCtx)
+	})
+
+	for _, svc := range services {
+		producer := broker.ForProducer(svc.name)
+		if err := svc.start(ctx, db, producer, shared.NewMemoryOutbox(svc.name)); err != nil {
+			t.Fatalf("failed to start %s: %v", svc.name, err)
+		}
+	}
+	return broker
+}
+
+// placeOrder stores an order for quantity units of a new product with stock
+// units in stock and publishes its OrderCreated event
+func placeOrder(t *testing.T, db *sql.DB, broker *shared.MemoryBroker, stock, quantity int) string {
+	t.Helper()
+	productID, orderID, userID := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	price := 25.0
+	item := shared.OrderItem{
+		ID:        uuid.New().String(),
+		OrderID:   orderID,
+		ProductID: productID,
+		Quantity:  quantity,
+		Price:     price,
+	}
+	total := price * float64(quantity)
+
+	_, err := db.Exec("INSERT INTO products (id, name, price, stock_quantity) VALUES ($1, $2, $3, $4)",
+		productID, "Saga test product", price, stock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO orders (id, user_id, total_amount, status) VALUES ($1, $2, $3, $4)",
+		orderID, userID, total, shared.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO order_items (id, order_id, product_id, quantity, price) VALUES ($1, $2, $3, $4, $5)",
+		item.ID, orderID, productID, quantity, price)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = broker.ForProducer("order-creation").PublishEvent(context.Background(), shared.OrderEvent{
+		EventType:   shared.EventOrderCreated,
+		OrderID:     orderID,
+		UserID:      userID,
+		TotalAmount: total,
+		Items:       []shared.OrderItem{item},
+		Status:      shared.StatusCreated,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orderID
+}
+
+// waitForStatus waits for the order to reach one of the final statuses and
+// returns the status it reached
+func waitForStatus(t *testing.T, db *sql.DB, orderID string) string {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var status string
+		if err := db.QueryRow("SELECT status FROM orders WHERE id = $1", orderID).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status == shared.StatusShipped || status == shared.StatusCancelled {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %s is still %s", orderID, status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSaga(t *testing.T) {
+	db := testdb.Open(t, "order_sagas")
+
+	tests := []struct {
+		name        string
+		successRate string
+		stock       int
+		quantity    int
+		want        string
+	}{
+		{"order ships", "1", 5, 2, shared.StatusShipped},
+		{"payment declined", "0", 5, 2, shared.StatusCancelled},
+		{"stock insufficient", "1", 1, 2, shared.StatusCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PAYMENT_SIMULATOR_SUCCESS_RATE", tt.successRate)
+			broker := startServices(t, db)
+
+			orderID := placeOrder(t, db, broker, tt.stock, tt.quantity)
+			if status := waitForStatus(t, db, orderID); status != tt.want {
+				t.Errorf("order %s ended %s, want %s", orderID, status, tt.want)
+			}
+
+			for _, svc := range services {
+				if parked := broker.Parked(svc.queue); len(parked) > 0 {
+					t.Errorf("%s parked %d events", svc.name, len(parked))
+				}
+			}
+		})
+	}
+}
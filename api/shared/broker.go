@@ -0,0 +1,33 @@
+package shared
+
+import "context"
+
+// Publisher publishes order events to the exchange
+type Publisher interface {
+	PublishEvent(ctx context.Context, event OrderEvent) error
+}
+
+// Subscriber declares service queues and consumes events from them
+type Subscriber interface {
+	SetupQueue(queueName string) error
+	ConsumeEvents(ctx context.Context, queueName string, handler TxHandler) error
+	// ConsumePreparedEvents consumes like ConsumeEvents, running prepare
+	// for each event before the handler's transaction
+	ConsumePreparedEvents(ctx context.Context, queueName string, prepare PrepareFunc, handler TxHandler) error
+}
+
+// Broker is the message broker as used by the services. It is implemented
+// by the AMQP client and by the in-process MemoryBroker.
+type Broker interface {
+	Publisher
+	Subscriber
+	SetupExchange() error
+	State() ConnectionState
+	Shutdown(ctx context.Context) error
+	Close()
+}
+
+var (
+	_ Broker = (*RabbitMQ)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+)
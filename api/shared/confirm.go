@@ -0,0 +1,222 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// Reasons a publish can fail after it was handed to the broker
+var (
+	ErrPublishNacked  = errors.New("broker nacked the message")
+	ErrUnroutable     = errors.New("message was returned as unroutable")
+	ErrPublishTimeout = errors.New("timed out waiting for publisher confirm")
+	ErrConnectionLost = errors.New("connection lost before publisher confirm")
+)
+
+// PublishError describes a publish that was not confirmed by the broker.
+// Use errors.Is with ErrNotConnected, ErrPublishNacked, ErrUnroutable,
+// ErrPublishTimeout or ErrConnectionLost to find out why.
+type PublishError struct {
+	Exchange   string
+	RoutingKey string
+	MessageID  string
+	Reason     string
+	Err        error
+}
+
+func (e *PublishError) Error() string {
+	msg := fmt.Sprintf("failed to publish %s to exchange %q: %v", e.RoutingKey, e.Exchange, e.Err)
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	}
+	return msg
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// confirmPublisher publishes mandatory messages on a channel in confirm mode
+// and waits for the broker to ack, nack or return each one
+type confirmPublisher struct {
+	ch *amqp.Channel
+
+	mu      sync.Mutex // serialises publishes so delivery tags stay in order
+	nextTag uint64
+
+	pendingMu sync.Mutex
+	pending   map[uint64]*pendingConfirm
+	returned  map[string]amqp.Return // keyed by message ID
+
+	done chan struct{}
+}
+
+type pendingConfirm struct {
+	messageID string
+	result    chan error
+}
+
+// newConfirmPublisher puts the channel in confirm mode and starts
+// dispatching confirmations
+func newConfirmPublisher(ch *amqp.Channel) (*confirmPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+
+	p := &confirmPublisher{
+		ch:       ch,
+		pending:  make(map[uint64]*pendingConfirm),
+		returned: make(map[string]amqp.Return),
+		done:     make(chan struct{}),
+	}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 128))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 128))
+	go p.dispatch(confirms, returns)
+
+	return p, nil
+}
+
+// publish sends a mandatory message and blocks until the broker confirms it
+// or the context ends
+func (p *confirmPublisher) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.New().String()
+	}
+	pending := &pendingConfirm{messageID: msg.MessageId, result: make(chan error, 1)}
+
+	p.mu.Lock()
+	tag := p.nextTag + 1
+	p.pendingMu.Lock()
+	p.pending[tag] = pending
+	p.pendingMu.Unlock()
+
+	err := p.ch.Publish(exchange, routingKey, true, false, msg)
+	if err != nil {
+		p.pendingMu.Lock()
+		delete(p.pending, tag)
+		p.pendingMu.Unlock()
+		p.mu.Unlock()
+		return &PublishError{Exchange: exchange, RoutingKey: routingKey, MessageID: msg.MessageId, Reason: err.Error(), Err: ErrConnectionLost}
+	}
+	p.nextTag = tag
+	p.mu.Unlock()
+
+	select {
+	case err = <-pending.result:
+	case <-p.done:
+		err = ErrConnectionLost
+	case <-ctx.Done():
+		p.pendingMu.Lock()
+		delete(p.pending, tag)
+		p.pendingMu.Unlock()
+		err = ErrPublishTimeout
+	}
+	if err == nil {
+		return nil
+	}
+
+	publishErr := &PublishError{Exchange: exchange, RoutingKey: routingKey, MessageID: msg.MessageId, Err: err}
+	var returnErr *returnedError
+	if errors.As(err, &returnErr) {
+		publishErr.Err = ErrUnroutable
+		publishErr.Reason = returnErr.ret.ReplyText
+	}
+	return publishErr
+}
+
+// returnedError carries the broker's basic.return for an unroutable message
+type returnedError struct {
+	ret amqp.Return
+}
+
+func (e *returnedError) Error() string {
+	return ErrUnroutable.Error()
+}
+
+// dispatch matches confirmations to pending publishes. The broker sends
+// basic.return before the ack of an unroutable message, so returns are
+// drained before each confirmation is resolved.
+func (p *confirmPublisher) dispatch(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	defer p.failPending()
+
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.recordReturn(ret)
+		case confirm, ok := <-confirms:
+			if !ok {
+				return
+			}
+			p.drainReturns(returns)
+			p.resolve(confirm)
+		}
+	}
+}
+
+func (p *confirmPublisher) drainReturns(returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			p.recordReturn(ret)
+		default:
+			return
+		}
+	}
+}
+
+func (p *confirmPublisher) recordReturn(ret amqp.Return) {
+	p.pendingMu.Lock()
+	p.returned[ret.MessageId] = ret
+	p.pendingMu.Unlock()
+}
+
+func (p *confirmPublisher) resolve(confirm amqp.Confirmation) {
+	p.pendingMu.Lock()
+	pending, ok := p.pending[confirm.DeliveryTag]
+	delete(p.pending, confirm.DeliveryTag)
+	var ret amqp.Return
+	var wasReturned bool
+	if ok {
+		ret, wasReturned = p.returned[pending.messageID]
+		delete(p.returned, pending.messageID)
+	}
+	p.pendingMu.Unlock()
+
+	if !ok {
+		return // the publisher gave up waiting
+	}
+
+	switch {
+	case !confirm.Ack:
+		pending.result <- ErrPublishNacked
+	case wasReturned:
+		pending.result <- &returnedError{ret: ret}
+	default:
+		pending.result <- nil
+	}
+}
+
+// failPending fails every publish still waiting when the channel closes
+func (p *confirmPublisher) failPending() {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	for tag, pending := range p.pending {
+		pending.result <- ErrConnectionLost
+		delete(p.pending, tag)
+	}
+	close(p.done)
+}
@@ -0,0 +1,295 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrNotConnected is returned when the broker stays unreachable for longer
+// than the publish wait timeout
+var ErrNotConnected = errors.New("not connected to RabbitMQ")
+
+// ConnectionState describes the state of the RabbitMQ connection
+type ConnectionState string
+
+const (
+	StateConnected    ConnectionState = "connected"
+	StateReconnecting ConnectionState = "reconnecting"
+	StateClosed       ConnectionState = "closed"
+)
+
+// StateHook is called whenever the connection state changes. err holds the
+// reason the connection was lost or the last failed reconnect attempt.
+type StateHook func(state ConnectionState, err error)
+
+// WithStateHook registers a callback for connection state changes
+func WithStateHook(hook StateHook) Option {
+	return func(r *RabbitMQ) {
+		r.stateHooks = append(r.stateHooks, hook)
+	}
+}
+
+// WithReconnectBackoff sets the initial and maximum delay between reconnect attempts
+func WithReconnectBackoff(initial, max time.Duration) Option {
+	return func(r *RabbitMQ) {
+		r.reconnectDelay = initial
+		r.maxReconnectDelay = max
+	}
+}
+
+// WithPublishTimeout sets how long PublishEvent waits for the broker to
+// confirm a message when the caller's context has no deadline
+func WithPublishTimeout(timeout time.Duration) Option {
+	return func(r *RabbitMQ) {
+		r.publishTimeout = timeout
+	}
+}
+
+// WithPublishWait sets how long PublishEvent waits for a lost connection to
+// come back before failing with ErrNotConnected
+func WithPublishWait(wait time.Duration) Option {
+	return func(r *RabbitMQ) {
+		r.publishWait = wait
+	}
+}
+
+// State returns the current connection state
+func (r *RabbitMQ) State() ConnectionState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+// channel returns the current AMQP channel, or nil while disconnected
+func (r *RabbitMQ) channel() *amqp.Channel {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ch
+}
+
+// publisher returns the current confirm publisher, or nil while disconnected
+func (r *RabbitMQ) publisher() *confirmPublisher {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pub
+}
+
+// waitForChannel returns the current channel, waiting up to the publish
+// wait timeout if the client is reconnecting
+func (r *RabbitMQ) waitForChannel() (*amqp.Channel, error) {
+	if !r.waitConnected() {
+		return nil, ErrNotConnected
+	}
+	if ch := r.channel(); ch != nil {
+		return ch, nil
+	}
+	return nil, ErrNotConnected
+}
+
+// waitForPublisher returns the current confirm publisher, waiting up to the
+// publish wait timeout if the client is reconnecting
+func (r *RabbitMQ) waitForPublisher() (*confirmPublisher, error) {
+	if !r.waitConnected() {
+		return nil, ErrNotConnected
+	}
+	if pub := r.publisher(); pub != nil {
+		return pub, nil
+	}
+	return nil, ErrNotConnected
+}
+
+func (r *RabbitMQ) waitConnected() bool {
+	r.mu.RLock()
+	connected, state := r.connected, r.state
+	r.mu.RUnlock()
+
+	switch state {
+	case StateClosed:
+		return false
+	case StateConnected:
+		return true
+	}
+
+	select {
+	case <-connected:
+		return true
+	case <-time.After(r.publishWait):
+	case <-r.closed:
+	}
+	return false
+}
+
+// connect dials the broker and opens a channel for topology and consumers
+// and a second one in confirm mode for publishing
+func (r *RabbitMQ) connect() (*amqp.Connection, *amqp.Channel, *confirmPublisher, error) {
+	conn, err := amqp.Dial(r.url)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+
+	pubCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to open a publishing channel: %v", err)
+	}
+
+	pub, err := newConfirmPublisher(pubCh)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	return conn, ch, pub, nil
+}
+
+// setConnected installs a new connection and notifies everyone waiting for it
+func (r *RabbitMQ) setConnected(conn *amqp.Connection, ch *amqp.Channel, pub *confirmPublisher) {
+	r.mu.Lock()
+	r.conn = conn
+	r.ch = ch
+	r.pub = pub
+	r.state = StateConnected
+	close(r.connected)
+	r.mu.Unlock()
+
+	r.notifyState(StateConnected, nil)
+	go r.watch(conn, ch, pub.ch)
+}
+
+// watch waits for the connection or one of its channels to close and starts
+// reconnecting unless the client was closed on purpose
+func (r *RabbitMQ) watch(conn *amqp.Connection, ch, pubCh *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	pubClosed := pubCh.NotifyClose(make(chan *amqp.Error, 1))
+
+	var amqpErr *amqp.Error
+	select {
+	case amqpErr = <-connClosed:
+	case amqpErr = <-chClosed:
+	case amqpErr = <-pubClosed:
+	case <-r.closed:
+		return
+	}
+
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+
+	r.mu.Lock()
+	r.conn = nil
+	r.ch = nil
+	r.pub = nil
+	r.state = StateReconnecting
+	r.connected = make(chan struct{})
+	r.mu.Unlock()
+
+	// A channel-level error leaves the connection open; drop it as well so
+	// the reconnect starts from a clean state
+	conn.Close()
+
+	var err error = ErrNotConnected
+	if amqpErr != nil {
+		err = amqpErr
+	}
+	r.notifyState(StateReconnecting, err)
+	r.reconnect()
+}
+
+// reconnect re-dials with exponential backoff until it succeeds or the
+// client is closed, then restores the topology and consumers
+func (r *RabbitMQ) reconnect() {
+	delay := r.reconnectDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(delay):
+		}
+
+		conn, ch, pub, err := r.connect()
+		if err == nil {
+			err = r.restore(ch)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("RabbitMQ reconnect attempt %d failed: %v", attempt, err)
+			r.notifyState(StateReconnecting, err)
+			delay *= 2
+			if delay > r.maxReconnectDelay {
+				delay = r.maxReconnectDelay
+			}
+			continue
+		}
+
+		log.Printf("RabbitMQ reconnected after %d attempts", attempt)
+		r.setConnected(conn, ch, pub)
+		r.restartConsumers(ch)
+		return
+	}
+}
+
+// restore re-declares the exchanges and queues set up before the
+// connection was lost
+func (r *RabbitMQ) restore(ch *amqp.Channel) error {
+	r.mu.RLock()
+	exchangeDeclared := r.exchangeDeclared
+	queues := append([]string(nil), r.queues...)
+	r.mu.RUnlock()
+
+	if exchangeDeclared {
+		if err := declareExchanges(ch); err != nil {
+			return err
+		}
+	}
+	for _, queueName := range queues {
+		if err := r.declareQueue(ch, queueName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restartConsumers registers every consumer again on a new channel
+func (r *RabbitMQ) restartConsumers(ch *amqp.Channel) {
+	r.mu.RLock()
+	consumers := append([]consumer(nil), r.consumers...)
+	r.mu.RUnlock()
+
+	for _, c := range consumers {
+		if err := r.startConsumer(ch, c); err != nil {
+			log.Printf("Failed to restart consumer for queue %s: %v", c.queueName, err)
+		}
+	}
+}
+
+func (r *RabbitMQ) notifyState(state ConnectionState, err error) {
+	for _, hook := range r.stateHooks {
+		hook(state, err)
+	}
+}
+
+// LogConnectionState returns a StateHook that logs connection changes
+func LogConnectionState(serviceName string) StateHook {
+	return func(state ConnectionState, err error) {
+		if err != nil {
+			log.Printf("[%s] RabbitMQ connection %s: %v", serviceName, state, err)
+			return
+		}
+		log.Printf("[%s] RabbitMQ connection %s", serviceName, state)
+	}
+}
@@ -4,15 +4,26 @@ import (
 	"database/sql"
 	"log"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
 type Database struct {
 	DB *sql.DB
 }
 
+// NewDatabase opens the Postgres database through a traced driver, so every
+// query and transaction gets a span in the trace of its context
 func NewDatabase(databaseURL string) (*Database, error) {
-	db, err := sql.Open("postgres", databaseURL)
+	db, err := otelsql.Open("postgres", databaseURL,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+		}),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -32,4 +43,4 @@ func (d *Database) Close() error {
 		return d.DB.Close()
 	}
 	return nil
-} 
\ No newline at end of file
+}
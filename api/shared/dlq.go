@@ -0,0 +1,237 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// HeaderReplayedAt marks a parked message that was sent back to its queue
+const HeaderReplayedAt = "x-replayed-at"
+
+// ParkedMessage is a message waiting in a service's parking-lot queue. A
+// message published without a message ID is identified by the event ID in
+// its body or, failing that, by a digest of the body.
+type ParkedMessage struct {
+	MessageID string          `json:"message_id"`
+	Queue     string          `json:"queue"`
+	EventType string          `json:"event_type"`
+	OrderID   string          `json:"order_id,omitempty"`
+	Reason    string          `json:"reason"`
+	Attempts  int             `json:"attempts"`
+	ParkedAt  string          `json:"parked_at,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// ListParked returns up to limit messages parked for a service queue, oldest
+// first. Messages are fetched without acknowledging them and stay parked.
+func (r *RabbitMQ) ListParked(queueName string, limit int) ([]ParkedMessage, error) {
+	var parked []ParkedMessage
+	err := r.scanParked(queueName, limit, func(d amqp.Delivery) (bool, error) {
+		parked = append(parked, parkedMessage(queueName, d))
+		return false, nil
+	})
+	return parked, err
+}
+
+// ReplayParked sends the parked messages with the given IDs back to their
+// service queue with a fresh retry count. It returns the number replayed.
+func (r *RabbitMQ) ReplayParked(ctx context.Context, queueName string, messageIDs []string) (int, error) {
+	wanted := idSet(messageIDs)
+	replayed := 0
+	err := r.scanParked(queueName, 0, func(d amqp.Delivery) (bool, error) {
+		id := parkedMessageID(d)
+		if !wanted[id] {
+			return false, nil
+		}
+
+		msg := republishing(d, 0, "")
+		msg.MessageId = id
+		delete(msg.Headers, HeaderRetryCount)
+		delete(msg.Headers, HeaderLastError)
+		delete(msg.Headers, HeaderParkedAt)
+		msg.Headers[HeaderReplayedAt] = time.Now().UTC().Format(time.RFC3339)
+
+		if err := r.publish(ctx, "", queueName, msg); err != nil {
+			return false, err
+		}
+		replayed++
+		return true, nil
+	})
+	return replayed, err
+}
+
+// PurgeParked drops the parked messages with the given IDs, or every parked
+// message of the queue when no IDs are given. It returns the number dropped.
+func (r *RabbitMQ) PurgeParked(queueName string, messageIDs []string) (int, error) {
+	if len(messageIDs) == 0 {
+		if _, ok := QueueBindings[queueName]; !ok {
+			return 0, fmt.Errorf("unknown queue %s", queueName)
+		}
+
+		ch, err := r.openChannel()
+		if err != nil {
+			return 0, err
+		}
+		defer ch.Close()
+
+		purged, err := ch.QueuePurge(ParkingLotQueue(queueName), false)
+		if isNotFound(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to purge %s: %v", ParkingLotQueue(queueName), err)
+		}
+		return purged, nil
+	}
+
+	wanted := idSet(messageIDs)
+	purged := 0
+	err := r.scanParked(queueName, 0, func(d amqp.Delivery) (bool, error) {
+		if !wanted[parkedMessageID(d)] {
+			return false, nil
+		}
+		purged++
+		return true, nil
+	})
+	return purged, err
+}
+
+// scanParked fetches the messages currently in a parking-lot queue on a
+// channel of its own and passes each to visit, stopping after limit messages
+// when limit is positive. Messages visit reports as handled are
+// acknowledged; the rest go back to the queue when the channel closes. A
+// parking-lot queue that was never declared holds no messages.
+func (r *RabbitMQ) scanParked(queueName string, limit int, visit func(d amqp.Delivery) (bool, error)) error {
+	if _, ok := QueueBindings[queueName]; !ok {
+		return fmt.Errorf("unknown queue %s", queueName)
+	}
+	parkingLot := ParkingLotQueue(queueName)
+
+	ch, err := r.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	// Only look at the messages present now; a message requeued by another
+	// scan must not be seen twice
+	q, err := ch.QueueInspect(parkingLot)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s: %v", parkingLot, err)
+	}
+	count := q.Messages
+	if limit > 0 && limit < count {
+		count = limit
+	}
+
+	for i := 0; i < count; i++ {
+		d, ok, err := ch.Get(parkingLot, false)
+		if err != nil {
+			return fmt.Errorf("failed to read from %s: %v", parkingLot, err)
+		}
+		if !ok {
+			return nil
+		}
+
+		handled, err := visit(d)
+		if err != nil {
+			return err
+		}
+		if handled {
+			if err := d.Ack(false); err != nil {
+				return fmt.Errorf("failed to acknowledge message %s: %v", parkedMessageID(d), err)
+			}
+		}
+	}
+	return nil
+}
+
+// openChannel opens a short-lived channel on the current connection
+func (r *RabbitMQ) openChannel() (*amqp.Channel, error) {
+	if !r.waitConnected() {
+		return nil, ErrNotConnected
+	}
+
+	r.mu.RLock()
+	conn := r.conn
+	r.mu.RUnlock()
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	return ch, nil
+}
+
+func parkedMessage(queueName string, d amqp.Delivery) ParkedMessage {
+	msg := ParkedMessage{
+		MessageID: parkedMessageID(d),
+		Queue:     queueName,
+		EventType: d.Type,
+		Attempts:  retryCount(d),
+	}
+	if reason, ok := d.Headers[HeaderLastError].(string); ok {
+		msg.Reason = reason
+	}
+	if parkedAt, ok := d.Headers[HeaderParkedAt].(string); ok {
+		msg.ParkedAt = parkedAt
+	}
+
+	var event OrderEvent
+	if err := json.Unmarshal(d.Body, &event); err == nil {
+		msg.OrderID = event.OrderID
+		if msg.EventType == "" {
+			msg.EventType = event.EventType
+		}
+	}
+	if json.Valid(d.Body) {
+		msg.Payload = json.RawMessage(d.Body)
+	} else {
+		msg.Payload, _ = json.Marshal(string(d.Body))
+	}
+	return msg
+}
+
+// parkedMessageID identifies a parked message by its message ID, the event
+// ID in its body or a digest of its body, in that order
+func parkedMessageID(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+
+	var event OrderEvent
+	if err := json.Unmarshal(d.Body, &event); err == nil && event.EventID != "" {
+		return event.EventID
+	}
+
+	digest := sha256.Sum256(d.Body)
+	return "sha256-" + hex.EncodeToString(digest[:16])
+}
+
+// isNotFound reports whether the broker closed the channel because a queue
+// does not exist
+func isNotFound(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+}
+
+func idSet(ids []string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestParkedMessageID(t *testing.T) {
+	body := []byte(`{"event_id":"event-1","event_type":"OrderCreated","order_id":"order-1"}`)
+
+	if id := parkedMessageID(amqp.Delivery{MessageId: "message-1", Body: body}); id != "message-1" {
+		t.Errorf("with a message ID: id = %q, want message-1", id)
+	}
+	if id := parkedMessageID(amqp.Delivery{Body: body}); id != "event-1" {
+		t.Errorf("without a message ID: id = %q, want the event ID event-1", id)
+	}
+
+	garbled := amqp.Delivery{Body: []byte("not an event")}
+	id := parkedMessageID(garbled)
+	if !strings.HasPrefix(id, "sha256-") {
+		t.Errorf("without any ID: id = %q, want a body digest", id)
+	}
+	if again := parkedMessageID(garbled); again != id {
+		t.Errorf("digest is not stable: %q then %q", id, again)
+	}
+	if parked := parkedMessage(ShippingQueue, garbled); parked.MessageID != id {
+		t.Errorf("listed message ID = %q, want %q", parked.MessageID, id)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	notFound := &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue 'shipping_queue.parking_lot'"}
+	if !isNotFound(notFound) {
+		t.Error("a 404 channel close is not reported as not found")
+	}
+	if !isNotFound(fmt.Errorf("inspect failed: %w", notFound)) {
+		t.Error("a wrapped 404 is not reported as not found")
+	}
+	if isNotFound(&amqp.Error{Code: amqp.AccessRefused}) {
+		t.Error("a 403 is reported as not found")
+	}
+	if isNotFound(nil) {
+		t.Error("nil is reported as not found")
+	}
+}
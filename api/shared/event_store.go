@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// EventStore is the append-only order_events table holding every event
+// published through a client configured with WithEventStore
+type EventStore struct {
+	db *sql.DB
+}
+
+// EventQuery filters stored events. Empty fields match everything.
+type EventQuery struct {
+	OrderID       string
+	UserID        string
+	EventType     string
+	EventTypes    []string  // only events of one of these types
+	OrderStatus   string    // only events of orders currently in this status
+	AfterSequence int64     // only events recorded after this position; see Position
+	From          time.Time // inclusive
+	To            time.Time // exclusive
+	Limit         int
+}
+
+// NewEventStore creates an event store backed by the order_events table
+func NewEventStore(db *sql.DB) *EventStore {
+	return &EventStore{db: db}
+}
+
+// WithEventStore records every confirmed publish in the event store
+func WithEventStore(store *EventStore) Option {
+	return func(r *RabbitMQ) {
+		r.eventStore = store
+	}
+}
+
+// Append stores an event with its full envelope. An event published again,
+// for example by an outbox relay retry, is stored only once.
+func (s *EventStore) Append(ctx context.Context, event OrderEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO order_events (event_id, order_id, event_type, correlation_id, causation_id,
+			producer, schema_version, payload, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (event_id) DO NOTHING
+	`, event.EventID, event.OrderID, event.EventType, event.CorrelationID, event.CausationID,
+		event.Producer, event.SchemaVersion, string(payload), event.Timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to append %s to event store: %v", event.EventType, err)
+	}
+
+	return nil
+}
+
+// Position returns the sequence the event was recorded at, or
+// sql.ErrNoRows if it is not in the store. Sequences are taken when an
+// append starts, not when it commits, so an event can become visible after
+// one with a higher sequence; a reader that has seen the higher one can
+// miss it when paging with AfterSequence. Each append commits on its own,
+// which keeps that window to the length of one insert.
+func (s *EventStore) Position(ctx context.Context, eventID string) (int64, error) {
+	var sequence int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT sequence FROM order_events WHERE event_id = $1", eventID,
+	).Scan(&sequence)
+	return sequence, err
+}
+
+// Query returns the stored events matching q in the order they were recorded
+func (s *EventStore) Query(ctx context.Context, q EventQuery) ([]OrderEvent, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.OrderID != "" {
+		addCondition("order_id = $%d", q.OrderID)
+	}
+	if q.UserID != "" {
+		addCondition("payload->>'user_id' = $%d", q.UserID)
+	}
+	if q.EventType != "" {
+		addCondition("event_type = $%d", q.EventType)
+	}
+	if len(q.EventTypes) > 0 {
+		addCondition("event_type = ANY($%d)", pq.Array(q.EventTypes))
+	}
+	if q.OrderStatus != "" {
+		addCondition("order_id IN (SELECT id FROM orders WHERE status = $%d)", q.OrderStatus)
+	}
+	if q.AfterSequence > 0 {
+		addCondition("sequence > $%d", q.AfterSequence)
+	}
+	if !q.From.IsZero() {
+		addCondition("occurred_at >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		addCondition("occurred_at < $%d", q.To)
+	}
+
+	query := "SELECT payload FROM order_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY sequence"
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query event store: %v", err)
+	}
+	defer rows.Close()
+
+	var events []OrderEvent
+	for rows.Next() {
+		var payload []byte
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+
+		var event OrderEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("failed to decode stored event: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,222 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// TxHandler handles an event inside the transaction that marks it as
+// processed. Its writes, including events added to the outbox, commit
+// together with that mark.
+type TxHandler func(ctx context.Context, tx *sql.Tx, event OrderEvent) error
+
+// PrepareFunc does the part of handling an event that must not hold a
+// transaction open, such as calling an external service, before the
+// handler's transaction begins. The context it returns is passed on to the
+// handler. It runs again when the event is retried and is skipped for an
+// event the inbox already processed, so it must be idempotent.
+type PrepareFunc func(ctx context.Context, event OrderEvent) (context.Context, error)
+
+// EventInbox runs a handler at most once per event ID. It is implemented by
+// Inbox and by the in-process MemoryInbox; PassthroughInbox implements it
+// for idempotent handlers without deduplicating.
+type EventInbox interface {
+	Process(ctx context.Context, event OrderEvent, handler TxHandler) error
+	// Processed reports whether the event was processed already
+	Processed(ctx context.Context, event OrderEvent) (bool, error)
+}
+
+var (
+	_ EventInbox = (*Inbox)(nil)
+	_ EventInbox = (*MemoryInbox)(nil)
+	_ EventInbox = PassthroughInbox{}
+)
+
+// Inbox records the events a consumer has processed in the processed_events
+// table. A redelivered event finds its row already there and is skipped, so
+// handlers have exactly-once effects on top of at-least-once delivery.
+type Inbox struct {
+	db       *sql.DB
+	consumer string
+}
+
+// NewInbox creates an inbox for the named consumer
+func NewInbox(db *sql.DB, consumer string) *Inbox {
+	return &Inbox{
+		db:       db,
+		consumer: consumer,
+	}
+}
+
+// WithInbox sets the inbox ConsumeEvents uses to deduplicate events
+func WithInbox(inbox EventInbox) Option {
+	return func(r *RabbitMQ) {
+		r.inbox = inbox
+	}
+}
+
+// Process runs the handler once per event ID. The processed mark is written
+// first in the handler's transaction; a concurrent delivery of the same event
+// blocks on it until the first one commits or rolls back.
+func (i *Inbox) Process(ctx context.Context, event OrderEvent, handler TxHandler) error {
+	if event.EventID == "" {
+		return fmt.Errorf("event %s for order %s has no event ID", event.EventType, event.OrderID)
+	}
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO processed_events (consumer, event_id, event_type, processed_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (consumer, event_id) DO NOTHING
+	`, i.consumer, event.EventID, event.EventType, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record processed event: %v", err)
+	}
+
+	if inserted, _ := res.RowsAffected(); inserted == 0 {
+		log.Printf("Skipping duplicate event %s (%s) for order %s", event.EventID, event.EventType, event.OrderID)
+		return nil
+	}
+
+	ctx, pending := withPendingEvents(ctx)
+	if err := handler(ctx, tx, event); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	pending.release()
+	return nil
+}
+
+// Processed reports whether the inbox has a processed mark for the event
+func (i *Inbox) Processed(ctx context.Context, event OrderEvent) (bool, error) {
+	var processed bool
+	err := i.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM processed_events WHERE consumer = $1 AND event_id = $2)
+	`, i.consumer, event.EventID).Scan(&processed)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up processed event: %v", err)
+	}
+	return processed, nil
+}
+
+// prepareEvent runs prepare, if set, for an event the inbox has not
+// processed yet
+func prepareEvent(ctx context.Context, inbox EventInbox, event OrderEvent, prepare PrepareFunc) (context.Context, error) {
+	if prepare == nil || event.EventID == "" {
+		return ctx, nil
+	}
+	processed, err := inbox.Processed(ctx, event)
+	if err != nil || processed {
+		return ctx, err
+	}
+	return prepare(ctx, event)
+}
+
+// MemoryInbox is an in-process EventInbox for tests. It remembers processed
+// event IDs in memory. Given a database, handlers run in a transaction of it
+// like with Inbox; without one they are passed a nil transaction.
+type MemoryInbox struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	processed map[string]bool
+}
+
+// NewMemoryInbox creates an in-memory inbox. db may be nil for handlers
+// that do not use the transaction.
+func NewMemoryInbox(db *sql.DB) *MemoryInbox {
+	return &MemoryInbox{
+		db:        db,
+		processed: make(map[string]bool),
+	}
+}
+
+// Process runs the handler once per event ID. A delivery of an event that is
+// being handled or was handled is skipped; an event whose handler failed may
+// be processed again.
+func (i *MemoryInbox) Process(ctx context.Context, event OrderEvent, handler TxHandler) error {
+	if event.EventID == "" {
+		return fmt.Errorf("event %s for order %s has no event ID", event.EventType, event.OrderID)
+	}
+
+	i.mu.Lock()
+	if i.processed[event.EventID] {
+		i.mu.Unlock()
+		log.Printf("Skipping duplicate event %s (%s) for order %s", event.EventID, event.EventType, event.OrderID)
+		return nil
+	}
+	i.processed[event.EventID] = true
+	i.mu.Unlock()
+
+	if err := i.run(ctx, event, handler); err != nil {
+		i.mu.Lock()
+		delete(i.processed, event.EventID)
+		i.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Processed reports whether the event is being handled or was handled
+func (i *MemoryInbox) Processed(ctx context.Context, event OrderEvent) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.processed[event.EventID], nil
+}
+
+func (i *MemoryInbox) run(ctx context.Context, event OrderEvent, handler TxHandler) error {
+	var tx *sql.Tx
+	if i.db != nil {
+		var err error
+		if tx, err = i.db.BeginTx(ctx, nil); err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+	}
+
+	ctx, pending := withPendingEvents(ctx)
+	if err := handler(ctx, tx, event); err != nil {
+		return err
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	pending.release()
+	return nil
+}
+
+// PassthroughInbox runs the handler for every delivery, with a nil
+// transaction. It suits consumers whose handlers are idempotent and write
+// nothing, such as one fanning events out to connected clients, which must
+// not share a processed mark with other instances consuming their own copy.
+type PassthroughInbox struct{}
+
+// Process runs the handler
+func (PassthroughInbox) Process(ctx context.Context, event OrderEvent, handler TxHandler) error {
+	ctx, pending := withPendingEvents(ctx)
+	if err := handler(ctx, nil, event); err != nil {
+		return err
+	}
+	pending.release()
+	return nil
+}
+
+// Processed reports every event as not processed yet
+func (PassthroughInbox) Processed(ctx context.Context, event OrderEvent) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,328 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is an in-process Broker for tests. It routes events to the
+// queues in QueueBindings like the topic exchange does and mimics the AMQP
+// client's delivery semantics: handlers run through an inbox, a failed event
+// is redelivered after the retry policy's delay and parked once its attempts
+// are exhausted, and an event no queue is bound to fails with ErrUnroutable.
+// All services of a test share one broker, each through its ForProducer view.
+type MemoryBroker struct {
+	*memoryBus
+	producer string
+}
+
+// memoryBus holds the queues shared by all views of a MemoryBroker
+type memoryBus struct {
+	retryPolicy RetryPolicy
+	newInbox    func(queueName string) EventInbox
+
+	mu        sync.Mutex
+	queues    map[string]*memoryQueue
+	inboxes   map[string]EventInbox
+	closed    bool
+	consumers sync.WaitGroup
+	done      chan struct{}
+}
+
+// memoryQueue holds the messages of one queue. notify is signalled when a
+// message is added.
+type memoryQueue struct {
+	mu       sync.Mutex
+	messages []memoryMessage
+	parked   []OrderEvent
+	notify   chan struct{}
+}
+
+// memoryMessage is a queued event body with its delivery count
+type memoryMessage struct {
+	body        []byte
+	redelivered int
+}
+
+// NewMemoryBroker creates an in-process broker. Handlers of a queue run
+// through the inbox newInbox returns for it, created once per queue; a nil
+// newInbox gives every queue a MemoryInbox without a database.
+func NewMemoryBroker(retryPolicy RetryPolicy, newInbox func(queueName string) EventInbox) *MemoryBroker {
+	if newInbox == nil {
+		newInbox = func(string) EventInbox { return NewMemoryInbox(nil) }
+	}
+	return &MemoryBroker{
+		memoryBus: &memoryBus{
+			retryPolicy: retryPolicy,
+			newInbox:    newInbox,
+			queues:      make(map[string]*memoryQueue),
+			inboxes:     make(map[string]EventInbox),
+			done:        make(chan struct{}),
+		},
+	}
+}
+
+// ForProducer returns a view of the broker that records serviceName as the
+// producer of the events it publishes, like WithProducer does for RabbitMQ.
+// The view shares the queues of b.
+func (b *MemoryBroker) ForProducer(serviceName string) *MemoryBroker {
+	return &MemoryBroker{
+		memoryBus: b.memoryBus,
+		producer:  serviceName,
+	}
+}
+
+// SetupExchange is a no-op; routing uses QueueBindings directly
+func (b *MemoryBroker) SetupExchange() error {
+	return nil
+}
+
+// SetupQueue declares a queue bound to the event types listed for it in
+// QueueBindings, or to StreamBindings for a stream queue
+func (b *memoryBus) SetupQueue(queueName string) error {
+	if _, ok := bindings(queueName); !ok {
+		return fmt.Errorf("no bindings defined for queue %s", queueName)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.queues[queueName]; !ok {
+		b.queues[queueName] = &memoryQueue{notify: make(chan struct{}, 1)}
+	}
+	return nil
+}
+
+// State reports the broker as connected until it is closed
+func (b *memoryBus) State() ConnectionState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return StateClosed
+	}
+	return StateConnected
+}
+
+// PublishEvent fills in the envelope and copies the event to every declared
+// queue bound to its type
+func (b *MemoryBroker) PublishEvent(ctx context.Context, event OrderEvent) error {
+	event.fillEnvelope(b.producer)
+	routingKey := RoutingKey(event.EventType)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return &PublishError{Exchange: OrderEventsExchange, RoutingKey: routingKey, MessageID: event.EventID, Err: ErrNotConnected}
+	}
+	var targets []*memoryQueue
+	for queueName, q := range b.queues {
+		if eventTypes, _ := bindings(queueName); containsString(eventTypes, event.EventType) {
+			targets = append(targets, q)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(targets) == 0 && isStreamEvent(event.EventType) {
+		return nil
+	}
+	if len(targets) == 0 {
+		return &PublishError{Exchange: OrderEventsExchange, RoutingKey: routingKey, MessageID: event.EventID, Reason: "NO_ROUTE", Err: ErrUnroutable}
+	}
+
+	for _, q := range targets {
+		q.push(memoryMessage{body: body})
+	}
+	return nil
+}
+
+// PublishEventToQueue fills in the envelope and sends the event straight to
+// a declared queue, bypassing the routing like the default exchange
+func (b *MemoryBroker) PublishEventToQueue(ctx context.Context, queueName string, event OrderEvent) error {
+	event.fillEnvelope(b.producer)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	b.mu.Lock()
+	closed := b.closed
+	q, ok := b.queues[queueName]
+	b.mu.Unlock()
+
+	if closed {
+		return &PublishError{RoutingKey: queueName, MessageID: event.EventID, Err: ErrNotConnected}
+	}
+	if !ok {
+		return &PublishError{RoutingKey: queueName, MessageID: event.EventID, Reason: "NO_ROUTE", Err: ErrUnroutable}
+	}
+
+	q.push(memoryMessage{body: body})
+	return nil
+}
+
+// ConsumeEvents handles the events of a queue one at a time until ctx ends.
+// A handler already running when ctx ends finishes with a context that is not
+// cancelled.
+func (b *memoryBus) ConsumeEvents(ctx context.Context, queueName string, handler TxHandler) error {
+	return b.ConsumePreparedEvents(ctx, queueName, nil, handler)
+}
+
+// ConsumePreparedEvents consumes like ConsumeEvents and runs prepare for
+// each event the inbox has not processed yet, before the handler
+func (b *memoryBus) ConsumePreparedEvents(ctx context.Context, queueName string, prepare PrepareFunc, handler TxHandler) error {
+	b.mu.Lock()
+	q, ok := b.queues[queueName]
+	if !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("queue %s is not declared", queueName)
+	}
+	inbox, ok := b.inboxes[queueName]
+	if !ok {
+		inbox = b.newInbox(queueName)
+		b.inboxes[queueName] = inbox
+	}
+	b.mu.Unlock()
+
+	b.consumers.Add(1)
+	go func() {
+		defer b.consumers.Done()
+
+		handlerCtx := context.WithoutCancel(ctx)
+		for {
+			msg, ok := q.pop()
+			if !ok {
+				select {
+				case <-q.notify:
+					continue
+				case <-ctx.Done():
+					return
+				case <-b.done:
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				q.push(msg)
+				return
+			}
+
+			b.handle(handlerCtx, inbox, queueName, q, msg, prepare, handler)
+		}
+	}()
+
+	return nil
+}
+
+// handle runs the handler for one message and retries or parks it on failure
+func (b *memoryBus) handle(ctx context.Context, inbox EventInbox, queueName string, q *memoryQueue, msg memoryMessage, prepare PrepareFunc, handler TxHandler) {
+	var event OrderEvent
+	if err := json.Unmarshal(msg.body, &event); err != nil {
+		log.Printf("Discarded malformed event from %s: %v", queueName, err)
+		return
+	}
+
+	ctx, err := prepareEvent(withRetries(ctx, msg.redelivered), inbox, event, prepare)
+	if err == nil {
+		err = inbox.Process(ctx, event, handler)
+	}
+	if err == nil {
+		return
+	}
+
+	msg.redelivered++
+	if msg.redelivered > b.retryPolicy.MaxAttempts {
+		log.Printf("Parked event %s from %s: retries exhausted: %v", event.EventID, queueName, err)
+		q.park(event)
+		return
+	}
+
+	delay := b.retryPolicy.Delay(msg.redelivered)
+	time.AfterFunc(delay, func() {
+		q.push(msg)
+	})
+}
+
+// Parked returns the events parked on a queue after exhausting their retries
+func (b *memoryBus) Parked(queueName string) []OrderEvent {
+	b.mu.Lock()
+	q, ok := b.queues[queueName]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]OrderEvent(nil), q.parked...)
+}
+
+// Shutdown waits for the consumers to stop, until ctx ends, and closes the
+// broker, with all its views. Cancel the contexts passed to ConsumeEvents
+// first.
+func (b *memoryBus) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		b.consumers.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = fmt.Errorf("in-flight handlers did not finish: %v", ctx.Err())
+	}
+
+	b.Close()
+	return err
+}
+
+// Close stops all consumers and rejects further publishes
+func (b *memoryBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+func (q *memoryQueue) push(msg memoryMessage) {
+	q.mu.Lock()
+	q.messages = append(q.messages, msg)
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memoryQueue) pop() (memoryMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return memoryMessage{}, false
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	return msg, true
+}
+
+func (q *memoryQueue) park(event OrderEvent) {
+	q.mu.Lock()
+	q.parked = append(q.parked, event)
+	q.mu.Unlock()
+}
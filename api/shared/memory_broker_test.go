@@ -0,0 +1,338 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder collects the events handlers receive
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []OrderEvent
+}
+
+func (r *eventRecorder) handle(ctx context.Context, tx *sql.Tx, event OrderEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *eventRecorder) received() []OrderEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]OrderEvent(nil), r.events...)
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestBroker(t *testing.T, queues ...string) *MemoryBroker {
+	t.Helper()
+	broker := NewMemoryBroker(RetryPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond}, nil)
+	for _, queue := range queues {
+		if err := broker.SetupQueue(queue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func TestMemoryBrokerRoutesByBinding(t *testing.T) {
+	broker := newTestBroker(t, ShippingQueue, PaymentQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shipping, payment := &eventRecorder{}, &eventRecorder{}
+	if err := broker.ConsumeEvents(ctx, ShippingQueue, shipping.handle); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.ConsumeEvents(ctx, PaymentQueue, payment.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	orders := broker.ForProducer("order-creation")
+	if err := orders.PublishEvent(ctx, OrderEvent{EventType: EventOrderCreated, OrderID: "order-1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "OrderCreated at the payment queue", func() bool { return len(payment.received()) == 1 })
+
+	event := payment.received()[0]
+	if event.Producer != "order-creation" {
+		t.Errorf("producer = %q, want order-creation", event.Producer)
+	}
+	if event.EventID == "" {
+		t.Error("event ID was not filled in")
+	}
+	if got := shipping.received(); len(got) != 0 {
+		t.Errorf("shipping queue received %d events, want none", len(got))
+	}
+
+	err := orders.PublishEvent(ctx, OrderEvent{EventType: EventOrderDelivered, OrderID: "order-1"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("publishing an unbound event type: err = %v, want ErrUnroutable", err)
+	}
+}
+
+func TestMemoryBrokerPublishEventToQueue(t *testing.T) {
+	broker := newTestBroker(t, ShippingQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shipping := &eventRecorder{}
+	if err := broker.ConsumeEvents(ctx, ShippingQueue, shipping.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue is not bound to OrderCreated, but direct sends bypass routing
+	replay := broker.ForProducer("replay")
+	if err := replay.PublishEventToQueue(ctx, ShippingQueue, OrderEvent{EventType: EventOrderCreated, OrderID: "order-1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the event at the shipping queue", func() bool { return len(shipping.received()) == 1 })
+	if producer := shipping.received()[0].Producer; producer != "replay" {
+		t.Errorf("producer = %q, want replay", producer)
+	}
+
+	err := replay.PublishEventToQueue(ctx, PaymentQueue, OrderEvent{EventType: EventOrderCreated, OrderID: "order-1"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("sending to an undeclared queue: err = %v, want ErrUnroutable", err)
+	}
+}
+
+func TestMemoryBrokerSkipsDuplicates(t *testing.T) {
+	broker := newTestBroker(t, ShippingQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shipping := &eventRecorder{}
+	if err := broker.ConsumeEvents(ctx, ShippingQueue, shipping.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	event := OrderEvent{EventID: "event-1", EventType: EventOrderReadyForShipping, OrderID: "order-1"}
+	for i := 0; i < 2; i++ {
+		if err := broker.PublishEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marker := OrderEvent{EventID: "event-2", EventType: EventOrderReadyForShipping, OrderID: "order-2"}
+	if err := broker.PublishEvent(ctx, marker); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the second order", func() bool {
+		events := shipping.received()
+		return len(events) > 0 && events[len(events)-1].EventID == "event-2"
+	})
+	if got := len(shipping.received()); got != 2 {
+		t.Errorf("handled %d events, want 2", got)
+	}
+}
+
+func TestMemoryBrokerRetriesAndParks(t *testing.T) {
+	broker := newTestBroker(t, ShippingQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	retries := make(map[string][]int)
+	handler := func(ctx context.Context, tx *sql.Tx, event OrderEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[event.OrderID]++
+		retries[event.OrderID] = append(retries[event.OrderID], Retries(ctx))
+		// order-1 succeeds on its second attempt, order-2 never does
+		if event.OrderID == "order-1" && attempts[event.OrderID] > 1 {
+			return nil
+		}
+		return errors.New("carrier unavailable")
+	}
+	if err := broker.ConsumeEvents(ctx, ShippingQueue, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, orderID := range []string{"order-1", "order-2"} {
+		if err := broker.PublishEvent(ctx, OrderEvent{EventType: EventOrderReadyForShipping, OrderID: orderID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "order-2 to be parked", func() bool { return len(broker.Parked(ShippingQueue)) == 1 })
+	if parked := broker.Parked(ShippingQueue)[0]; parked.OrderID != "order-2" {
+		t.Errorf("parked %s, want order-2", parked.OrderID)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["order-1"] != 2 {
+		t.Errorf("order-1 attempts = %d, want 2", attempts["order-1"])
+	}
+	if attempts["order-2"] != 3 {
+		t.Errorf("order-2 attempts = %d, want 3", attempts["order-2"])
+	}
+	if got := fmt.Sprint(retries["order-2"]); got != "[0 1 2]" {
+		t.Errorf("order-2 retries seen by the handler = %s, want [0 1 2]", got)
+	}
+}
+
+func TestMemoryOutboxReleasesEventsOnCommit(t *testing.T) {
+	broker := newTestBroker(t, ShippingQueue, OrderStatusQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outbox := NewMemoryOutbox("shipping")
+	go outbox.Relay(ctx, broker.ForProducer("shipping"))
+
+	// The handler stores a follow-up event and fails the first time, so only
+	// the event of the second, successful attempt is published
+	var mu sync.Mutex
+	attempts := 0
+	handler := func(ctx context.Context, tx *sql.Tx, event OrderEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+
+		shipped := event.FollowUp(EventOrderShipped)
+		shipped.Metadata = map[string]interface{}{"attempt": attempts}
+		if err := outbox.Add(ctx, tx, shipped); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return errors.New("rolled back")
+		}
+		return nil
+	}
+	if err := broker.ConsumeEvents(ctx, ShippingQueue, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	status := &eventRecorder{}
+	if err := broker.ConsumeEvents(ctx, OrderStatusQueue, status.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.PublishEvent(ctx, OrderEvent{EventType: EventOrderReadyForShipping, OrderID: "order-1"}); err != nil {
+		t.Fatal(err)
+	}
+	var shipped OrderEvent
+	waitFor(t, "OrderShipped", func() bool {
+		for _, event := range status.received() {
+			if event.EventType == EventOrderShipped {
+				shipped = event
+				return true
+			}
+		}
+		return false
+	})
+
+	if shipped.Producer != "shipping" {
+		t.Errorf("producer = %q, want shipping", shipped.Producer)
+	}
+	if attempt, _ := shipped.Metadata["attempt"].(float64); attempt != 2 {
+		t.Errorf("published the event of attempt %v, want 2", shipped.Metadata["attempt"])
+	}
+	if got := len(outbox.Events()); got != 1 {
+		t.Errorf("outbox holds %d events, want 1", got)
+	}
+}
+
+func TestMemoryBrokerStreamQueues(t *testing.T) {
+	broker := newTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without a gateway instance status changes have no route, which is fine
+	changed := OrderEvent{EventType: EventOrderStatusChanged, OrderID: "order-1"}
+	if err := broker.PublishEvent(ctx, changed); err != nil {
+		t.Fatalf("publishing without a stream queue: %v", err)
+	}
+
+	// Every instance gets every status change
+	instances := []*eventRecorder{{}, {}}
+	for i, instance := range instances {
+		queueName := StreamQueue(fmt.Sprint("gateway-", i))
+		if err := broker.SetupQueue(queueName); err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.ConsumeEvents(ctx, queueName, instance.handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := broker.PublishEvent(ctx, changed); err != nil {
+		t.Fatal(err)
+	}
+	for i, instance := range instances {
+		waitFor(t, fmt.Sprint("the status change at instance ", i), func() bool { return len(instance.received()) == 1 })
+	}
+}
+
+type preparedKey struct{}
+
+func TestMemoryBrokerPreparesEvents(t *testing.T) {
+	broker := newTestBroker(t, ShippingQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Preparing fails once, and the handler sees what the retry prepared
+	var mu sync.Mutex
+	prepared := 0
+	prepare := func(ctx context.Context, event OrderEvent) (context.Context, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		prepared++
+		if prepared == 1 {
+			return ctx, errors.New("carrier unavailable")
+		}
+		return context.WithValue(ctx, preparedKey{}, prepared), nil
+	}
+	var seen []interface{}
+	handler := func(ctx context.Context, tx *sql.Tx, event OrderEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, ctx.Value(preparedKey{}))
+		return nil
+	}
+	if err := broker.ConsumePreparedEvents(ctx, ShippingQueue, prepare, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duplicate is neither prepared nor handled again
+	event := OrderEvent{EventID: "event-1", EventType: EventOrderReadyForShipping, OrderID: "order-1"}
+	for i := 0; i < 2; i++ {
+		if err := broker.PublishEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the event to be handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seen) == 1
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if prepared != 2 {
+		t.Errorf("prepared %d times, want 2", prepared)
+	}
+	if fmt.Sprint(seen) != "[2]" {
+		t.Errorf("handler saw %v, want [2]", seen)
+	}
+}
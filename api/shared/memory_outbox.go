@@ -0,0 +1,193 @@
+package shared
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// MemoryOutbox is an in-process EventOutbox for tests. Events added while
+// an inbox handles an event are held until that handling commits and are
+// dropped if it fails, like rows of a rolled back transaction; other events
+// are stored right away. Relay publishes stored events in the order they
+// were added, keeping the events of an order in sequence when a publish
+// fails.
+type MemoryOutbox struct {
+	producer string
+
+	mu     sync.Mutex
+	events []memoryOutboxEvent
+	notify chan struct{}
+}
+
+type memoryOutboxEvent struct {
+	event     OrderEvent
+	published bool
+}
+
+// NewMemoryOutbox creates an in-memory outbox whose events are recorded as
+// produced by producer
+func NewMemoryOutbox(producer string) *MemoryOutbox {
+	return &MemoryOutbox{
+		producer: producer,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Add stores an event for publishing. exec is ignored.
+func (o *MemoryOutbox) Add(ctx context.Context, exec Execer, event OrderEvent) error {
+	event.fillEnvelope(o.producer)
+
+	if pending := pendingEventsFrom(ctx); pending != nil {
+		pending.add(o, event)
+		return nil
+	}
+	o.store(event)
+	return nil
+}
+
+// Requeue marks the order's published events of the given types as pending
+// again
+func (o *MemoryOutbox) Requeue(ctx context.Context, exec Execer, orderID string, eventTypes ...string) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var requeued int64
+	for i := range o.events {
+		e := &o.events[i]
+		if e.published && e.event.OrderID == orderID && containsString(eventTypes, e.event.EventType) {
+			e.published = false
+			requeued++
+		}
+	}
+	if requeued > 0 {
+		o.signal()
+	}
+	return requeued, nil
+}
+
+// Events returns every event added to the outbox, in the order they were
+// stored
+func (o *MemoryOutbox) Events() []OrderEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	events := make([]OrderEvent, len(o.events))
+	for i, e := range o.events {
+		events[i] = e.event
+	}
+	return events
+}
+
+// Relay publishes pending events until ctx is cancelled. Failed publishes
+// are retried every 10 milliseconds.
+func (o *MemoryOutbox) Relay(ctx context.Context, publisher Publisher) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		o.relayPending(ctx, publisher)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *MemoryOutbox) relayPending(ctx context.Context, publisher Publisher) {
+	blocked := make(map[string]bool)
+	for i := 0; ; i++ {
+		o.mu.Lock()
+		if i >= len(o.events) {
+			o.mu.Unlock()
+			return
+		}
+		e := o.events[i]
+		o.mu.Unlock()
+
+		if e.published || blocked[e.event.OrderID] {
+			continue
+		}
+		if err := publisher.PublishEvent(ctx, e.event); err != nil {
+			log.Printf("Failed to relay outbox event %s: %v", e.event.EventID, err)
+			blocked[e.event.OrderID] = true
+			continue
+		}
+
+		o.mu.Lock()
+		o.events[i].published = true
+		o.mu.Unlock()
+	}
+}
+
+func (o *MemoryOutbox) store(events ...OrderEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, event := range events {
+		o.events = append(o.events, memoryOutboxEvent{event: event})
+	}
+	o.signal()
+}
+
+func (o *MemoryOutbox) signal() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pendingEvents holds the MemoryOutbox events added while an inbox handles
+// an event, until the handling commits
+type pendingEvents struct {
+	mu      sync.Mutex
+	outbox  []*MemoryOutbox
+	batches map[*MemoryOutbox][]OrderEvent
+}
+
+type pendingEventsKey struct{}
+
+// withPendingEvents returns a context whose MemoryOutbox events are held
+// until release is called
+func withPendingEvents(ctx context.Context) (context.Context, *pendingEvents) {
+	pending := &pendingEvents{batches: make(map[*MemoryOutbox][]OrderEvent)}
+	return context.WithValue(ctx, pendingEventsKey{}, pending), pending
+}
+
+func pendingEventsFrom(ctx context.Context) *pendingEvents {
+	pending, _ := ctx.Value(pendingEventsKey{}).(*pendingEvents)
+	return pending
+}
+
+func (p *pendingEvents) add(outbox *MemoryOutbox, event OrderEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.batches[outbox]; !ok {
+		p.outbox = append(p.outbox, outbox)
+	}
+	p.batches[outbox] = append(p.batches[outbox], event)
+}
+
+// release stores the held events in their outboxes
+func (p *pendingEvents) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, outbox := range p.outbox {
+		outbox.store(p.batches[outbox]...)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,16 +1,21 @@
 package shared
 
-import "time"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 // Order represents the main order entity
 type Order struct {
-	ID          string    `json:"order_id" db:"id"`
-	UserID      string    `json:"user_id" db:"user_id"`
-	TotalAmount float64   `json:"total_amount" db:"total_amount"`
-	Status      string    `json:"status" db:"status"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
-	Items       []OrderItem `json:"items"`
+	ID                 string      `json:"order_id" db:"id"`
+	UserID             string      `json:"user_id" db:"user_id"`
+	TotalAmount        float64     `json:"total_amount" db:"total_amount"`
+	Status             string      `json:"status" db:"status"`
+	CancellationReason string      `json:"cancellation_reason,omitempty" db:"cancellation_reason"`
+	CreatedAt          time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time   `json:"updated_at" db:"updated_at"`
+	Items              []OrderItem `json:"items"`
 }
 
 // OrderItem represents individual items in an order
@@ -24,14 +29,86 @@ type OrderItem struct {
 
 // OrderEvent represents events published to RabbitMQ
 type OrderEvent struct {
-	EventType   string    `json:"event_type"`
-	OrderID     string    `json:"order_id"`
-	UserID      string    `json:"user_id"`
-	TotalAmount float64   `json:"total_amount"`
-	Items       []OrderItem `json:"items,omitempty"`
-	Status      string    `json:"status"`
-	Timestamp   time.Time `json:"timestamp"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	EventID       string                 `json:"event_id"`
+	CorrelationID string                 `json:"correlation_id"`
+	CausationID   string                 `json:"causation_id,omitempty"`
+	Producer      string                 `json:"producer"`
+	SchemaVersion int                    `json:"schema_version"`
+	EventType     string                 `json:"event_type"`
+	OrderID       string                 `json:"order_id"`
+	UserID        string                 `json:"user_id"`
+	TotalAmount   float64                `json:"total_amount"`
+	Items         []OrderItem            `json:"items,omitempty"`
+	Status        string                 `json:"status"`
+	Timestamp     time.Time              `json:"timestamp"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// CurrentSchemaVersion is the version of the OrderEvent envelope and payload
+// written by this code
+const CurrentSchemaVersion = 1
+
+// AMQP headers mirroring envelope fields that have no message property
+const (
+	HeaderCausationID   = "x-causation-id"
+	HeaderSchemaVersion = "x-schema-version"
+)
+
+// FollowUp starts an event emitted in reaction to e. It stays in the same
+// order saga (correlation ID) and records e as its cause.
+func (e OrderEvent) FollowUp(eventType string) OrderEvent {
+	correlationID := e.CorrelationID
+	if correlationID == "" {
+		correlationID = e.OrderID
+	}
+
+	return OrderEvent{
+		CorrelationID: correlationID,
+		CausationID:   e.EventID,
+		EventType:     eventType,
+		OrderID:       e.OrderID,
+		UserID:        e.UserID,
+		TotalAmount:   e.TotalAmount,
+		Timestamp:     time.Now(),
+	}
+}
+
+// StatusChanged builds the OrderStatusChanged event for a status change
+// caused by e. Its metadata is e's metadata with the old and new status and
+// the causing event type added.
+func (e OrderEvent) StatusChanged(oldStatus, newStatus string) OrderEvent {
+	metadata := make(map[string]interface{}, len(e.Metadata)+3)
+	for key, value := range e.Metadata {
+		metadata[key] = value
+	}
+	metadata["old_status"] = oldStatus
+	metadata["new_status"] = newStatus
+	metadata["cause"] = e.EventType
+
+	event := e.FollowUp(EventOrderStatusChanged)
+	event.Status = newStatus
+	event.Metadata = metadata
+	return event
+}
+
+// fillEnvelope sets the envelope fields that were left empty. The
+// correlation ID defaults to the order ID, which identifies the order saga.
+func (e *OrderEvent) fillEnvelope(producer string) {
+	if e.EventID == "" {
+		e.EventID = uuid.New().String()
+	}
+	if e.CorrelationID == "" {
+		e.CorrelationID = e.OrderID
+	}
+	if e.Producer == "" {
+		e.Producer = producer
+	}
+	if e.SchemaVersion == 0 {
+		e.SchemaVersion = CurrentSchemaVersion
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
 }
 
 // Product represents a product in the system
@@ -68,4 +145,36 @@ const (
 	EventOrderShipped           = "OrderShipped"
 	EventOrderDelivered         = "OrderDelivered"
 	EventOrderCancelled         = "OrderCancelled"
+
+	// Compensation commands emitted by the order orchestrator when one half
+	// of the saga succeeded and the other failed. A payment refund request
+	// voids a payment that is only authorized.
+	EventPaymentRefundRequested = "PaymentRefundRequested"
+	EventStockReleaseRequested  = "StockReleaseRequested"
+
+	// Asks the order orchestrator to cancel an order whose saga has not
+	// finished, as the order status watchdog does for orders stuck too long
+	EventOrderCancellationRequested = "OrderCancellationRequested"
+
+	// Results of the compensation commands. Refunds an admin issues for
+	// returns and the like are reported the same way.
+	EventRefundIssued  = "RefundIssued"
+	EventRefundFailed  = "RefundFailed"
+	EventStockReleased = "StockReleased"
+
+	// Emitted by the stock service when it gives back the stock of an order
+	// whose reservation expired before the order was paid
+	EventStockReservationExpired = "StockReservationExpired"
+
+	// Two-phase payments: PaymentSuccessful reports the authorization, which
+	// the payment service captures when the order ships or voids when it is
+	// cancelled. An authorization never captured expires.
+	EventPaymentCaptured             = "PaymentCaptured"
+	EventPaymentCaptureFailed        = "PaymentCaptureFailed"
+	EventPaymentVoided               = "PaymentVoided"
+	EventPaymentAuthorizationExpired = "PaymentAuthorizationExpired"
+
+	// Emitted by whoever commits a change of an order's status, in the same
+	// transaction, so clients can follow the order
+	EventOrderStatusChanged = "OrderStatusChanged"
 ) 
\ No newline at end of file
@@ -0,0 +1,85 @@
+package orderfsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mermaid renders the machine as a Mermaid state diagram. A transition
+// without source states enters the machine; states without outgoing
+// transitions are final.
+func (m *Machine) Mermaid() string {
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+
+	for _, t := range m.transitions {
+		label := transitionLabel(t)
+		if len(t.From) == 0 {
+			fmt.Fprintf(&b, "    [*] --> %s : %s\n", t.To, label)
+		}
+		for _, from := range t.From {
+			fmt.Fprintf(&b, "    %s --> %s : %s\n", from, t.To, label)
+		}
+	}
+	for _, state := range m.finalStates() {
+		fmt.Fprintf(&b, "    %s --> [*]\n", state)
+	}
+
+	return b.String()
+}
+
+// DOT renders the machine as a Graphviz digraph, with final states drawn
+// as double circles
+func (m *Machine) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph order {\n")
+	b.WriteString("    rankdir=LR;\n")
+	b.WriteString("    node [shape=box, style=rounded];\n")
+	b.WriteString("    start [shape=point];\n")
+
+	for _, state := range m.finalStates() {
+		fmt.Fprintf(&b, "    %q [shape=doublecircle];\n", state)
+	}
+	for _, t := range m.transitions {
+		label := transitionLabel(t)
+		if len(t.From) == 0 {
+			fmt.Fprintf(&b, "    start -> %q [label=%q];\n", t.To, label)
+		}
+		for _, from := range t.From {
+			fmt.Fprintf(&b, "    %q -> %q [label=%q];\n", from, t.To, label)
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// finalStates returns the states no transition leaves
+func (m *Machine) finalStates() []State {
+	leaves := make(map[State]bool)
+	for _, t := range m.transitions {
+		for _, from := range t.From {
+			leaves[from] = true
+		}
+	}
+
+	var final []State
+	for _, state := range m.states {
+		if !leaves[state] {
+			final = append(final, state)
+		}
+	}
+	return final
+}
+
+// transitionLabel names the event and any guards in brackets
+func transitionLabel(t Transition) string {
+	if len(t.Guards) == 0 {
+		return string(t.Event)
+	}
+	names := make([]string, len(t.Guards))
+	for i, guard := range t.Guards {
+		names[i] = guard.Name
+	}
+	return fmt.Sprintf("%s [%s]", t.Event, strings.Join(names, ", "))
+}
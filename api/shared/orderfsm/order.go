@@ -0,0 +1,80 @@
+package orderfsm
+
+import (
+	"errors"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// Order states
+const (
+	Created           State = shared.StatusCreated
+	PaymentSuccessful State = shared.StatusPaymentSuccessful
+	PaymentFailed     State = shared.StatusPaymentFailed
+	StockReserved     State = shared.StatusStockReserved
+	StockInsufficient State = shared.StatusStockInsufficient
+	ReadyForShipping  State = shared.StatusReadyForShipping
+	Shipped           State = shared.StatusShipped
+	Delivered         State = shared.StatusDelivered
+	Cancelled         State = shared.StatusCancelled
+)
+
+// NoShipment rejects a transition once a shipment has been created for the
+// order, even if its status does not show it yet
+var NoShipment = Guard{
+	Name: "no shipment created",
+	Check: func(in Input) error {
+		if in.ShipmentCreated {
+			return errors.New("a shipment has already been created")
+		}
+		return nil
+	},
+}
+
+// Order is the order lifecycle. Payment and stock run in parallel, so an
+// order may report either outcome first; the orchestrator decides when it
+// is ready for shipping. Orders can be cancelled until they ship.
+var Order = mustNew(Created,
+	[]State{
+		Created,
+		PaymentSuccessful,
+		PaymentFailed,
+		StockReserved,
+		StockInsufficient,
+		ReadyForShipping,
+		Shipped,
+		Delivered,
+		Cancelled,
+	},
+	[]Transition{
+		{Event: Event(shared.EventOrderCreated), To: Created},
+		{Event: Event(shared.EventPaymentSuccessful), From: []State{Created, StockReserved}, To: PaymentSuccessful},
+		{Event: Event(shared.EventPaymentFailed), From: []State{Created, StockReserved}, To: PaymentFailed},
+		{Event: Event(shared.EventStockReserved), From: []State{Created, PaymentSuccessful}, To: StockReserved},
+		{Event: Event(shared.EventStockInsufficient), From: []State{Created, PaymentSuccessful}, To: StockInsufficient},
+		{Event: Event(shared.EventOrderReadyForShipping), From: []State{PaymentSuccessful, StockReserved}, To: ReadyForShipping},
+		{Event: Event(shared.EventOrderShipped), From: []State{ReadyForShipping}, To: Shipped},
+		{Event: Event(shared.EventOrderDelivered), From: []State{Shipped}, To: Delivered},
+		{
+			Event: Event(shared.EventOrderCancelled),
+			From: []State{
+				Created,
+				PaymentSuccessful,
+				PaymentFailed,
+				StockReserved,
+				StockInsufficient,
+				ReadyForShipping,
+			},
+			To:     Cancelled,
+			Guards: []Guard{NoShipment},
+		},
+	},
+)
+
+func mustNew(initial State, states []State, transitions []Transition) *Machine {
+	m, err := New(initial, states, transitions)
+	if err != nil {
+		panic("orderfsm: " + err.Error())
+	}
+	return m
+}
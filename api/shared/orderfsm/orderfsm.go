@@ -0,0 +1,188 @@
+// Package orderfsm defines the order lifecycle once: the statuses an order
+// can be in, the events that move it, the transitions each event may make
+// and the guards a transition must pass. Services apply events through
+// Order instead of keeping their own transition tables, and the diagrams
+// are exported from the same definition.
+package orderfsm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State is an order status
+type State string
+
+// Event is an order event type
+type Event string
+
+var (
+	ErrUnknownState      = errors.New("unknown order state")
+	ErrUnknownEvent      = errors.New("unknown order event")
+	ErrInvalidTransition = errors.New("invalid order transition")
+	ErrGuardRejected     = errors.New("order transition rejected")
+)
+
+// TransitionError reports why an event could not be applied. It wraps one
+// of the errors above, so callers check it with errors.Is.
+type TransitionError struct {
+	From  State
+	Event Event
+	To    State
+	Guard string // set when a guard rejected the transition
+	Cause error  // the guard's reason
+	Err   error
+}
+
+func (e *TransitionError) Error() string {
+	switch {
+	case e.Guard != "":
+		return fmt.Sprintf("%v: %s -> %s on %s: %s: %v", e.Err, e.From, e.To, e.Event, e.Guard, e.Cause)
+	case e.To != "":
+		return fmt.Sprintf("%v: %s -> %s on %s", e.Err, e.From, e.To, e.Event)
+	case errors.Is(e.Err, ErrUnknownEvent):
+		return fmt.Sprintf("%v: %s", e.Err, e.Event)
+	default:
+		return fmt.Sprintf("%v: %s", e.Err, e.From)
+	}
+}
+
+func (e *TransitionError) Unwrap() error {
+	return e.Err
+}
+
+// Input carries what guards may look at besides the states
+type Input struct {
+	Metadata        map[string]interface{}
+	ShipmentCreated bool
+}
+
+// Guard is a named condition a transition must satisfy. Check returns why
+// the transition is not allowed, or nil.
+type Guard struct {
+	Name  string
+	Check func(in Input) error
+}
+
+// Transition moves an order in any of the From states to To when Event is
+// applied and all guards pass
+type Transition struct {
+	From   []State
+	Event  Event
+	To     State
+	Guards []Guard
+}
+
+// Machine is a validated state machine definition. Every event has one
+// target state. Applying an event to an order already in its target state
+// is allowed and changes nothing, so redelivered events are harmless.
+type Machine struct {
+	initial     State
+	states      []State
+	transitions []Transition
+	known       map[State]bool
+	byEvent     map[Event]Transition
+}
+
+// New validates a definition: the states are unique, every transition
+// starts and ends in a known state and each event has a single transition
+func New(initial State, states []State, transitions []Transition) (*Machine, error) {
+	m := &Machine{
+		initial:     initial,
+		states:      states,
+		transitions: transitions,
+		known:       make(map[State]bool, len(states)),
+		byEvent:     make(map[Event]Transition, len(transitions)),
+	}
+
+	for _, state := range states {
+		if m.known[state] {
+			return nil, fmt.Errorf("state %s defined twice", state)
+		}
+		m.known[state] = true
+	}
+	if !m.known[initial] {
+		return nil, fmt.Errorf("initial state %s is not defined", initial)
+	}
+
+	for _, t := range transitions {
+		if _, exists := m.byEvent[t.Event]; exists {
+			return nil, fmt.Errorf("event %s has more than one transition", t.Event)
+		}
+		if !m.known[t.To] {
+			return nil, fmt.Errorf("event %s leads to undefined state %s", t.Event, t.To)
+		}
+		for _, from := range t.From {
+			if !m.known[from] {
+				return nil, fmt.Errorf("event %s starts from undefined state %s", t.Event, from)
+			}
+		}
+		m.byEvent[t.Event] = t
+	}
+
+	return m, nil
+}
+
+// Initial returns the state a new order starts in
+func (m *Machine) Initial() State {
+	return m.initial
+}
+
+// States returns the states in definition order
+func (m *Machine) States() []State {
+	return append([]State(nil), m.states...)
+}
+
+// Transitions returns the transitions in definition order
+func (m *Machine) Transitions() []Transition {
+	return append([]Transition(nil), m.transitions...)
+}
+
+// Target returns the state event moves an order to
+func (m *Machine) Target(event Event) (State, bool) {
+	t, ok := m.byEvent[event]
+	return t.To, ok
+}
+
+// Apply returns the state an order in from moves to on event, or a
+// *TransitionError saying why it cannot
+func (m *Machine) Apply(from State, event Event, in Input) (State, error) {
+	if !m.known[from] {
+		return "", &TransitionError{From: from, Event: event, Err: ErrUnknownState}
+	}
+	t, ok := m.byEvent[event]
+	if !ok {
+		return "", &TransitionError{From: from, Event: event, Err: ErrUnknownEvent}
+	}
+
+	// Applying an event again is idempotent
+	if from == t.To {
+		return from, nil
+	}
+
+	if !containsState(t.From, from) {
+		return "", &TransitionError{From: from, Event: event, To: t.To, Err: ErrInvalidTransition}
+	}
+	for _, guard := range t.Guards {
+		if err := guard.Check(in); err != nil {
+			return "", &TransitionError{From: from, Event: event, To: t.To, Guard: guard.Name, Cause: err, Err: ErrGuardRejected}
+		}
+	}
+
+	return t.To, nil
+}
+
+// Can reports whether Apply would succeed
+func (m *Machine) Can(from State, event Event, in Input) bool {
+	_, err := m.Apply(from, event, in)
+	return err == nil
+}
+
+func containsState(states []State, state State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
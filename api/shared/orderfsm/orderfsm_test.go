@@ -0,0 +1,167 @@
+package orderfsm
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden diagrams")
+
+func TestOrderAllowedTransitions(t *testing.T) {
+	tests := []struct {
+		from  State
+		event string
+		want  State
+	}{
+		{Created, shared.EventPaymentSuccessful, PaymentSuccessful},
+		{Created, shared.EventPaymentFailed, PaymentFailed},
+		{Created, shared.EventStockReserved, StockReserved},
+		{Created, shared.EventStockInsufficient, StockInsufficient},
+		{StockReserved, shared.EventPaymentSuccessful, PaymentSuccessful},
+		{StockReserved, shared.EventPaymentFailed, PaymentFailed},
+		{PaymentSuccessful, shared.EventStockReserved, StockReserved},
+		{PaymentSuccessful, shared.EventStockInsufficient, StockInsufficient},
+		{PaymentSuccessful, shared.EventOrderReadyForShipping, ReadyForShipping},
+		{StockReserved, shared.EventOrderReadyForShipping, ReadyForShipping},
+		{ReadyForShipping, shared.EventOrderShipped, Shipped},
+		{Shipped, shared.EventOrderDelivered, Delivered},
+		{Created, shared.EventOrderCancelled, Cancelled},
+		{PaymentFailed, shared.EventOrderCancelled, Cancelled},
+		{StockInsufficient, shared.EventOrderCancelled, Cancelled},
+		{ReadyForShipping, shared.EventOrderCancelled, Cancelled},
+
+		// Redelivered events leave the order where it is
+		{Created, shared.EventOrderCreated, Created},
+		{Shipped, shared.EventOrderShipped, Shipped},
+		{Cancelled, shared.EventOrderCancelled, Cancelled},
+	}
+
+	for _, tt := range tests {
+		got, err := Order.Apply(tt.from, Event(tt.event), Input{})
+		if err != nil {
+			t.Errorf("%s on %s: %v", tt.event, tt.from, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s on %s = %s, want %s", tt.event, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestOrderForbiddenTransitions(t *testing.T) {
+	tests := []struct {
+		from  State
+		event string
+		want  error
+	}{
+		{Created, shared.EventOrderShipped, ErrInvalidTransition},
+		{Created, shared.EventOrderReadyForShipping, ErrInvalidTransition},
+		{PaymentFailed, shared.EventPaymentSuccessful, ErrInvalidTransition},
+		{StockInsufficient, shared.EventStockReserved, ErrInvalidTransition},
+		{ReadyForShipping, shared.EventPaymentFailed, ErrInvalidTransition},
+		{Shipped, shared.EventOrderCancelled, ErrInvalidTransition},
+		{Delivered, shared.EventOrderCancelled, ErrInvalidTransition},
+		{Cancelled, shared.EventOrderShipped, ErrInvalidTransition},
+		{Cancelled, shared.EventPaymentSuccessful, ErrInvalidTransition},
+		{Shipped, shared.EventOrderCreated, ErrInvalidTransition},
+		{Created, shared.EventStockReservationExpired, ErrUnknownEvent},
+		{State("LOST"), shared.EventOrderCancelled, ErrUnknownState},
+	}
+
+	for _, tt := range tests {
+		_, err := Order.Apply(tt.from, Event(tt.event), Input{})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s on %s: err = %v, want %v", tt.event, tt.from, err, tt.want)
+		}
+		var transitionErr *TransitionError
+		if !errors.As(err, &transitionErr) {
+			t.Errorf("%s on %s: err is %T, want *TransitionError", tt.event, tt.from, err)
+		}
+		if Order.Can(tt.from, Event(tt.event), Input{}) {
+			t.Errorf("Can(%s, %s) = true, want false", tt.from, tt.event)
+		}
+	}
+}
+
+func TestNoShipmentGuard(t *testing.T) {
+	shipped := Input{ShipmentCreated: true}
+	cancel := Event(shared.EventOrderCancelled)
+
+	_, err := Order.Apply(ReadyForShipping, cancel, shipped)
+	if !errors.Is(err, ErrGuardRejected) {
+		t.Fatalf("cancelling with a shipment: err = %v, want ErrGuardRejected", err)
+	}
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.Guard != NoShipment.Name {
+		t.Errorf("rejected by guard %q, want %q", transitionErr.Guard, NoShipment.Name)
+	}
+
+	// The guard only applies to transitions that change the state
+	if got, err := Order.Apply(Cancelled, cancel, shipped); err != nil || got != Cancelled {
+		t.Errorf("cancelling a cancelled order with a shipment = %s, %v; want %s", got, err, Cancelled)
+	}
+	if got, err := Order.Apply(ReadyForShipping, Event(shared.EventOrderShipped), shipped); err != nil || got != Shipped {
+		t.Errorf("shipping with a shipment = %s, %v; want %s", got, err, Shipped)
+	}
+}
+
+func TestNewRejectsInvalidDefinitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		initial     State
+		states      []State
+		transitions []Transition
+	}{
+		{"duplicate state", Created, []State{Created, Created}, nil},
+		{"undefined initial state", Shipped, []State{Created}, nil},
+		{"undefined target", Created, []State{Created}, []Transition{
+			{Event: "OrderShipped", From: []State{Created}, To: Shipped},
+		}},
+		{"undefined source", Created, []State{Created, Shipped}, []Transition{
+			{Event: "OrderShipped", From: []State{ReadyForShipping}, To: Shipped},
+		}},
+		{"event defined twice", Created, []State{Created, Shipped}, []Transition{
+			{Event: "OrderShipped", From: []State{Created}, To: Shipped},
+			{Event: "OrderShipped", From: []State{Shipped}, To: Created},
+		}},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(tt.initial, tt.states, tt.transitions); err == nil {
+			t.Errorf("%s: New succeeded, want an error", tt.name)
+		}
+	}
+}
+
+// TestDiagrams compares the diagrams with the golden files in testdata.
+// Run with -update after changing the lifecycle to rewrite them.
+func TestDiagrams(t *testing.T) {
+	tests := []struct {
+		file string
+		got  string
+	}{
+		{"order.mmd", Order.Mermaid()},
+		{"order.dot", Order.DOT()},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join("testdata", tt.file)
+		if *update {
+			if err := os.WriteFile(path, []byte(tt.got), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.got != string(want) {
+			t.Errorf("%s differs from the golden file:\n%s", tt.file, tt.got)
+		}
+	}
+}
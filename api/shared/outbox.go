@@ -0,0 +1,268 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Execer is implemented by *sql.DB and *sql.Tx
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// EventOutbox stores events for publishing together with the state change
+// that produced them. It is implemented by Outbox and by the in-process
+// MemoryOutbox.
+type EventOutbox interface {
+	Add(ctx context.Context, exec Execer, event OrderEvent) error
+	Requeue(ctx context.Context, exec Execer, orderID string, eventTypes ...string) (int64, error)
+	Relay(ctx context.Context, publisher Publisher)
+}
+
+var (
+	_ EventOutbox = (*Outbox)(nil)
+	_ EventOutbox = (*MemoryOutbox)(nil)
+)
+
+// Outbox stores events in the database in the same transaction as the state
+// change that produced them. Relay publishes the stored events afterwards,
+// so an event is never lost when the broker is down or the process dies
+// between the commit and the publish.
+type Outbox struct {
+	db           *sql.DB
+	producer     string
+	pollInterval time.Duration
+	batchSize    int
+}
+
+// NewOutbox creates an outbox backed by the outbox table. producer is the
+// service name recorded in the envelope of stored events.
+func NewOutbox(db *sql.DB, producer string, pollInterval time.Duration) *Outbox {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	return &Outbox{
+		db:           db,
+		producer:     producer,
+		pollInterval: pollInterval,
+		batchSize:    100,
+	}
+}
+
+// Add stores an event for publishing. Pass the transaction that writes the
+// related state so both commit or roll back together. The envelope is filled
+// in here, so a relay that publishes the event twice reuses its event ID.
+// The trace context of ctx is stored with the event and continued by the
+// relay when it publishes.
+func (o *Outbox) Add(ctx context.Context, exec Execer, event OrderEvent) error {
+	event.fillEnvelope(o.producer)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	var traceContext []byte
+	if stored := TraceContext(ctx); stored != nil {
+		if traceContext, err = json.Marshal(stored); err != nil {
+			return fmt.Errorf("failed to marshal trace context: %v", err)
+		}
+	}
+
+	_, err = exec.ExecContext(ctx, `
+		INSERT INTO outbox (id, aggregate_id, producer, event_type, payload, trace_context, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, event.EventID, event.OrderID, o.producer, event.EventType, string(payload), nullableJSON(traceContext), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store %s in outbox: %v", event.EventType, err)
+	}
+
+	return nil
+}
+
+// Requeue marks the order's stored events of the given types as pending
+// again, so a relay publishes them once more under their original event
+// IDs. Consumers that already handled them skip them in their inbox.
+func (o *Outbox) Requeue(ctx context.Context, exec Execer, orderID string, eventTypes ...string) (int64, error) {
+	result, err := exec.ExecContext(ctx, `
+		UPDATE outbox SET published_at = NULL
+		WHERE aggregate_id = $1 AND event_type = ANY($2) AND published_at IS NOT NULL
+	`, orderID, pq.Array(eventTypes))
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue events of order %s: %v", orderID, err)
+	}
+	return result.RowsAffected()
+}
+
+// Relay publishes the producer's pending events until the context is
+// cancelled. Several relays of the same producer may run against the table;
+// each order's events are published by one relay at a time.
+func (o *Outbox) Relay(ctx context.Context, publisher Publisher) {
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			published, err := o.relayBatch(ctx, publisher)
+			if err != nil {
+				log.Printf("Outbox relay failed: %v", err)
+				break
+			}
+			if published == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch publishes the pending events of up to batchSize orders, oldest
+// order first. Each order is claimed with an advisory lock on a session of
+// its own, so no transaction stays open while the broker confirms.
+func (o *Outbox) relayBatch(ctx context.Context, publisher Publisher) (int, error) {
+	rows, err := o.db.QueryContext(ctx, `
+		SELECT aggregate_id
+		FROM outbox
+		WHERE producer = $1 AND published_at IS NULL
+		GROUP BY aggregate_id
+		ORDER BY MIN(created_at)
+		LIMIT $2
+	`, o.producer, o.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var orderIDs []string
+	for rows.Next() {
+		var orderID string
+		if err := rows.Scan(&orderID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(orderIDs) == 0 {
+		return 0, nil
+	}
+
+	conn, err := o.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	published := 0
+	for _, orderID := range orderIDs {
+		n, err := o.relayOrder(ctx, conn, publisher, orderID)
+		published += n
+		if err != nil {
+			return published, err
+		}
+	}
+	return published, nil
+}
+
+// relayOrder publishes the pending events of one order in creation order,
+// marking each as sent once the broker confirmed it. A failed event is left
+// pending together with the later events of the order, so events of an
+// order stay in sequence. An order another relay is publishing is skipped.
+func (o *Outbox) relayOrder(ctx context.Context, conn *sql.Conn, publisher Publisher, orderID string) (int, error) {
+	var locked bool
+	err := conn.QueryRowContext(ctx,
+		"SELECT pg_try_advisory_lock(hashtext($1), hashtext($2))", o.producer, orderID,
+	).Scan(&locked)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock outbox events of order %s: %v", orderID, err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx),
+		"SELECT pg_advisory_unlock(hashtext($1), hashtext($2))", o.producer, orderID)
+
+	// Read after locking, so events another relay published meanwhile are
+	// not published again
+	rows, err := conn.QueryContext(ctx, `
+		SELECT id, payload, trace_context
+		FROM outbox
+		WHERE producer = $1 AND aggregate_id = $2 AND published_at IS NULL
+		ORDER BY created_at
+		LIMIT $3
+	`, o.producer, orderID, o.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type pendingEvent struct {
+		id           string
+		payload      []byte
+		traceContext []byte
+	}
+	var pending []pendingEvent
+	for rows.Next() {
+		var e pendingEvent
+		if err := rows.Scan(&e.id, &e.payload, &e.traceContext); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, e := range pending {
+		var event OrderEvent
+		err := json.Unmarshal(e.payload, &event)
+		if err == nil {
+			var stored map[string]string
+			if len(e.traceContext) > 0 {
+				json.Unmarshal(e.traceContext, &stored) // a broken trace context only starts a new trace
+			}
+			err = publisher.PublishEvent(WithTraceContext(ctx, stored), event)
+		}
+		if err != nil {
+			log.Printf("Failed to relay outbox event %s: %v", e.id, err)
+			_, err = conn.ExecContext(ctx,
+				"UPDATE outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2",
+				err.Error(), e.id,
+			)
+			return published, err
+		}
+
+		_, err = conn.ExecContext(ctx,
+			"UPDATE outbox SET published_at = $1, attempts = attempts + 1 WHERE id = $2",
+			time.Now(), e.id,
+		)
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// nullableJSON stores an empty document as NULL
+func nullableJSON(doc []byte) interface{} {
+	if len(doc) == 0 {
+		return nil
+	}
+	return string(doc)
+}
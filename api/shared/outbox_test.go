@@ -0,0 +1,121 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// recordingPublisher records published events and fails those listed in fail
+type recordingPublisher struct {
+	published []string
+	fail      map[string]bool
+}
+
+func (p *recordingPublisher) PublishEvent(ctx context.Context, event OrderEvent) error {
+	if p.fail[event.EventID] {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, event.EventID)
+	return nil
+}
+
+func outboxPayload(t *testing.T, eventID, orderID string) []byte {
+	t.Helper()
+	payload, err := json.Marshal(OrderEvent{EventID: eventID, EventType: EventOrderCreated, OrderID: orderID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestRelayBatchKeepsOrderSequence(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	outbox := NewOutbox(db, "payment-processing", 0)
+	publisher := &recordingPublisher{fail: map[string]bool{"a1": true}}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT aggregate_id")).
+		WithArgs("payment-processing", 100).
+		WillReturnRows(sqlmock.NewRows([]string{"aggregate_id"}).AddRow("order-a").AddRow("order-b").AddRow("order-c"))
+
+	// Order A: the first event fails, so the second must stay pending
+	mock.ExpectQuery(regexp.QuoteMeta("pg_try_advisory_lock")).
+		WithArgs("payment-processing", "order-a").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, payload, trace_context")).
+		WithArgs("payment-processing", "order-a", 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "trace_context"}).
+			AddRow("a1", outboxPayload(t, "a1", "order-a"), nil).
+			AddRow("a2", outboxPayload(t, "a2", "order-a"), nil))
+	mock.ExpectExec(regexp.QuoteMeta("SET attempts = attempts + 1, last_error")).
+		WithArgs("broker unavailable", "a1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("pg_advisory_unlock")).
+		WithArgs("payment-processing", "order-a").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Order B is published and marked after the publish
+	mock.ExpectQuery(regexp.QuoteMeta("pg_try_advisory_lock")).
+		WithArgs("payment-processing", "order-b").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, payload, trace_context")).
+		WithArgs("payment-processing", "order-b", 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload", "trace_context"}).
+			AddRow("b1", outboxPayload(t, "b1", "order-b"), nil))
+	mock.ExpectExec(regexp.QuoteMeta("SET published_at")).
+		WithArgs(sqlmock.AnyArg(), "b1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("pg_advisory_unlock")).
+		WithArgs("payment-processing", "order-b").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Order C is being published by another relay
+	mock.ExpectQuery(regexp.QuoteMeta("pg_try_advisory_lock")).
+		WithArgs("payment-processing", "order-c").
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+
+	published, err := outbox.relayBatch(context.Background(), publisher)
+	if err != nil {
+		t.Fatalf("relayBatch failed: %v", err)
+	}
+	if published != 1 {
+		t.Errorf("published = %d, want 1", published)
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != "b1" {
+		t.Errorf("published events = %v, want [b1]", publisher.published)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutboxAddRecordsProducer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	outbox := NewOutbox(db, "stock-reservation", 0)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO outbox")).
+		WithArgs(sqlmock.AnyArg(), "order-1", "stock-reservation", EventStockReserved,
+			sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = outbox.Add(context.Background(), db, OrderEvent{EventType: EventStockReserved, OrderID: "order-1"})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
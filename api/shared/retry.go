@@ -0,0 +1,195 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DeadLetterExchange receives messages rejected by a service queue.
+// Each service queue dead-letters with its own name as routing key, so the
+// exchange routes failures to that service's parking-lot queue.
+const DeadLetterExchange = "order_events_dlx"
+
+// Message headers used to track retries
+const (
+	HeaderRetryCount = "x-retry-count"
+	HeaderLastError  = "x-last-error"
+	HeaderParkedAt   = "x-parked-at"
+)
+
+// RetryPolicy controls how failed events are retried before being parked
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy retries three times with 1s, 2s and 4s delays
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: time.Second,
+	MaxDelay:     time.Minute,
+}
+
+// Delay returns the backoff before the given retry attempt (starting at 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+// ParkingLotQueue returns the name of the queue holding a service queue's
+// events that exhausted their retries
+func ParkingLotQueue(queueName string) string {
+	return queueName + ".parking_lot"
+}
+
+// retryQueue returns the name of the delay queue for a given backoff.
+// The delay is part of the name so that changing the policy declares new
+// queues instead of conflicting with the TTL of existing ones.
+func retryQueue(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queueName, delay)
+}
+
+// setupRetryQueues declares the parking-lot queue and one delay queue per
+// retry attempt. Delay queues have no consumers; their messages expire after
+// the TTL and are dead-lettered back to the service queue.
+func (r *RabbitMQ) setupRetryQueues(ch *amqp.Channel, queueName string) error {
+	parkingLot := ParkingLotQueue(queueName)
+	_, err := ch.QueueDeclare(parkingLot, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %v", parkingLot, err)
+	}
+
+	err = ch.QueueBind(parkingLot, queueName, DeadLetterExchange, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s: %v", parkingLot, err)
+	}
+
+	for attempt := 1; attempt <= r.retryPolicy.MaxAttempts; attempt++ {
+		delay := r.retryPolicy.Delay(attempt)
+		_, err := ch.QueueDeclare(
+			retryQueue(queueName, delay),
+			true,
+			false,
+			false,
+			false,
+			amqp.Table{
+				"x-message-ttl":             int64(delay / time.Millisecond),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue for %s: %v", queueName, err)
+		}
+	}
+
+	return nil
+}
+
+type retriesKey struct{}
+
+// withRetries records how often the event being handled was retried
+func withRetries(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, retriesKey{}, retries)
+}
+
+// Retries returns how often the event a handler is given was retried after
+// failing, according to the retry policy. It is 0 on the first delivery.
+func Retries(ctx context.Context) int {
+	retries, _ := ctx.Value(retriesKey{}).(int)
+	return retries
+}
+
+// retryOrPark schedules a failed delivery for another attempt through the
+// matching delay queue, or parks it once the retry policy is exhausted
+func (r *RabbitMQ) retryOrPark(queueName string, d amqp.Delivery, cause error) {
+	// Stream queues have no retry or parking-lot queues; clients resume
+	// from the event store instead
+	if IsStreamQueue(queueName) {
+		log.Printf("Dropping message from %s: %v", queueName, cause)
+		d.Nack(false, false)
+		return
+	}
+
+	attempt := retryCount(d) + 1
+	if attempt > r.retryPolicy.MaxAttempts {
+		r.park(queueName, d, fmt.Sprintf("retries exhausted after %d attempts: %v", attempt-1, cause))
+		return
+	}
+
+	delay := r.retryPolicy.Delay(attempt)
+	err := r.publish(context.Background(), "", retryQueue(queueName, delay), republishing(d, attempt, cause.Error()))
+	if err != nil {
+		log.Printf("Failed to schedule retry for message from %s: %v", queueName, err)
+		d.Nack(false, true) // requeue
+		return
+	}
+
+	log.Printf("Scheduled retry %d/%d for message from %s in %s", attempt, r.retryPolicy.MaxAttempts, queueName, delay)
+	d.Ack(false)
+}
+
+// park moves a delivery to the service's parking-lot queue through the dead
+// letter exchange, recording the reason in the message headers. If that
+// publish fails the delivery is rejected so the broker dead-letters it.
+func (r *RabbitMQ) park(queueName string, d amqp.Delivery, reason string) {
+	msg := republishing(d, retryCount(d), reason)
+	msg.Headers[HeaderParkedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	err := r.publish(context.Background(), DeadLetterExchange, queueName, msg)
+	if err != nil {
+		log.Printf("Failed to park message from %s: %v", queueName, err)
+		d.Nack(false, false) // dead-letter without reason
+		return
+	}
+
+	log.Printf("Parked message from %s: %s", queueName, reason)
+	d.Ack(false)
+}
+
+// republishing copies a delivery into a new persistent message carrying
+// the retry headers
+func republishing(d amqp.Delivery, attempt int, lastError string) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryCount] = int32(attempt)
+	headers[HeaderLastError] = lastError
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: d.CorrelationId,
+		MessageId:     d.MessageId,
+		Timestamp:     d.Timestamp,
+		Type:          d.Type,
+		AppId:         d.AppId,
+		Body:          d.Body,
+	}
+}
+
+// retryCount reads the number of retries already attempted for a delivery
+func retryCount(d amqp.Delivery) int {
+	switch v := d.Headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
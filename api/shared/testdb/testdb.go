@@ -0,0 +1,65 @@
+// Package testdb opens the Postgres database tests run against
+package testdb
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+const schemaFile = "setup-database.sql"
+
+// Open opens the Postgres database in TEST_DATABASE_URL, creating the schema
+// unless table shows an earlier run did. Without it the test is skipped.
+func Open(t *testing.T, table string) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var existing sql.NullString
+	if err := db.QueryRow("SELECT to_regclass($1)", "public."+table).Scan(&existing); err != nil {
+		t.Fatal(err)
+	}
+	if !existing.Valid {
+		schema, err := os.ReadFile(findSchema(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(schema)); err != nil {
+			t.Fatalf("failed to create schema: %v", err)
+		}
+	}
+	return db
+}
+
+// findSchema returns the path of the schema file, looking for it in the
+// test's working directory and each directory above it
+func findSchema(t *testing.T) string {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		path := filepath.Join(dir, schemaFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatalf("%s not found above the working directory", schemaFile)
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Exchange and queue names used across services
+const (
+	OrderEventsExchange = "order_events_exchange"
+
+	PaymentQueue          = "payment_queue"
+	StockReservationQueue = "stock_reservation_queue"
+	ShippingQueue         = "shipping_queue"
+	OrderStatusQueue      = "order_status_queue"
+	OrchestratorQueue     = "order_orchestrator_queue"
+
+	// OrderStreamQueue prefixes the queues feeding the gateway instances'
+	// order status streams; see StreamQueue
+	OrderStreamQueue = "order_stream_queue"
+)
+
+// routingKeys maps event types to the topic routing keys they are published with
+var routingKeys = map[string]string{
+	EventOrderCreated:           "order.created",
+	EventPaymentSuccessful:      "payment.succeeded",
+	EventPaymentFailed:          "payment.failed",
+	EventStockReserved:          "stock.reserved",
+	EventStockInsufficient:      "stock.insufficient",
+	EventOrderReadyForShipping:  "order.ready_for_shipping",
+	EventOrderShipped:           "order.shipped",
+	EventOrderDelivered:         "order.delivered",
+	EventOrderCancelled:         "order.cancelled",
+	EventPaymentRefundRequested: "payment.refund_requested",
+	EventStockReleaseRequested:  "stock.release_requested",
+	EventRefundIssued:           "payment.refund_issued",
+	EventRefundFailed:           "payment.refund_failed",
+	EventStockReleased:          "stock.released",
+
+	EventStockReservationExpired:    "stock.reservation_expired",
+	EventOrderStatusChanged:         "order.status_changed",
+	EventOrderCancellationRequested: "order.cancellation_requested",
+
+	EventPaymentCaptured:             "payment.captured",
+	EventPaymentCaptureFailed:        "payment.capture_failed",
+	EventPaymentVoided:               "payment.voided",
+	EventPaymentAuthorizationExpired: "payment.authorization_expired",
+}
+
+// QueueBindings lists the event types each service queue subscribes to
+var QueueBindings = map[string][]string{
+	PaymentQueue: {
+		EventOrderCreated,
+		EventOrderReadyForShipping,
+		EventOrderShipped,
+		EventPaymentRefundRequested,
+	},
+	StockReservationQueue: {
+		EventOrderCreated,
+		EventStockReleaseRequested,
+		EventOrderShipped,
+	},
+	ShippingQueue: {
+		EventOrderReadyForShipping,
+	},
+	OrderStatusQueue: {
+		EventOrderCreated,
+		EventPaymentSuccessful,
+		EventPaymentFailed,
+		EventStockReserved,
+		EventStockInsufficient,
+		EventOrderReadyForShipping,
+		EventOrderShipped,
+		EventOrderDelivered,
+		EventOrderCancelled,
+	},
+	OrchestratorQueue: {
+		EventOrderCreated,
+		EventPaymentSuccessful,
+		EventPaymentFailed,
+		EventStockReserved,
+		EventStockInsufficient,
+		EventOrderShipped,
+		EventOrderCancelled,
+		EventOrderCancellationRequested,
+		EventRefundIssued,
+		EventRefundFailed,
+		EventStockReleased,
+		EventStockReservationExpired,
+		EventPaymentCaptured,
+		EventPaymentCaptureFailed,
+		EventPaymentVoided,
+		EventPaymentAuthorizationExpired,
+	},
+}
+
+// StreamBindings lists the event types the stream queues subscribe to.
+// Only gateway instances consume them, so they have no route while none is
+// running; publishers ignore that, as clients resume from the event store.
+var StreamBindings = []string{
+	EventOrderStatusChanged,
+}
+
+// StreamQueue returns the stream queue of one gateway instance. Every
+// instance gets all status changes on its own exclusive queue, which the
+// broker deletes when the instance disconnects.
+func StreamQueue(instanceID string) string {
+	return OrderStreamQueue + "." + instanceID
+}
+
+// IsStreamQueue reports whether queueName is a gateway instance's stream
+// queue
+func IsStreamQueue(queueName string) bool {
+	return strings.HasPrefix(queueName, OrderStreamQueue+".")
+}
+
+// bindings returns the event types a queue subscribes to
+func bindings(queueName string) ([]string, bool) {
+	if IsStreamQueue(queueName) {
+		return StreamBindings, true
+	}
+	eventTypes, ok := QueueBindings[queueName]
+	return eventTypes, ok
+}
+
+// isStreamEvent reports whether only stream queues subscribe to eventType
+func isStreamEvent(eventType string) bool {
+	for _, queued := range QueueBindings {
+		if containsString(queued, eventType) {
+			return false
+		}
+	}
+	return containsString(StreamBindings, eventType)
+}
+
+// RoutingKey returns the topic routing key for an event type.
+// Unknown event types are converted from CamelCase to dotted lower case,
+// e.g. "OrderRefunded" becomes "order.refunded".
+func RoutingKey(eventType string) string {
+	if key, ok := routingKeys[eventType]; ok {
+		return key
+	}
+
+	var b strings.Builder
+	for i, r := range eventType {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
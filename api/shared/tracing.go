@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "go-rabbitmq-order-system/shared"
+
+// headerCarrier reads and writes W3C trace context in AMQP message headers
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// startPublishSpan starts a producer span for an event and injects its trace
+// context into headers
+func startPublishSpan(ctx context.Context, destination string, event OrderEvent, headers amqp.Table) (context.Context, trace.Span) {
+	ctx, span := tracer().Start(ctx, destination+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(eventAttributes(destination, event)...),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+	return ctx, span
+}
+
+// startConsumeSpan continues the trace carried in a message's headers with a
+// consumer span covering the handling of the event
+func startConsumeSpan(ctx context.Context, queueName string, event OrderEvent, headers amqp.Table) (context.Context, trace.Span) {
+	if headers != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(headers))
+	}
+	return tracer().Start(ctx, queueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(eventAttributes(queueName, event)...),
+	)
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceContext returns the W3C trace context of ctx as header values, for
+// storing alongside an event that is published later
+func TraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// WithTraceContext returns ctx continuing the trace stored by TraceContext
+func WithTraceContext(ctx context.Context, stored map[string]string) context.Context {
+	if len(stored) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(stored))
+}
+
+// traceLabel formats the trace ID of ctx for log lines, so one order can be
+// followed through the logs of every service
+func traceLabel(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return fmt.Sprintf(" trace_id=%s", spanContext.TraceID())
+}
+
+func eventAttributes(destination string, event OrderEvent) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemRabbitmq,
+		semconv.MessagingDestinationName(destination),
+		semconv.MessagingMessageID(event.EventID),
+		semconv.MessagingMessageConversationID(event.CorrelationID),
+		attribute.String("order.id", event.OrderID),
+		attribute.String("order.event_type", event.EventType),
+	}
+}
@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// WithPrefetch sets how many unacknowledged deliveries the broker sends to
+// each consumer. Keep it at least as high as the number of workers.
+func WithPrefetch(count int) Option {
+	return func(r *RabbitMQ) {
+		if count > 0 {
+			r.prefetch = count
+		}
+	}
+}
+
+// WithWorkers sets how many deliveries of a consumer are handled
+// concurrently. With orderByOrderID, events of the same order are handled
+// one at a time in delivery order while different orders run in parallel.
+// An event scheduled for a retry no longer holds back the later events of
+// its order.
+func WithWorkers(count int, orderByOrderID bool) Option {
+	return func(r *RabbitMQ) {
+		if count > 0 {
+			r.workers = count
+		}
+		r.orderByOrderID = orderByOrderID
+	}
+}
+
+// dispatch feeds deliveries to the consumer's workers until msgs is closed
+// and then waits for the workers to finish. In ordered mode every worker has
+// its own queue and a delivery goes to the worker its order ID hashes to;
+// otherwise all workers take from one queue.
+func (r *RabbitMQ) dispatch(c consumer, msgs <-chan amqp.Delivery) {
+	// Handlers run to completion even while shutting down
+	ctx := context.WithoutCancel(c.ctx)
+
+	queues := make([]chan amqp.Delivery, r.workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		if r.orderByOrderID || i == 0 {
+			queues[i] = make(chan amqp.Delivery, r.prefetch)
+		} else {
+			queues[i] = queues[0]
+		}
+
+		wg.Add(1)
+		go func(queue <-chan amqp.Delivery) {
+			defer wg.Done()
+			for d := range queue {
+				r.handleDelivery(ctx, c, d)
+			}
+		}(queues[i])
+	}
+
+	for d := range msgs {
+		worker := 0
+		if r.orderByOrderID {
+			worker = partition(d.Body, r.workers)
+		}
+		queues[worker] <- d
+	}
+
+	if r.orderByOrderID {
+		for _, queue := range queues {
+			close(queue)
+		}
+	} else {
+		close(queues[0])
+	}
+	wg.Wait()
+}
+
+// handleDelivery decodes a delivery, runs the consumer's handler through the
+// inbox and acknowledges, retries or parks the delivery
+func (r *RabbitMQ) handleDelivery(ctx context.Context, c consumer, d amqp.Delivery) {
+	// Deliveries buffered before the cancel go back to the queue
+	if c.ctx.Err() != nil {
+		d.Nack(false, true)
+		return
+	}
+
+	var event OrderEvent
+	err := json.Unmarshal(d.Body, &event)
+	if err != nil {
+		log.Printf("Error unmarshaling event: %v", err)
+		r.park(c.queueName, d, fmt.Sprintf("malformed event: %v", err)) // never retried
+		return
+	}
+
+	// Events from producers without an envelope fall back to the
+	// message ID, which is kept across retries
+	if event.EventID == "" {
+		event.EventID = d.MessageId
+	}
+
+	ctx, span := startConsumeSpan(ctx, c.queueName, event, d.Headers)
+	ctx, err = prepareEvent(withRetries(ctx, retryCount(d)), r.inbox, event, c.prepare)
+	if err == nil {
+		err = r.inbox.Process(ctx, event, c.handler)
+	}
+	endSpan(span, err)
+	if err != nil {
+		log.Printf("Error handling event: %v%s", err, traceLabel(ctx))
+		r.retryOrPark(c.queueName, d, err)
+		return
+	}
+
+	d.Ack(false) // acknowledge successful processing
+}
+
+// partition maps the order ID of an event body to a worker. Malformed
+// bodies go to the first worker, which parks them.
+func partition(body []byte, workers int) int {
+	var key struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := json.Unmarshal(body, &key); err != nil {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key.OrderID))
+	return int(h.Sum32() % uint32(workers))
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"os"
+	"time"
+
 	"go-rabbitmq-order-system/pkg/config"
 )
 
@@ -9,26 +12,45 @@ type Config struct {
 	Shipping ShippingConfig
 }
 
+// ShippingConfig configures the simulated carrier. An order ready for
+// shipping is scheduled to ship after ProcessingDelay; the dispatcher looks
+// for due shipments every DispatchInterval.
 type ShippingConfig struct {
-	Carriers               []string
-	ProcessingDelayMinutes int
-	PremiumThreshold       float64
-	StandardThreshold      float64
+	Carriers          []string
+	ProcessingDelay   time.Duration
+	DispatchInterval  time.Duration
+	DispatchBatchSize int
+	PremiumThreshold  float64
+	StandardThreshold float64
 }
 
 func Load() *Config {
 	baseConfig := config.LoadBaseConfig()
-	
+
 	return &Config{
 		BaseConfig: baseConfig,
 		Shipping: ShippingConfig{
 			Carriers: []string{
-				"DHL", "UPS", "FedEx", 
+				"DHL", "UPS", "FedEx",
 				"Aras Kargo", "Yurtiçi Kargo", "PTT Kargo",
 			},
-			ProcessingDelayMinutes: 2,     // 2 minutes processing time
-			PremiumThreshold:       5000,  // Premium shipping for orders > 5000
-			StandardThreshold:      1000,  // Standard shipping for orders > 1000
+			ProcessingDelay:   getEnvAsDuration("SHIPPING_PROCESSING_DELAY", "2m"),  // 2 minutes processing time
+			DispatchInterval:  getEnvAsDuration("SHIPPING_DISPATCH_INTERVAL", "5s"), // Look for due shipments every 5 seconds
+			DispatchBatchSize: 100,                                                  // Ship at most 100 orders per check
+			PremiumThreshold:  5000,                                                 // Premium shipping for orders > 5000
+			StandardThreshold: 1000,                                                 // Standard shipping for orders > 1000
 		},
 	}
-} 
\ No newline at end of file
+}
+
+func getEnvAsDuration(key string, defaultValue string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		value = defaultValue
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	duration, _ := time.ParseDuration(defaultValue)
+	return duration
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// dueShipment is a scheduled shipment whose processing delay has passed
+type dueShipment struct {
+	ID             string
+	OrderID        string
+	UserID         string
+	TotalAmount    float64
+	TrackingNumber string
+	Carrier        string
+	EstimatedDays  int
+	Message        string
+	ReadyEventID   string
+}
+
+// RunDispatcher ships scheduled shipments once their processing delay has
+// passed, until ctx is cancelled
+func (s *ShippingService) RunDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(s.config.DispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.dispatchShipments(ctx); err != nil {
+			log.Printf("Shipment dispatch failed: %v", err)
+		}
+	}
+}
+
+// dispatchShipments ships one batch of due shipments in a single
+// transaction. The order and saga rows are held until commit, so a
+// concurrent cancellation either waits and then sees the shipment, or gets
+// there first and the shipment is cancelled.
+func (s *ShippingService) dispatchShipments(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT si.id, si.order_id, o.user_id, o.total_amount, si.tracking_number, si.carrier,
+			COALESCE(si.estimated_delivery_days, 0), COALESCE(si.message, ''), COALESCE(si.ready_event_id, '')
+		FROM shipping_info si
+		JOIN orders o ON o.id = si.order_id
+		WHERE si.status = $1 AND si.ship_after <= $2
+		ORDER BY si.ship_after
+		LIMIT $3
+		FOR UPDATE OF si SKIP LOCKED
+	`, ShipmentScheduled, time.Now(), s.config.DispatchBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to find due shipments: %v", err)
+	}
+	var shipments []dueShipment
+	for rows.Next() {
+		var d dueShipment
+		err := rows.Scan(&d.ID, &d.OrderID, &d.UserID, &d.TotalAmount, &d.TrackingNumber, &d.Carrier,
+			&d.EstimatedDays, &d.Message, &d.ReadyEventID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		shipments = append(shipments, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range shipments {
+		cancelled, err := s.orderCancelled(ctx, tx, d.OrderID, true)
+		if err != nil {
+			return err
+		}
+
+		if cancelled {
+			_, err = tx.ExecContext(ctx, "UPDATE shipping_info SET status = $1 WHERE id = $2", ShipmentCancelled, d.ID)
+			if err != nil {
+				return fmt.Errorf("failed to cancel shipment of order %s: %v", d.OrderID, err)
+			}
+			log.Printf("Shipment halted: order %s was cancelled or is being cancelled", d.OrderID)
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE shipping_info SET status = $1, shipped_at = $2 WHERE id = $3
+		`, ShipmentShipped, time.Now(), d.ID)
+		if err != nil {
+			return fmt.Errorf("failed to mark shipment of order %s shipped: %v", d.OrderID, err)
+		}
+
+		err = s.outbox.Add(ctx, tx, shared.OrderEvent{
+			CorrelationID: d.OrderID,
+			CausationID:   d.ReadyEventID,
+			EventType:     shared.EventOrderShipped,
+			OrderID:       d.OrderID,
+			UserID:        d.UserID,
+			TotalAmount:   d.TotalAmount,
+			Status:        shared.EventOrderShipped,
+			Timestamp:     time.Now(),
+			Metadata: map[string]interface{}{
+				"tracking_number": d.TrackingNumber,
+				"carrier":         d.Carrier,
+				"estimated_days":  d.EstimatedDays,
+				"message":         d.Message,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Shipped order %s via %s", d.OrderID, d.Carrier)
+	}
+
+	return tx.Commit()
+}
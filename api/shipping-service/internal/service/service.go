@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -13,10 +14,24 @@ import (
 	"github.com/google/uuid"
 )
 
+// Shipment statuses
+const (
+	ShipmentScheduled = "SCHEDULED"
+	ShipmentShipped   = "SHIPPED"
+	ShipmentCancelled = "CANCELLED"
+)
+
+// Statuses of the orchestrator's saga of an order that is being or has
+// been cancelled
+const (
+	sagaCompensating = "COMPENSATING"
+	sagaCancelled    = "CANCELLED"
+)
+
 type ShippingService struct {
-	db       *sql.DB
-	rabbitMQ *shared.RabbitMQ
-	config   *config.ShippingConfig
+	db     *sql.DB
+	outbox shared.EventOutbox
+	config *config.ShippingConfig
 }
 
 type ShippingResult struct {
@@ -27,123 +42,104 @@ type ShippingResult struct {
 	EstimatedDays  int    `json:"estimated_days"`
 }
 
-func New(db *sql.DB, rabbitMQ *shared.RabbitMQ, config *config.ShippingConfig) *ShippingService {
+func New(db *sql.DB, outbox shared.EventOutbox, config *config.ShippingConfig) *ShippingService {
 	return &ShippingService{
-		db:       db,
-		rabbitMQ: rabbitMQ,
-		config:   config,
+		db:     db,
+		outbox: outbox,
+		config: config,
 	}
 }
 
-func (s *ShippingService) HandleOrderEvent(event shared.OrderEvent) error {
+// HandleOrderEvent handles an event in the inbox transaction that marks it
+// as processed, so a redelivered event never schedules an order twice
+func (s *ShippingService) HandleOrderEvent(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
 	log.Printf("Received event: %s for order: %s", event.EventType, event.OrderID)
 
-	// Process different types of events
-	switch event.EventType {
-	case shared.EventPaymentSuccessful:
-		return s.checkReadyForShipping(event.OrderID)
-	case shared.EventStockReserved:
-		return s.checkReadyForShipping(event.OrderID)
-	default:
-		// Ignore other events
+	// The order orchestrator decides when an order is ready for shipping
+	if event.EventType != shared.EventOrderReadyForShipping {
 		return nil
 	}
-}
 
-func (s *ShippingService) checkReadyForShipping(orderID string) error {
-	// Check if both payment is successful and stock is reserved
-	var orderStatus string
-	var totalAmount float64
-	err := s.db.QueryRow(`
-		SELECT status, total_amount 
-		FROM orders 
-		WHERE id = $1
-	`, orderID).Scan(&orderStatus, &totalAmount)
-	
+	// Never schedule an order twice, even if the decision is re-emitted
+	var scheduled bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM shipping_info WHERE order_id = $1)
+	`, event.OrderID).Scan(&scheduled)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("Order %s not found, skipping", orderID)
-			return nil // Don't requeue if order doesn't exist
-		}
-		log.Printf("Failed to get order status: %v", err)
-		return nil // Don't requeue on other DB errors either
+		return fmt.Errorf("failed to check shipping info: %v", err)
 	}
-
-	// Check payment status
-	var paymentTransactionStatus string
-	err = s.db.QueryRow(`
-		SELECT status 
-		FROM payment_transactions 
-		WHERE order_id = $1
-	`, orderID).Scan(&paymentTransactionStatus)
-	
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("Payment not found for order %s, skipping", orderID)
-			return nil // Payment might not be processed yet
-		}
-		log.Printf("Failed to check payment status: %v", err)
+	if scheduled {
+		log.Printf("Order %s already scheduled for shipping, skipping", event.OrderID)
 		return nil
 	}
 
-	// Check stock reservation
-	var stockReservationCount int
-	err = s.db.QueryRow(`
-		SELECT COUNT(*) 
-		FROM stock_reservations 
-		WHERE order_id = $1 AND status = 'RESERVED'
-	`, orderID).Scan(&stockReservationCount)
-	
+	cancelled, err := s.orderCancelled(ctx, tx, event.OrderID, false)
 	if err != nil {
-		log.Printf("Failed to check stock reservations: %v", err)
+		return err
+	}
+	if cancelled {
+		log.Printf("Order %s was cancelled, not shipping", event.OrderID)
 		return nil
 	}
 
-	// If both payment and stock reservation are successful, proceed with shipping
-	if paymentTransactionStatus == "SUCCESS" && stockReservationCount > 0 {
-		return s.processShipping(orderID, totalAmount)
-	}
+	return s.scheduleShipment(ctx, tx, event)
+}
 
-	log.Printf("Order %s not ready for shipping yet. Payment: %s, Stock reservations: %d", 
-		orderID, paymentTransactionStatus, stockReservationCount)
+// scheduleShipment books the order with a carrier to ship after the
+// processing delay. The dispatcher ships it then, outside of this event's
+// transaction.
+func (s *ShippingService) scheduleShipment(ctx context.Context, tx *sql.Tx, cause shared.OrderEvent) error {
+	log.Printf("Scheduling shipment for order: %s, amount: %.2f", cause.OrderID, cause.TotalAmount)
+
+	result := s.createShipment(cause.TotalAmount)
+	shipAfter := time.Now().Add(s.config.ProcessingDelay)
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO shipping_info (id, order_id, tracking_number, carrier, estimated_delivery_days, status, message,
+			ready_event_id, ship_after, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, uuid.New().String(), cause.OrderID, result.TrackingNumber, result.Carrier,
+		result.EstimatedDays, ShipmentScheduled, result.Message, cause.EventID, shipAfter, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to schedule shipment: %v", err)
+	}
 	return nil
 }
 
-func (s *ShippingService) processShipping(orderID string, totalAmount float64) error {
-	log.Printf("Processing shipping for order: %s, amount: %.2f", orderID, totalAmount)
-
-	// Create shipment
-	result := s.createShipment(totalAmount)
+// orderCancelled reports whether the order has been cancelled or the
+// orchestrator is cancelling it. The order is only marked cancelled once
+// its refund and stock release are done, so a saga that is compensating or
+// cancelled counts as well. With lock the order and saga rows are held
+// against cancellation until the transaction ends.
+func (s *ShippingService) orderCancelled(ctx context.Context, tx *sql.Tx, orderID string, lock bool) (bool, error) {
+	orderQuery := "SELECT status FROM orders WHERE id = $1"
+	sagaQuery := "SELECT status FROM order_sagas WHERE order_id = $1"
+	if lock {
+		orderQuery += " FOR SHARE"
+		sagaQuery += " FOR SHARE"
+	}
 
-	// Store shipping information
-	err := s.storeShippingInfo(orderID, result)
+	var status string
+	err := tx.QueryRowContext(ctx, orderQuery, orderID).Scan(&status)
 	if err != nil {
-		log.Printf("Failed to store shipping info: %v", err)
-		return err
+		return false, fmt.Errorf("failed to check order status: %v", err)
 	}
-
-	// Publish shipping event
-	shippingEvent := shared.OrderEvent{
-		EventType:   shared.EventOrderShipped,
-		OrderID:     orderID,
-		TotalAmount: totalAmount,
-		Status:      shared.EventOrderShipped,
-		Timestamp:   time.Now(),
-		Metadata: map[string]interface{}{
-			"tracking_number": result.TrackingNumber,
-			"carrier":         result.Carrier,
-			"estimated_days":  result.EstimatedDays,
-			"message":         result.Message,
-		},
+	if status == shared.StatusCancelled {
+		return true, nil
 	}
 
-	return s.rabbitMQ.PublishEvent(shippingEvent)
+	var sagaStatus string
+	err = tx.QueryRowContext(ctx, sagaQuery, orderID).Scan(&sagaStatus)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check saga status: %v", err)
+	}
+	return sagaStatus == sagaCompensating || sagaStatus == sagaCancelled, nil
 }
 
 func (s *ShippingService) createShipment(totalAmount float64) ShippingResult {
-	// Simulate processing time
-	time.Sleep(time.Duration(s.config.ProcessingDelayMinutes) * time.Minute)
-
 	// Random carrier selection
 	carrier := s.config.Carriers[rand.Intn(len(s.config.Carriers))]
 
@@ -174,13 +170,3 @@ func (s *ShippingService) createShipment(totalAmount float64) ShippingResult {
 		EstimatedDays:  estimatedDays,
 	}
 }
-
-func (s *ShippingService) storeShippingInfo(orderID string, result ShippingResult) error {
-	_, err := s.db.Exec(`
-		INSERT INTO shipping_info (id, order_id, tracking_number, carrier, estimated_delivery_days, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, uuid.New().String(), orderID, result.TrackingNumber, result.Carrier, 
-		result.EstimatedDays, "SHIPPED", time.Now())
-
-	return err
-} 
\ No newline at end of file
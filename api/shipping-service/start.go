@@ -0,0 +1,18 @@
+// Package shipping starts the shipping service with its configuration from the
+// environment, for tests that run the services in one process.
+package shipping
+
+import (
+	"context"
+	"database/sql"
+
+	"go-rabbitmq-order-system/shared"
+	"go-rabbitmq-order-system/shipping-service/internal/app"
+	"go-rabbitmq-order-system/shipping-service/internal/config"
+)
+
+// Start starts the service on db and broker, storing its events in outbox,
+// until ctx ends. It does not block.
+func Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	return app.New(config.Load()).Start(ctx, db, broker, outbox)
+}
@@ -1,17 +1,23 @@
 package app
 
 import (
+	"context"
+	"database/sql"
 	"log"
 
 	"go-rabbitmq-order-system/stock-reservation-service/internal/config"
 	"go-rabbitmq-order-system/stock-reservation-service/internal/service"
+	"go-rabbitmq-order-system/pkg/tracing"
 	"go-rabbitmq-order-system/shared"
 )
 
+// serviceName identifies this service as the producer of its events
+const serviceName = "stock-reservation"
+
 type App struct {
 	config   *config.Config
 	database *shared.Database
-	rabbitMQ *shared.RabbitMQ
+	broker   shared.Broker
 }
 
 func New(cfg *config.Config) *App {
@@ -20,7 +26,14 @@ func New(cfg *config.Config) *App {
 	}
 }
 
-func (a *App) Run() error {
+func (a *App) Run(ctx context.Context) error {
+	// Initialize tracing
+	shutdownTracing, err := tracing.Init(ctx, serviceName, a.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer tracing.Flush(shutdownTracing, a.config.ShutdownTimeout)
+
 	// Initialize database
 	db, err := shared.NewDatabase(a.config.Database.URL)
 	if err != nil {
@@ -29,34 +42,75 @@ func (a *App) Run() error {
 	a.database = db
 
 	// Initialize RabbitMQ
-	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL)
+	rabbitmq, err := shared.NewRabbitMQ(a.config.RabbitMQ.URL,
+		shared.WithRetryPolicy(shared.RetryPolicy{
+			MaxAttempts:  a.config.RabbitMQ.RetryAttempts,
+			InitialDelay: a.config.RabbitMQ.RetryDelay,
+			MaxDelay:     a.config.RabbitMQ.MaxRetryDelay,
+		}),
+		shared.WithReconnectBackoff(a.config.RabbitMQ.ReconnectDelay, a.config.RabbitMQ.MaxReconnectDelay),
+		shared.WithPublishWait(a.config.RabbitMQ.PublishWait),
+		shared.WithPublishTimeout(a.config.RabbitMQ.PublishTimeout),
+		shared.WithPrefetch(a.config.Consumer.Prefetch),
+		shared.WithWorkers(a.config.Consumer.Workers, a.config.Consumer.OrderByOrderID),
+		shared.WithProducer(serviceName),
+		shared.WithEventStore(shared.NewEventStore(db.DB)),
+		shared.WithInbox(shared.NewInbox(db.DB, serviceName)),
+		shared.WithStateHook(shared.LogConnectionState(serviceName)),
+	)
 	if err != nil {
 		return err
 	}
-	a.rabbitMQ = rabbitmq
+	a.broker = rabbitmq
 
-	// Initialize service
-	stockService := service.New(db.DB, rabbitmq, &a.config.StockReservation)
-
-	// Start consuming events
-	err = rabbitmq.ConsumeEvents("stock_reservation_queue", stockService.HandleOrderEvent)
-	if err != nil {
+	outbox := shared.NewOutbox(db.DB, serviceName, a.config.Outbox.PollInterval)
+	if err := a.Start(ctx, db.DB, rabbitmq, outbox); err != nil {
 		return err
 	}
 
 	log.Println("Stock Reservation Service started")
 	log.Println("Waiting for order events...")
 
-	// Keep the service running
-	select {}
+	// Run until a shutdown signal cancels the context
+	<-ctx.Done()
+	log.Println("Shutting down Stock Reservation Service")
+	return a.Close()
+}
+
+// Start sets up the service's queue on the broker, starts relaying the outbox
+// and the reservation expiry sweeper and consumes events until ctx ends. It
+// does not block.
+func (a *App) Start(ctx context.Context, db *sql.DB, broker shared.Broker, outbox shared.EventOutbox) error {
+	// Setup exchange and this service's queue bindings
+	if err := broker.SetupExchange(); err != nil {
+		return err
+	}
+	if err := broker.SetupQueue(shared.StockReservationQueue); err != nil {
+		return err
+	}
+
+	// Start publishing stored events
+	go outbox.Relay(ctx, broker)
+
+	// Initialize service and release reservations that expire unpaid
+	stockService := service.New(db, outbox, &a.config.StockReservation)
+	go stockService.RunExpirySweeper(ctx)
+
+	// Start consuming events
+	return broker.ConsumeEvents(ctx, shared.StockReservationQueue, stockService.HandleOrderEvent)
 }
 
+// Close waits for in-flight events to be handled, up to the shutdown
+// timeout, and then closes the broker and database connections
 func (a *App) Close() error {
+	var err error
+	if a.broker != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
+		defer cancel()
+		err = a.broker.Shutdown(ctx)
+	}
 	if a.database != nil {
 		a.database.Close()
 	}
-	if a.rabbitMQ != nil {
-		a.rabbitMQ.Close()
-	}
-	return nil
+	return err
 } 
\ No newline at end of file
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"go-rabbitmq-order-system/pkg/config"
 )
 
@@ -12,7 +14,8 @@ type Config struct {
 type StockReservationConfig struct {
 	ReservationTimeoutMinutes int
 	LockTimeoutSeconds        int
-	RetryAttempts             int
+	ExpiryCheckInterval       time.Duration
+	ExpiryBatchSize           int
 }
 
 func Load() *Config {
@@ -21,9 +24,10 @@ func Load() *Config {
 	return &Config{
 		BaseConfig: baseConfig,
 		StockReservation: StockReservationConfig{
-			ReservationTimeoutMinutes: 15, // 15 minutes reservation timeout
-			LockTimeoutSeconds:        30, // 30 seconds lock timeout
-			RetryAttempts:             3,  // 3 retry attempts
+			ReservationTimeoutMinutes: 15,          // 15 minutes reservation timeout
+			LockTimeoutSeconds:        30,          // 30 seconds lock timeout
+			ExpiryCheckInterval:       time.Minute, // Look for expired reservations every minute
+			ExpiryBatchSize:           100,         // Expire at most 100 reservations per check
 		},
 	}
 } 
\ No newline at end of file
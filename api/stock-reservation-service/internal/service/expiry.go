@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"go-rabbitmq-order-system/shared"
+)
+
+// expiredOrder is an order holding reservations that expired before it was
+// paid
+type expiredOrder struct {
+	OrderID     string
+	UserID      string
+	TotalAmount float64
+}
+
+// RunExpirySweeper gives back the stock of reservations that expired before
+// their order was paid, until ctx is cancelled
+func (s *StockService) RunExpirySweeper(ctx context.Context) {
+	ticker := time.NewTicker(s.config.ExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.expireReservations(ctx); err != nil {
+			log.Printf("Stock reservation expiry check failed: %v", err)
+		}
+	}
+}
+
+// expireReservations releases one batch of expired reservations in a single
+// transaction. Each affected order gets a StockReservationExpired event, on
+// which the orchestrator cancels it.
+func (s *StockService) expireReservations(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	orders, err := s.lockExpiredOrders(ctx, tx, s.config.ExpiryBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		released, err := s.releaseReservations(ctx, tx, order.OrderID, "EXPIRED")
+		if err != nil {
+			return err
+		}
+		if len(released) == 0 {
+			// A release request got to the order first
+			continue
+		}
+
+		message := fmt.Sprintf("Stock reservation expired after %d minutes without payment",
+			s.config.ReservationTimeoutMinutes)
+		err = s.outbox.Add(ctx, tx, shared.OrderEvent{
+			CorrelationID: order.OrderID,
+			EventType:     shared.EventStockReservationExpired,
+			OrderID:       order.OrderID,
+			UserID:        order.UserID,
+			TotalAmount:   order.TotalAmount,
+			Status:        shared.EventStockReservationExpired,
+			Timestamp:     time.Now(),
+			Metadata: map[string]interface{}{
+				"message":      message,
+				"reservations": released,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Expired %d stock reservations of order %s", len(released), order.OrderID)
+	}
+
+	return tx.Commit()
+}
+
+// lockExpiredOrders returns the orders of up to limit expired reservations
+// whose payment was never authorized and that have not shipped. Once a
+// payment is authorized the orchestrator decides what happens to the stock,
+// whatever the payment's later status. The reservations are locked, skipping
+// those another instance or a release request is working on.
+func (s *StockService) lockExpiredOrders(ctx context.Context, tx *sql.Tx, limit int) ([]expiredOrder, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT r.order_id, o.user_id, o.total_amount
+		FROM stock_reservations r
+		JOIN orders o ON o.id = r.order_id
+		WHERE r.status = 'RESERVED' AND r.expires_at < $1
+		  AND o.status NOT IN ('SHIPPED', 'DELIVERED')
+		  AND NOT EXISTS (
+			SELECT 1 FROM payment_transactions p
+			WHERE p.order_id = r.order_id AND p.status <> 'FAILED'
+		  )
+		ORDER BY r.expires_at
+		LIMIT $2
+		FOR UPDATE OF r SKIP LOCKED
+	`, time.Now(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired stock reservations: %v", err)
+	}
+	defer rows.Close()
+
+	var orders []expiredOrder
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var order expiredOrder
+		if err := rows.Scan(&order.OrderID, &order.UserID, &order.TotalAmount); err != nil {
+			return nil, err
+		}
+		if seen[order.OrderID] {
+			continue
+		}
+		seen[order.OrderID] = true
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
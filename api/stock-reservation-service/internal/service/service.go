@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -13,9 +14,9 @@ import (
 )
 
 type StockService struct {
-	db       *sql.DB
-	rabbitMQ *shared.RabbitMQ
-	config   *config.StockReservationConfig
+	db     *sql.DB
+	outbox shared.EventOutbox
+	config *config.StockReservationConfig
 }
 
 type StockReservationResult struct {
@@ -30,32 +31,50 @@ type StockReservation struct {
 	ReservationID string `json:"reservation_id"`
 }
 
-func New(db *sql.DB, rabbitMQ *shared.RabbitMQ, config *config.StockReservationConfig) *StockService {
+func New(db *sql.DB, outbox shared.EventOutbox, config *config.StockReservationConfig) *StockService {
 	return &StockService{
-		db:       db,
-		rabbitMQ: rabbitMQ,
-		config:   config,
+		db:     db,
+		outbox: outbox,
+		config: config,
 	}
 }
 
-func (s *StockService) HandleOrderEvent(event shared.OrderEvent) error {
+// HandleOrderEvent handles an event in the inbox transaction that marks it
+// as processed, so a redelivered OrderCreated never reserves stock twice and
+// a redelivered release request never restores it twice
+func (s *StockService) HandleOrderEvent(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
 	log.Printf("Received event: %s for order: %s", event.EventType, event.OrderID)
 
-	// Only process order created events
-	if event.EventType != shared.EventOrderCreated {
+	switch event.EventType {
+	case shared.EventOrderCreated:
+		return s.processStockReservation(ctx, tx, event)
+	case shared.EventStockReleaseRequested:
+		return s.processStockRelease(ctx, tx, event)
+	case shared.EventOrderShipped:
+		return s.commitReservations(ctx, tx, event.OrderID)
+	default:
 		return nil
 	}
-
-	return s.processStockReservation(event)
 }
 
-func (s *StockService) processStockReservation(event shared.OrderEvent) error {
+func (s *StockService) processStockReservation(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
 	log.Printf("Processing stock reservation for order: %s", event.OrderID)
 
-	// Reserve stock for order items
-	result := s.reserveStock(event)
+	// Reserve stock for order items. A successful reservation stores its
+	// result event itself.
+	result, err := s.reserveStock(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+	if result.Success {
+		return nil
+	}
+
+	return s.outbox.Add(ctx, tx, s.resultEvent(event, result))
+}
 
-	// Publish stock reservation result event
+// resultEvent builds the stock reservation result event
+func (s *StockService) resultEvent(event shared.OrderEvent, result StockReservationResult) shared.OrderEvent {
 	var eventType string
 	if result.Success {
 		eventType = shared.EventStockReserved
@@ -63,54 +82,40 @@ func (s *StockService) processStockReservation(event shared.OrderEvent) error {
 		eventType = shared.EventStockInsufficient
 	}
 
-	resultEvent := shared.OrderEvent{
-		EventType:   eventType,
-		OrderID:     event.OrderID,
-		UserID:      event.UserID,
-		TotalAmount: event.TotalAmount,
-		Items:       event.Items,
-		Status:      eventType,
-		Timestamp:   time.Now(),
-		Metadata: map[string]interface{}{
-			"message":      result.Message,
-			"reservations": result.Reservations,
-		},
+	resultEvent := event.FollowUp(eventType)
+	resultEvent.Items = event.Items
+	resultEvent.Status = eventType
+	resultEvent.Metadata = map[string]interface{}{
+		"message":      result.Message,
+		"reservations": result.Reservations,
 	}
-
-	return s.rabbitMQ.PublishEvent(resultEvent)
+	return resultEvent
 }
 
-func (s *StockService) reserveStock(event shared.OrderEvent) StockReservationResult {
-	// Start transaction with retry logic
-	var result StockReservationResult
-	
-	for attempt := 0; attempt < s.config.RetryAttempts; attempt++ {
-		result = s.attemptStockReservation(event)
-		if result.Success {
-			break
-		}
-		
-		if attempt < s.config.RetryAttempts-1 {
-			log.Printf("Stock reservation attempt %d failed, retrying...", attempt+1)
-			time.Sleep(time.Duration(attempt+1) * time.Second)
-		}
+// reserveStock reserves the order's stock in a savepoint, so a reservation
+// that fails for want of stock is undone and releases its row locks before
+// its failure is reported. A missing product or too little stock is
+// reported right away, as retrying cannot change it; a database error is
+// returned so the broker retries the event under its retry policy.
+func (s *StockService) reserveStock(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) (StockReservationResult, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT stock_reservation"); err != nil {
+		return StockReservationResult{}, fmt.Errorf("failed to create savepoint: %v", err)
 	}
-	
-	return result
-}
 
-func (s *StockService) attemptStockReservation(event shared.OrderEvent) StockReservationResult {
-	// Start transaction
-	tx, err := s.db.Begin()
-	if err != nil {
-		log.Printf("Failed to start transaction: %v", err)
-		return StockReservationResult{
-			Success: false,
-			Message: "Failed to start transaction",
-		}
+	result, err := s.attemptStockReservation(ctx, tx, event)
+	if err != nil || result.Success {
+		return result, err
 	}
-	defer tx.Rollback()
 
+	if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT stock_reservation"); err != nil {
+		return result, fmt.Errorf("failed to roll back stock reservation: %v", err)
+	}
+	return result, nil
+}
+
+// attemptStockReservation reserves the stock of each item. It returns an
+// error only when the database fails.
+func (s *StockService) attemptStockReservation(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) (StockReservationResult, error) {
 	var reservations []StockReservation
 	var insufficientProducts []string
 
@@ -127,12 +132,15 @@ func (s *StockService) attemptStockReservation(event shared.OrderEvent) StockRes
 			FOR UPDATE
 		`, item.ProductID).Scan(&currentStock)
 		
-		if err != nil {
+		if err == sql.ErrNoRows {
 			log.Printf("Product not found: %s", item.ProductID)
 			return StockReservationResult{
 				Success: false,
 				Message: "Product not found: " + item.ProductID,
-			}
+			}, nil
+		}
+		if err != nil {
+			return StockReservationResult{}, fmt.Errorf("failed to lock stock of product %s: %v", item.ProductID, err)
 		}
 
 		// Check if sufficient stock available
@@ -151,11 +159,7 @@ func (s *StockService) attemptStockReservation(event shared.OrderEvent) StockRes
 		`, item.Quantity, time.Now(), item.ProductID)
 		
 		if err != nil {
-			log.Printf("Failed to update stock for product %s: %v", item.ProductID, err)
-			return StockReservationResult{
-				Success: false,
-				Message: "Failed to update stock for product: " + item.ProductID,
-			}
+			return StockReservationResult{}, fmt.Errorf("failed to update stock for product %s: %v", item.ProductID, err)
 		}
 
 		// Create stock reservation record
@@ -167,11 +171,7 @@ func (s *StockService) attemptStockReservation(event shared.OrderEvent) StockRes
 			time.Now(), time.Now().Add(time.Duration(s.config.ReservationTimeoutMinutes)*time.Minute))
 		
 		if err != nil {
-			log.Printf("Failed to create stock reservation: %v", err)
-			return StockReservationResult{
-				Success: false,
-				Message: "Failed to create stock reservation",
-			}
+			return StockReservationResult{}, fmt.Errorf("failed to create stock reservation: %v", err)
 		}
 
 		reservations = append(reservations, StockReservation{
@@ -188,23 +188,108 @@ func (s *StockService) attemptStockReservation(event shared.OrderEvent) StockRes
 		return StockReservationResult{
 			Success: false,
 			Message: "Insufficient stock for products: " + fmt.Sprintf("%v", insufficientProducts),
-		}
+		}, nil
+	}
+
+	result := StockReservationResult{
+		Success:      true,
+		Message:      "Stock reserved successfully",
+		Reservations: reservations,
+	}
+
+	// Store the result event with the reservations
+	if err := s.outbox.Add(ctx, tx, s.resultEvent(event, result)); err != nil {
+		return StockReservationResult{}, fmt.Errorf("failed to store stock reserved event: %v", err)
 	}
 
-	// Commit transaction
-	err = tx.Commit()
+	log.Printf("Stock reservation completed successfully for order: %s", event.OrderID)
+	return result, nil
+} 
+// processStockRelease gives the reserved stock of a cancelled order back and
+// reports the release to the orchestrator
+func (s *StockService) processStockRelease(ctx context.Context, tx *sql.Tx, event shared.OrderEvent) error {
+	reason, _ := event.Metadata["reason"].(string)
+	log.Printf("Releasing stock for order: %s, reason: %s", event.OrderID, reason)
+
+	released, err := s.releaseReservations(ctx, tx, event.OrderID, "RELEASED")
 	if err != nil {
-		log.Printf("Failed to commit transaction: %v", err)
-		return StockReservationResult{
-			Success: false,
-			Message: "Failed to commit stock reservation",
+		return err
+	}
+
+	releasedEvent := event.FollowUp(shared.EventStockReleased)
+	releasedEvent.Status = shared.EventStockReleased
+	releasedEvent.Metadata = map[string]interface{}{
+		"message":      fmt.Sprintf("Released %d stock reservations", len(released)),
+		"reason":       reason,
+		"reservations": released,
+	}
+	return s.outbox.Add(ctx, tx, releasedEvent)
+}
+
+// commitReservations marks the reservations of a shipped order as
+// committed: the stock has left the warehouse and is never given back
+func (s *StockService) commitReservations(ctx context.Context, tx *sql.Tx, orderID string) error {
+	res, err := tx.ExecContext(ctx,
+		"UPDATE stock_reservations SET status = 'COMMITTED' WHERE order_id = $1 AND status = 'RESERVED'",
+		orderID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to commit stock reservations of order %s: %v", orderID, err)
+	}
+
+	committed, _ := res.RowsAffected()
+	log.Printf("Committed %d stock reservations of shipped order %s", committed, orderID)
+	return nil
+}
+
+// releaseReservations restores the product quantities held by the order's
+// RESERVED reservations and moves the reservations to status
+func (s *StockService) releaseReservations(ctx context.Context, tx *sql.Tx, orderID, status string) ([]StockReservation, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, product_id, quantity
+		FROM stock_reservations
+		WHERE order_id = $1 AND status = 'RESERVED'
+		ORDER BY product_id
+		FOR UPDATE
+	`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stock reservations: %v", err)
+	}
+
+	var reservations []StockReservation
+	for rows.Next() {
+		var r StockReservation
+		if err := rows.Scan(&r.ReservationID, &r.ProductID, &r.Quantity); err != nil {
+			rows.Close()
+			return nil, err
 		}
+		reservations = append(reservations, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	log.Printf("Stock reservation completed successfully for order: %s", event.OrderID)
-	return StockReservationResult{
-		Success:      true,
-		Message:      "Stock reserved successfully",
-		Reservations: reservations,
+	for _, r := range reservations {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE products 
+			SET stock_quantity = stock_quantity + $1, updated_at = $2 
+			WHERE id = $3
+		`, r.Quantity, time.Now(), r.ProductID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore stock for product %s: %v", r.ProductID, err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE stock_reservations SET status = $1 WHERE id = $2",
+			status, r.ReservationID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update stock reservation %s: %v", r.ReservationID, err)
+		}
+
+		log.Printf("Released %d units of product %s for order %s", r.Quantity, r.ProductID, orderID)
 	}
-} 
\ No newline at end of file
+
+	return reservations, nil
+}
@@ -1,4 +1,4 @@
-import { useState, useEffect } from 'react';
+import { useState, useEffect, useRef } from 'react';
 import './App.css';
 import { AuthProvider, useAuth } from './contexts/AuthContext';
 import AuthForm from './components/AuthForm';
@@ -75,6 +75,70 @@ function MainApp() {
     }
   }, [isAuthenticated, currentPage, filters]);
 
+  // The stream outlives renders; it reloads orders through the latest
+  // fetchOrders, which sees the current user and token
+  const fetchOrdersRef = useRef<(() => Promise<void>) | null>(null);
+
+  // Live order status updates. The stream is opened with a short-lived
+  // ticket rather than the access token, which would end up in URL logs. A
+  // ticket is only good for opening the stream, so after an error the
+  // stream is reopened with a new one, resuming from the last event.
+  useEffect(() => {
+    if (!isAuthenticated || !token) return;
+
+    let source: EventSource | undefined;
+    let lastEventId = '';
+    let retry: ReturnType<typeof setTimeout> | undefined;
+    let closed = false;
+
+    const reconnect = () => {
+      if (!closed) retry = setTimeout(connect, 3000);
+    };
+
+    const connect = async () => {
+      try {
+        const response = await fetch(`${API_BASE_URL}/orders/stream/ticket`, {
+          method: 'POST',
+          headers: { 'Authorization': `Bearer ${token}` },
+        });
+        if (!response.ok) {
+          throw new Error(`stream ticket request failed with ${response.status}`);
+        }
+        const { ticket } = await response.json();
+        if (closed) return;
+
+        const params = new URLSearchParams({ ticket });
+        if (lastEventId) params.append('last_event_id', lastEventId);
+        source = new EventSource(`${API_BASE_URL}/orders/stream?${params.toString()}`);
+        source.addEventListener('status', (e) => {
+          const message = e as MessageEvent;
+          lastEventId = message.lastEventId || lastEventId;
+          const update = JSON.parse(message.data);
+          setOrders(prev => prev.map(order =>
+            order.order_id === update.order_id ? { ...order, status: update.status } : order
+          ));
+        });
+        source.addEventListener('reset', () => {
+          fetchOrdersRef.current?.();
+        });
+        source.onerror = () => {
+          source?.close();
+          reconnect();
+        };
+      } catch (error) {
+        console.error('Order stream error:', error);
+        reconnect();
+      }
+    };
+
+    connect();
+    return () => {
+      closed = true;
+      clearTimeout(retry);
+      source?.close();
+    };
+  }, [isAuthenticated, token]);
+
   const getAuthHeaders = () => {
     return {
       'Content-Type': 'application/json',
@@ -148,6 +212,9 @@ function MainApp() {
       console.error('Siparişler yüklenirken hata:', error);
     }
   };
+  useEffect(() => {
+    fetchOrdersRef.current = fetchOrders;
+  });
 
   const addToCart = (product: Product) => {
     setCart(currentCart => {
@@ -23,6 +23,7 @@ CREATE TABLE IF NOT EXISTS orders (
     customer_email VARCHAR(255),
     total_amount DECIMAL(10,2) NOT NULL,
     status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    cancellation_reason TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -59,10 +60,48 @@ CREATE TABLE IF NOT EXISTS payment_transactions (
     transaction_id VARCHAR(255),
     message TEXT,
     provider_response TEXT,
+    captured_amount DECIMAL(10,2),
+    authorized_at TIMESTAMP,
+    authorization_expires_at TIMESTAMP,
+    captured_at TIMESTAMP,
+    voided_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Create payment ledger (required by payment-processing-service). Every
+-- authorization, capture, void and refund of a payment transaction is an
+-- entry; failed refunds are kept with status FAILED and a failure_code saying
+-- why, and refunds waiting for the provider's answer are PENDING.
+CREATE TABLE IF NOT EXISTS payment_ledger (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    order_id UUID NOT NULL,
+    payment_transaction_id UUID NOT NULL REFERENCES payment_transactions(id),
+    entry_type VARCHAR(50) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    reason TEXT,
+    failure_code VARCHAR(50),
+    failure_reason TEXT,
+    request_id VARCHAR(255) UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Per-order payment balance for finance, built from the ledger
+CREATE OR REPLACE VIEW order_payment_balances AS
+SELECT
+    order_id,
+    COALESCE(SUM(amount) FILTER (WHERE entry_type = 'AUTHORIZATION' AND status = 'SUCCEEDED'), 0) AS authorized_amount,
+    COALESCE(SUM(amount) FILTER (WHERE entry_type = 'CAPTURE' AND status = 'SUCCEEDED'), 0) AS captured_amount,
+    COALESCE(SUM(amount) FILTER (WHERE entry_type = 'REFUND' AND status = 'SUCCEEDED'), 0) AS refunded_amount,
+    COALESCE(SUM(amount) FILTER (WHERE entry_type = 'CAPTURE' AND status = 'SUCCEEDED'), 0)
+        - COALESCE(SUM(amount) FILTER (WHERE entry_type = 'REFUND' AND status = 'SUCCEEDED'), 0) AS balance,
+    COUNT(*) FILTER (WHERE entry_type = 'REFUND' AND status = 'FAILED') AS failed_refunds,
+    MAX(created_at) AS last_entry_at
+FROM payment_ledger
+GROUP BY order_id;
+
 -- Create users table (required by auth-service)
 CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -125,6 +164,75 @@ CREATE TABLE IF NOT EXISTS stock_reservations (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Create outbox table (events waiting to be published by each service's relay)
+CREATE TABLE IF NOT EXISTS outbox (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    aggregate_id UUID NOT NULL,
+    producer VARCHAR(100) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    trace_context JSONB,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP
+);
+
+-- Create processed events table (inbox used by consumers to skip redelivered events)
+CREATE TABLE IF NOT EXISTS processed_events (
+    consumer VARCHAR(100) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (consumer, event_id)
+);
+
+-- Create order events table (append-only store of every published event)
+CREATE TABLE IF NOT EXISTS order_events (
+    sequence BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL UNIQUE,
+    order_id UUID NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    correlation_id VARCHAR(255),
+    causation_id VARCHAR(255),
+    producer VARCHAR(100),
+    schema_version INTEGER NOT NULL,
+    payload JSONB NOT NULL,
+    occurred_at TIMESTAMP NOT NULL,
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create shipping_info table (required by shipping-service). A shipment is
+-- SCHEDULED until ship_after, then SHIPPED, or CANCELLED if its order was
+-- cancelled meanwhile.
+CREATE TABLE IF NOT EXISTS shipping_info (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    order_id UUID NOT NULL UNIQUE,
+    tracking_number VARCHAR(255) NOT NULL,
+    carrier VARCHAR(100) NOT NULL,
+    estimated_delivery_days INTEGER,
+    status VARCHAR(50) NOT NULL,
+    message TEXT,
+    ready_event_id VARCHAR(255),
+    ship_after TIMESTAMP,
+    shipped_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create order sagas table (workflow state kept by order-orchestrator-service)
+CREATE TABLE IF NOT EXISTS order_sagas (
+    order_id UUID PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    total_amount DECIMAL(10,2) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    payment_status VARCHAR(50) NOT NULL,
+    stock_status VARCHAR(50) NOT NULL,
+    failure_reason TEXT,
+    deadline_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Insert sample products with specific UUIDs - SIMPLIFIED VERSION
 -- First batch: Electronics
 INSERT INTO products (id, name, description, price, stock_quantity) VALUES
@@ -338,6 +446,9 @@ CREATE INDEX IF NOT EXISTS idx_order_items_product_id ON order_items(product_id)
 CREATE INDEX IF NOT EXISTS idx_payments_order_id ON payments(order_id);
 CREATE INDEX IF NOT EXISTS idx_payment_transactions_order_id ON payment_transactions(order_id);
 CREATE INDEX IF NOT EXISTS idx_payment_transactions_status ON payment_transactions(status);
+CREATE INDEX IF NOT EXISTS idx_payment_ledger_order_id ON payment_ledger(order_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_payment_ledger_payment_transaction_id ON payment_ledger(payment_transaction_id);
+CREATE INDEX IF NOT EXISTS idx_payment_transactions_authorization_expires_at ON payment_transactions(authorization_expires_at) WHERE status IN ('AUTHORIZED', 'CAPTURE_FAILED');
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
 CREATE INDEX IF NOT EXISTS idx_users_is_active ON users(is_active);
@@ -346,10 +457,18 @@ CREATE INDEX IF NOT EXISTS idx_user_sessions_token_hash ON user_sessions(token_h
 CREATE INDEX IF NOT EXISTS idx_user_sessions_expires_at ON user_sessions(expires_at);
 CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id);
 CREATE INDEX IF NOT EXISTS idx_order_status_history_event_type ON order_status_history(event_type);
+CREATE INDEX IF NOT EXISTS idx_shipping_info_ship_after ON shipping_info(ship_after) WHERE status = 'SCHEDULED';
 CREATE INDEX IF NOT EXISTS idx_shipments_order_id ON shipments(order_id);
 CREATE INDEX IF NOT EXISTS idx_shipments_tracking_number ON shipments(tracking_number);
 CREATE INDEX IF NOT EXISTS idx_stock_reservations_product_id ON stock_reservations(product_id);
 CREATE INDEX IF NOT EXISTS idx_stock_reservations_order_id ON stock_reservations(order_id);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_expires_at ON stock_reservations(expires_at) WHERE status = 'RESERVED';
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(producer, aggregate_id, created_at) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_order_events_order_id ON order_events(order_id, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_order_events_event_type ON order_events(event_type, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_order_events_occurred_at ON order_events(occurred_at);
+CREATE INDEX IF NOT EXISTS idx_order_events_user_id ON order_events((payload->>'user_id'), event_type, sequence);
+CREATE INDEX IF NOT EXISTS idx_order_sagas_deadline ON order_sagas(deadline_at) WHERE status = 'STARTED';
 
 -- Create trigger function to update updated_at timestamp
 CREATE OR REPLACE FUNCTION update_updated_at_column()
@@ -391,5 +510,18 @@ CREATE TRIGGER update_shipments_updated_at
     BEFORE UPDATE ON shipments 
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
 
+-- Keep the order events store append-only
+CREATE OR REPLACE FUNCTION reject_order_events_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'order_events is append-only';
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS order_events_append_only ON order_events;
+CREATE TRIGGER order_events_append_only 
+    BEFORE UPDATE OR DELETE ON order_events 
+    FOR EACH ROW EXECUTE FUNCTION reject_order_events_change();
+
 -- Grant permissions to orderuser (if needed)
 -- This is automatically handled by PostgreSQL when using POSTGRES_USER in Docker 
\ No newline at end of file